@@ -2,10 +2,11 @@ package main
 
 import (
 	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net"
-	"net/http"
 	"os"
 	"runtime"
 	"strconv"
@@ -15,6 +16,7 @@ import (
 	"github.com/pagpeter/quic-go/http3"
 	"github.com/pagpeter/trackme/pkg/server"
 	"github.com/pagpeter/trackme/pkg/tcp"
+	"github.com/pagpeter/trackme/pkg/types"
 	"github.com/pagpeter/trackme/pkg/utils"
 	utls "github.com/wwhtrbbtt/utls"
 )
@@ -23,6 +25,15 @@ var cert tls.Certificate
 var utlsCert utls.Certificate
 var srv *server.Server
 var local = false
+var savedSYN *tcp.SavedSYNSource
+
+const (
+	// How long the plain server waits after a failed accept, doubling up to the maximum
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
+var captureFile = flag.String("capture-file", "", "replay a pcap or pcapng file instead of capturing on the device")
 
 func logCrash(r interface{}) {
 	crashInfo := fmt.Sprintf("PANIC: %v\n", r)
@@ -59,66 +70,152 @@ func init() {
 	}
 }
 
-func redirect(w http.ResponseWriter, r *http.Request) {
-	http.Redirect(w, r, srv.GetConfig().HTTPRedirect, http.StatusMovedPermanently)
-}
-
-func StartRedirectServer(host, port string) {
-	// Starts an HTTP server on port 80 that redirects to the HTTPS server on port 443
+func StartPlainServer(host, port string) {
+	// Starts a server on port 80 that fingerprints h2c clients and plain HTTP/1 requests,
+	// and redirects the latter to the HTTPS server on port 443
 
 	local = host == "" && port != "443"
 	srv.SetLocal(local)
 
-	log.Println("Starting Redirect Server:", srv.GetConfig().HTTPRedirect)
+	log.Println("Starting Plain HTTP Server, redirecting to:", srv.GetConfig().HTTPRedirect)
 	log.Println("Listening on", host+":"+port)
 
-	http.HandleFunc("/", redirect)
-	if err := http.ListenAndServe(host+":"+port, nil); err != nil {
-		log.Fatal("ListenAndServe: ", err)
+	inner, err := listenTCP(host + ":" + port)
+	if err != nil {
+		log.Fatal("Listen: ", err)
+	}
+	listener, err := srv.AcceptProxyProtocol(inner)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer listener.Close()
+
+	var backoff time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// Temporary errors like running out of file descriptors would
+			// otherwise spin the loop
+			backoff = min(max(2*backoff, minAcceptBackoff), maxAcceptBackoff)
+			log.Println("Error accepting plain connection, retrying in", backoff, err)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+		go func() {
+			defer func() {
+				if r := recover(); r != nil {
+					logCrash(r)
+					if err := conn.Close(); err != nil {
+						log.Println("Error closing connection after panic:", err)
+					}
+				}
+			}()
+
+			if err := srv.HandlePlainConnection(conn); err != nil {
+				server.Log(fmt.Sprintf("Plain request failed for %s: %v", conn.RemoteAddr(), err))
+				if err := conn.Close(); err != nil {
+					log.Println("Error closing failed connection:", err)
+				}
+			}
+		}()
 	}
 }
 
-// Timeout function
-func timeoutHandleTLSConnection(conn net.Conn) error {
-	result := make(chan error)
-	go func() {
-		result <- srv.HandleTLSConnection(conn)
-	}()
-	select {
-	case <-time.After(15 * time.Second):
-		return fmt.Errorf("connection timed out")
-	case err := <-result:
-		return err
+// listenTCP listens on a TCP address, keeping the SYN of every connection if
+// TCP fingerprints come from saved SYNs
+func listenTCP(addr string) (net.Listener, error) {
+	if savedSYN != nil {
+		return savedSYN.Listen("tcp", addr)
 	}
+	return net.Listen("tcp", addr)
 }
 
-func StartHTTP3Server(host string, port int) {
+// StartHTTP3Server starts an HTTP/3 server. probe is empty for the regular
+// server, or the mode of a server that probes its clients.
+func StartHTTP3Server(host string, port int, probe string) {
 	// Use the server's HTTP/3 handler
-	handler := srv.HandleHTTP3()
+	handler := srv.HandleHTTP3(probe)
 
-	// Configure TLS for HTTP/3
+	// Configure TLS for HTTP/3. The client's traffic secrets are kept to
+	// read the HTTP/3 frames it sent.
 	h3TLSConfig := http3.ConfigureTLSConfig(&tls.Config{
 		Certificates: []tls.Certificate{cert},
 		NextProtos:   []string{"h3"},
+		KeyLogWriter: srv.QUICKeyLog(),
 	})
 
 	addr := fmt.Sprintf("%s:%d", host, port)
 
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		log.Printf("HTTP/3 server error: %v", err)
+		return
+	}
+	udpConn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		log.Printf("HTTP/3 server error: %v", err)
+		return
+	}
+	defer udpConn.Close()
+
+	// The socket is wrapped to record the client's QUIC Initial packets
+	tr := &quic.Transport{
+		Conn:   srv.RecordQUICInitials(udpConn),
+		Tracer: srv.NewQUICTransportTracer(),
+	}
+	quicConfig := &quic.Config{
+		Allow0RTT: true,
+		Tracer:    srv.NewQUICTracer,
+	}
+	server.ConfigureQUICProbe(probe, tr, quicConfig, h3TLSConfig)
+
+	listener, err := tr.ListenEarly(h3TLSConfig, quicConfig)
+	if err != nil {
+		log.Printf("HTTP/3 server error: %v", err)
+		return
+	}
+
 	h3Server := &http3.Server{
-		Handler:   handler,
-		Addr:      addr,
-		TLSConfig: h3TLSConfig,
-		QUICConfig: &quic.Config{
-			Allow0RTT: true,
-		},
+		Handler:           handler,
+		Addr:              addr,
+		TLSConfig:         h3TLSConfig,
+		UniStreamHijacker: srv.HTTP3UniStreamHijacker,
+		QUICConfig:        quicConfig,
 	}
 
-	log.Println("Starting HTTP/3 server on", addr)
-	if err := h3Server.ListenAndServe(); err != nil {
+	if probe != "" {
+		log.Printf("Starting HTTP/3 %s probe server on %s", probe, addr)
+	} else {
+		log.Println("Starting HTTP/3 server on", addr)
+	}
+	if err := h3Server.ServeListener(listener); err != nil {
 		log.Printf("HTTP/3 server error: %v", err)
 	}
 }
 
+// startQUICProbeServers starts the HTTP/3 probe servers that have a port configured
+func startQUICProbeServers(host string) {
+	probes := map[string]string{
+		server.QUICProbeRetry:              srv.GetConfig().QUICRetryPort,
+		server.QUICProbeVersionNegotiation: srv.GetConfig().QUICVersionNegotiationPort,
+		server.QUICProbeHelloRetryRequest:  srv.GetConfig().QUICHelloRetryPort,
+	}
+	for probe, p := range probes {
+		if p == "" {
+			continue
+		}
+		port, err := strconv.Atoi(p)
+		if err != nil {
+			log.Fatal("Error parsing "+probe+" probe port", err)
+		}
+		go StartHTTP3Server(host, port, probe)
+	}
+}
+
 func main() {
 	defer func() {
 		if r := recover(); r != nil {
@@ -127,6 +224,12 @@ func main() {
 		}
 	}()
 
+	flag.Parse()
+	if *captureFile != "" {
+		srv.GetConfig().CaptureFile = *captureFile
+	}
+	srv.ConfigureFingerprintStores()
+
 	log.Println("Starting server...")
 	log.Println("Listening on " + srv.GetConfig().Host + ":" + srv.GetConfig().TLSPort)
 
@@ -153,23 +256,59 @@ func main() {
 		Certificates: []utls.Certificate{utlsCert},
 	}
 
-	listener, err := utls.Listen("tcp", srv.GetConfig().Host+":"+srv.GetConfig().TLSPort, &config)
+	switch srv.GetConfig().TCPSource {
+	case types.TCPSourceSavedSYN:
+		savedSYN = tcp.NewSavedSYNSource(srv)
+	case types.TCPSourcePcap, "":
+	default:
+		log.Fatal("Unknown tcp_source: ", srv.GetConfig().TCPSource)
+	}
+
+	inner, err := listenTCP(srv.GetConfig().Host + ":" + srv.GetConfig().TLSPort)
 	if err != nil {
 		log.Fatal("Error starting tcp listener", err)
 	}
+	proxied, err := srv.AcceptProxyProtocol(inner)
+	if err != nil {
+		log.Fatal(err)
+	}
+	listener := utls.NewListener(server.TimeTLSHandshakes(proxied), &config)
 
 	tlsPort, err := strconv.Atoi(srv.GetConfig().TLSPort)
 	if err != nil {
 		log.Fatal("Error parsing tls port", err)
 	}
+	httpPort, err := strconv.Atoi(srv.GetConfig().HTTPPort)
+	if err != nil {
+		log.Fatal("Error parsing http port", err)
+	}
 
 	defer listener.Close()
-	go StartRedirectServer(srv.GetConfig().Host, srv.GetConfig().HTTPPort)
+	go StartPlainServer(srv.GetConfig().Host, srv.GetConfig().HTTPPort)
 	if srv.GetConfig().EnableQUIC {
-		go StartHTTP3Server(srv.GetConfig().Host, tlsPort)
+		go StartHTTP3Server(srv.GetConfig().Host, tlsPort, "")
+		startQUICProbeServers(srv.GetConfig().Host)
 	}
-	if srv.GetConfig().Device != "" {
-		go tcp.SniffTCP(srv.GetConfig().Device, tlsPort, srv)
+	if srv.GetConfig().Device != "" || srv.GetConfig().CaptureFile != "" {
+		quicPort := 0
+		if srv.GetConfig().EnableQUIC {
+			quicPort = tlsPort
+		}
+		if savedSYN != nil {
+			// Only the HTTP/3 datagrams are still sniffed
+			tlsPort, httpPort = 0, 0
+		}
+		if tlsPort == 0 && httpPort == 0 && quicPort == 0 {
+			log.Println("Not capturing packets: SYNs are read from the sockets and QUIC is disabled")
+		} else if srv.GetConfig().CaptureFile != "" {
+			go func() {
+				if err := tcp.ReplayCapture(srv.GetConfig().CaptureFile, tlsPort, httpPort, quicPort, srv); err != nil {
+					log.Fatal(err)
+				}
+			}()
+		} else {
+			go tcp.SniffTCP(srv.GetConfig().Device, tlsPort, httpPort, quicPort, srv)
+		}
 	}
 
 	for {
@@ -210,7 +349,7 @@ func main() {
 						}
 					}()
 
-					if err := timeoutHandleTLSConnection(conn); err != nil {
+					if err := srv.HandleTLSConnection(conn); err != nil {
 						server.Log(fmt.Sprintf("Request failed for %s: %v", ip, err))
 						if err := conn.Close(); err != nil {
 							log.Println("Error closing failed connection:", err)
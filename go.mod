@@ -6,7 +6,9 @@ require (
 	github.com/google/gopacket v1.1.19
 	github.com/pagpeter/quic-go v0.0.0-20260120153640-0de4e3b8377b
 	github.com/wwhtrbbtt/utls v0.0.0-20220918194152-45ee2a20799c
+	golang.org/x/crypto v0.41.0
 	golang.org/x/net v0.43.0
+	golang.org/x/sys v0.35.0
 )
 
 // replace github.com/pagpeter/quic-go => ../quic-go
@@ -16,10 +18,8 @@ require (
 	github.com/klauspost/compress v1.17.11 // indirect
 	github.com/quic-go/qpack v0.5.1 // indirect
 	github.com/refraction-networking/utls v1.1.2 // indirect
-	golang.org/x/crypto v0.41.0 // indirect
 	golang.org/x/mod v0.27.0 // indirect
 	golang.org/x/sync v0.16.0 // indirect
-	golang.org/x/sys v0.35.0 // indirect
 	golang.org/x/text v0.28.0 // indirect
 	golang.org/x/tools v0.36.0 // indirect
 )
@@ -22,8 +22,7 @@ func GetHTTP3SettingName(id uint64) string {
 	case 0x33:
 		return "SETTINGS_H3_DATAGRAM"
 	default:
-		// Check if it's a GREASE value (0x1f * N + 0x21)
-		if (id-0x21)%0x1f == 0 {
+		if IsHTTP3Grease(id) {
 			return "GREASE"
 		}
 		return fmt.Sprintf("UNKNOWN_%d", id)
@@ -0,0 +1,145 @@
+package http
+
+import (
+	"bufio"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/pagpeter/trackme/pkg/types"
+	"github.com/pagpeter/trackme/pkg/utils"
+)
+
+// Requests with a header section larger than this are rejected
+const MaxHTTP1HeadSize = 64 * 1024
+
+// Anomalies that can be recorded while parsing an HTTP/1.x request
+const (
+	AnomalyBareLF                   = "bare_lf"
+	AnomalyObsFold                  = "obs_fold"
+	AnomalyLeadingEmptyLine         = "leading_empty_line"
+	AnomalyInvalidRequestLine       = "invalid_request_line"
+	AnomalyInvalidHeaderLine        = "invalid_header_line"
+	AnomalyWhitespaceBeforeColon    = "whitespace_before_colon"
+	AnomalyDuplicateHeader          = "duplicate_header"
+	AnomalyMissingHost              = "missing_host"
+	AnomalyContentLengthAndChunking = "content_length_and_transfer_encoding"
+)
+
+// ParseHTTP1 reads an HTTP/1.x request head from r, up to and including the
+// empty line, and parses it. Header lines are kept as sent (casing, spacing),
+// the raw bytes are preserved, and everything a strict parser would complain
+// about is recorded as an anomaly instead of being rejected.
+func ParseHTTP1(r *bufio.Reader) (types.Response, error) {
+	var raw []byte
+	var lines []string
+	var crlf, lf int
+	anomalies := []string{}
+	addAnomaly := func(a string) {
+		if !slices.Contains(anomalies, a) {
+			anomalies = append(anomalies, a)
+		}
+	}
+
+	for {
+		line, err := r.ReadBytes('\n')
+		raw = append(raw, line...)
+		if err != nil {
+			return types.Response{}, err
+		}
+		if len(raw) > MaxHTTP1HeadSize {
+			return types.Response{}, fmt.Errorf("request head exceeds %d bytes", MaxHTTP1HeadSize)
+		}
+
+		text := string(line)
+		if strings.HasSuffix(text, "\r\n") {
+			crlf++
+			text = text[:len(text)-2]
+		} else {
+			lf++
+			text = text[:len(text)-1]
+			addAnomaly(AnomalyBareLF)
+		}
+
+		if text == "" {
+			// RFC 9112, 2.2: empty lines before the request line should be ignored
+			if len(lines) == 0 {
+				addAnomaly(AnomalyLeadingEmptyLine)
+				continue
+			}
+			break
+		}
+		lines = append(lines, text)
+	}
+
+	// Continuation lines (obs-fold) are joined with the header they belong to
+	var headers []string
+	for _, line := range lines[1:] {
+		if (line[0] == ' ' || line[0] == '\t') && len(headers) > 0 {
+			addAnomaly(AnomalyObsFold)
+			headers[len(headers)-1] += " " + strings.TrimLeft(line, " \t")
+			continue
+		}
+		headers = append(headers, line)
+	}
+
+	seen := map[string]bool{}
+	var order []string
+	var userAgent string
+	for _, h := range headers {
+		name, value, ok := strings.Cut(h, ":")
+		if !ok {
+			addAnomaly(AnomalyInvalidHeaderLine)
+			continue
+		}
+		if strings.TrimRight(name, " \t") != name {
+			addAnomaly(AnomalyWhitespaceBeforeColon)
+		}
+		lower := strings.ToLower(strings.TrimSpace(name))
+		if seen[lower] {
+			addAnomaly(AnomalyDuplicateHeader + ":" + lower)
+		}
+		seen[lower] = true
+		order = append(order, lower)
+		if lower == "user-agent" && userAgent == "" {
+			userAgent = strings.TrimSpace(value)
+		}
+	}
+
+	method, path, version := "--", "--", "--"
+	if parts := strings.Split(lines[0], " "); len(parts) == 3 {
+		method, path, version = parts[0], parts[1], parts[2]
+	} else {
+		addAnomaly(AnomalyInvalidRequestLine)
+	}
+	if version == "HTTP/1.1" && !seen["host"] {
+		addAnomaly(AnomalyMissingHost)
+	}
+	if seen["content-length"] && seen["transfer-encoding"] {
+		addAnomaly(AnomalyContentLengthAndChunking)
+	}
+
+	lineEndings := "crlf"
+	if lf > 0 && crlf > 0 {
+		lineEndings = "mixed"
+	} else if lf > 0 {
+		lineEndings = "lf"
+	}
+
+	headerOrder := strings.Join(order, ",")
+	return types.Response{
+		HTTPVersion: version,
+		Path:        path,
+		Method:      method,
+		UserAgent:   userAgent,
+		Http1: &types.Http1Details{
+			RequestLine:     lines[0],
+			Headers:         headers,
+			LineEndings:     lineEndings,
+			Anomalies:       anomalies,
+			HeaderOrder:     headerOrder,
+			HeaderOrderHash: utils.GetMD5Hash(headerOrder),
+			Raw:             string(raw),
+		},
+	}, nil
+}
@@ -0,0 +1,193 @@
+package http
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseHTTP1(t *testing.T) {
+	tests := []struct {
+		name        string
+		raw         string
+		order       string
+		lineEndings string
+		anomalies   []string
+	}{
+		{
+			name:        "clean",
+			raw:         "GET / HTTP/1.1\r\nHost: example.com\r\nUser-Agent: test\r\nAccept: */*\r\n\r\n",
+			order:       "host,user-agent,accept",
+			lineEndings: "crlf",
+			anomalies:   []string{},
+		},
+		{
+			name:        AnomalyBareLF,
+			raw:         "GET / HTTP/1.1\nHost: example.com\r\nAccept: */*\n\r\n",
+			order:       "host,accept",
+			lineEndings: "mixed",
+			anomalies:   []string{AnomalyBareLF},
+		},
+		{
+			name:        AnomalyObsFold,
+			raw:         "GET / HTTP/1.1\r\nHost: example.com\r\nX-Folded: a\r\n \tb\r\nAccept: */*\r\n\r\n",
+			order:       "host,x-folded,accept",
+			lineEndings: "crlf",
+			anomalies:   []string{AnomalyObsFold},
+		},
+		{
+			name:        AnomalyLeadingEmptyLine,
+			raw:         "\r\n\r\nGET / HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			order:       "host",
+			lineEndings: "crlf",
+			anomalies:   []string{AnomalyLeadingEmptyLine},
+		},
+		{
+			name:        AnomalyWhitespaceBeforeColon,
+			raw:         "GET / HTTP/1.1\r\nHost : example.com\r\nAccept: */*\r\n\r\n",
+			order:       "host,accept",
+			lineEndings: "crlf",
+			anomalies:   []string{AnomalyWhitespaceBeforeColon},
+		},
+		{
+			name:        AnomalyDuplicateHeader,
+			raw:         "GET / HTTP/1.1\r\nHost: example.com\r\nAccept: */*\r\naccept: text/html\r\n\r\n",
+			order:       "host,accept,accept",
+			lineEndings: "crlf",
+			anomalies:   []string{AnomalyDuplicateHeader + ":accept"},
+		},
+		{
+			name:        AnomalyMissingHost,
+			raw:         "GET / HTTP/1.1\r\nAccept: */*\r\n\r\n",
+			order:       "accept",
+			lineEndings: "crlf",
+			anomalies:   []string{AnomalyMissingHost},
+		},
+		{
+			name:        "http/1.0 without host",
+			raw:         "GET / HTTP/1.0\r\nAccept: */*\r\n\r\n",
+			order:       "accept",
+			lineEndings: "crlf",
+			anomalies:   []string{},
+		},
+		{
+			name:        AnomalyContentLengthAndChunking,
+			raw:         "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n",
+			order:       "host,content-length,transfer-encoding",
+			lineEndings: "crlf",
+			anomalies:   []string{AnomalyContentLengthAndChunking},
+		},
+		{
+			name:        AnomalyInvalidRequestLine,
+			raw:         "GET /  HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			order:       "host",
+			lineEndings: "crlf",
+			anomalies:   []string{AnomalyInvalidRequestLine},
+		},
+		{
+			name:        AnomalyInvalidHeaderLine,
+			raw:         "GET / HTTP/1.1\r\nHost: example.com\r\nno colon\r\n\r\n",
+			order:       "host",
+			lineEndings: "crlf",
+			anomalies:   []string{AnomalyInvalidHeaderLine},
+		},
+		{
+			name:        "several anomalies in order",
+			raw:         "\nGET / HTTP/1.1\nAccept : */*\nAccept: text/html\n\n",
+			order:       "accept,accept",
+			lineEndings: "lf",
+			anomalies: []string{
+				AnomalyBareLF,
+				AnomalyLeadingEmptyLine,
+				AnomalyWhitespaceBeforeColon,
+				AnomalyDuplicateHeader + ":accept",
+				AnomalyMissingHost,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The body after the head must not be consumed
+			r := bufio.NewReader(strings.NewReader(tt.raw + "body"))
+			resp, err := ParseHTTP1(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h1 := resp.Http1
+			if h1.HeaderOrder != tt.order {
+				t.Errorf("header order = %q, want %q", h1.HeaderOrder, tt.order)
+			}
+			if h1.LineEndings != tt.lineEndings {
+				t.Errorf("line endings = %q, want %q", h1.LineEndings, tt.lineEndings)
+			}
+			if !slices.Equal(h1.Anomalies, tt.anomalies) {
+				t.Errorf("anomalies = %q, want %q", h1.Anomalies, tt.anomalies)
+			}
+			if h1.Raw != tt.raw {
+				t.Errorf("raw = %q, want %q", h1.Raw, tt.raw)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != "body" {
+				t.Errorf("left after the head: %q", rest)
+			}
+		})
+	}
+}
+
+func TestParseHTTP1ObsFoldJoinsValue(t *testing.T) {
+	raw := "GET / HTTP/1.1\r\nHost: example.com\r\nUser-Agent: a\r\n\tb\r\n\r\n"
+	resp, err := ParseHTTP1(bufio.NewReader(strings.NewReader(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.UserAgent != "a b" {
+		t.Errorf("user agent = %q, want %q", resp.UserAgent, "a b")
+	}
+	if want := []string{"Host: example.com", "User-Agent: a b"}; !slices.Equal(resp.Http1.Headers, want) {
+		t.Errorf("headers = %q, want %q", resp.Http1.Headers, want)
+	}
+}
+
+func TestParseHTTP1Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		err  error
+	}{
+		{name: "empty", raw: "", err: io.EOF},
+		{name: "truncated request line", raw: "GET / HTTP/1.1", err: io.EOF},
+		{name: "truncated head", raw: "GET / HTTP/1.1\r\nHost: example.com\r\n", err: io.EOF},
+		{name: "only empty lines", raw: "\r\n\r\n", err: io.EOF},
+		{
+			name: "over limit head",
+			raw:  "GET / HTTP/1.1\r\nHost: example.com\r\nX-Large: " + strings.Repeat("a", MaxHTTP1HeadSize) + "\r\n\r\n",
+		},
+		{
+			name: "over limit in many lines",
+			raw:  "GET / HTTP/1.1\r\n" + strings.Repeat("X-Header: value\r\n", MaxHTTP1HeadSize/17+1) + "\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseHTTP1(bufio.NewReader(strings.NewReader(tt.raw)))
+			if err == nil {
+				t.Fatal("no error")
+			}
+			if tt.err != nil && !errors.Is(err, tt.err) {
+				t.Errorf("err = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestParseHTTP1AtLimit(t *testing.T) {
+	head := "GET / HTTP/1.1\r\nHost: example.com\r\nX-Large: \r\n\r\n"
+	raw := strings.Replace(head, "X-Large: ", "X-Large: "+strings.Repeat("a", MaxHTTP1HeadSize-len(head)), 1)
+	if _, err := ParseHTTP1(bufio.NewReader(strings.NewReader(raw))); err != nil {
+		t.Fatalf("head of %d bytes rejected: %v", len(raw), err)
+	}
+}
@@ -0,0 +1,137 @@
+package http
+
+import (
+	"fmt"
+
+	"github.com/pagpeter/quic-go/quicvarint"
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+// HTTP/3 unidirectional stream types (RFC 9114, 6.2 and RFC 9204, 4.2)
+const (
+	HTTP3StreamControl      = 0x00
+	HTTP3StreamPush         = 0x01
+	HTTP3StreamQPACKEncoder = 0x02
+	HTTP3StreamQPACKDecoder = 0x03
+)
+
+// HTTP3Stream is what was read from the data of a client stream
+type HTTP3Stream struct {
+	// StreamType is the type at the start of a unidirectional stream
+	StreamType *uint64
+	Frames     []types.Http3Frame
+	// HeaderBlocks are the encoded field sections of the complete HEADERS frames
+	HeaderBlocks [][]byte
+}
+
+// IsHTTP3Grease checks if a stream, frame or setting type is reserved for GREASE (0x1f * N + 0x21)
+func IsHTTP3Grease(id uint64) bool {
+	return id >= 0x21 && (id-0x21)%0x1f == 0
+}
+
+// GetHTTP3FrameName returns the name of an HTTP/3 frame type
+func GetHTTP3FrameName(id uint64) string {
+	switch id {
+	case 0x00:
+		return "DATA"
+	case 0x01:
+		return "HEADERS"
+	case 0x03:
+		return "CANCEL_PUSH"
+	case 0x04:
+		return "SETTINGS"
+	case 0x05:
+		return "PUSH_PROMISE"
+	case 0x07:
+		return "GOAWAY"
+	case 0x0c:
+		return "ORIGIN"
+	case 0x0d:
+		return "MAX_PUSH_ID"
+	case 0xf0700, 0xf0701:
+		return "PRIORITY_UPDATE"
+	}
+	if IsHTTP3Grease(id) {
+		return "GREASE"
+	}
+	return fmt.Sprintf("UNKNOWN_%d", id)
+}
+
+// ParseHTTP3Stream reads the frames of a client stream from its data, which
+// may be cut off. Unidirectional streams start with their type, only the
+// control stream carries frames.
+func ParseHTTP3Stream(data []byte, unidirectional bool) HTTP3Stream {
+	var stream HTTP3Stream
+	b := data
+	if unidirectional {
+		streamType, n, err := quicvarint.Parse(b)
+		if err != nil {
+			return stream
+		}
+		stream.StreamType = &streamType
+		if streamType != HTTP3StreamControl {
+			return stream
+		}
+		b = b[n:]
+	}
+
+	for len(b) > 0 {
+		frameType, n, err := quicvarint.Parse(b)
+		if err != nil {
+			break
+		}
+		length, m, err := quicvarint.Parse(b[n:])
+		if err != nil {
+			break
+		}
+		b = b[n+m:]
+
+		frame := types.Http3Frame{
+			Type:   GetHTTP3FrameName(frameType),
+			TypeID: frameType,
+			Length: length,
+		}
+		if uint64(len(b)) < length {
+			// Only the start of the frame was received
+			stream.Frames = append(stream.Frames, frame)
+			break
+		}
+		payload := b[:length]
+		b = b[length:]
+
+		switch frameType {
+		case 0x01:
+			stream.HeaderBlocks = append(stream.HeaderBlocks, payload)
+		case 0x04:
+			frame.Settings = parseHTTP3Settings(payload)
+		case 0x03, 0x07, 0x0d:
+			if id, _, err := quicvarint.Parse(payload); err == nil {
+				frame.ID = &id
+			}
+		case 0xf0700, 0xf0701:
+			if id, n, err := quicvarint.Parse(payload); err == nil {
+				frame.PriorityUpdate = &types.Http3PriorityUpdate{ElementID: id, Priority: string(payload[n:])}
+			}
+		}
+		stream.Frames = append(stream.Frames, frame)
+	}
+	return stream
+}
+
+// parseHTTP3Settings reads the parameters of a SETTINGS frame, in order
+func parseHTTP3Settings(payload []byte) []types.Http3SettingPair {
+	settings := []types.Http3SettingPair{}
+	for len(payload) > 0 {
+		id, n, err := quicvarint.Parse(payload)
+		if err != nil {
+			break
+		}
+		value, m, err := quicvarint.Parse(payload[n:])
+		if err != nil {
+			break
+		}
+		payload = payload[n+m:]
+		settings = append(settings, types.Http3SettingPair{ID: id, Name: GetHTTP3SettingName(id), Value: value})
+	}
+	return settings
+}
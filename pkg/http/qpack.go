@@ -0,0 +1,239 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/pagpeter/trackme/pkg/types"
+	"golang.org/x/net/http2/hpack"
+)
+
+var errQPACKTruncated = errors.New("field section is truncated")
+
+// qpackStaticTable is the QPACK static table (RFC 9204, Appendix A)
+var qpackStaticTable = [...][2]string{
+	{":authority", ""},
+	{":path", "/"},
+	{"age", "0"},
+	{"content-disposition", ""},
+	{"content-length", "0"},
+	{"cookie", ""},
+	{"date", ""},
+	{"etag", ""},
+	{"if-modified-since", ""},
+	{"if-none-match", ""},
+	{"last-modified", ""},
+	{"link", ""},
+	{"location", ""},
+	{"referer", ""},
+	{"set-cookie", ""},
+	{":method", "CONNECT"},
+	{":method", "DELETE"},
+	{":method", "GET"},
+	{":method", "HEAD"},
+	{":method", "OPTIONS"},
+	{":method", "POST"},
+	{":method", "PUT"},
+	{":scheme", "http"},
+	{":scheme", "https"},
+	{":status", "103"},
+	{":status", "200"},
+	{":status", "304"},
+	{":status", "404"},
+	{":status", "503"},
+	{"accept", "*/*"},
+	{"accept", "application/dns-message"},
+	{"accept-encoding", "gzip, deflate, br"},
+	{"accept-ranges", "bytes"},
+	{"access-control-allow-headers", "cache-control"},
+	{"access-control-allow-headers", "content-type"},
+	{"access-control-allow-origin", "*"},
+	{"cache-control", "max-age=0"},
+	{"cache-control", "max-age=2592000"},
+	{"cache-control", "max-age=604800"},
+	{"cache-control", "no-cache"},
+	{"cache-control", "no-store"},
+	{"cache-control", "public, max-age=31536000"},
+	{"content-encoding", "br"},
+	{"content-encoding", "gzip"},
+	{"content-type", "application/dns-message"},
+	{"content-type", "application/javascript"},
+	{"content-type", "application/json"},
+	{"content-type", "application/x-www-form-urlencoded"},
+	{"content-type", "image/gif"},
+	{"content-type", "image/jpeg"},
+	{"content-type", "image/png"},
+	{"content-type", "text/css"},
+	{"content-type", "text/html; charset=utf-8"},
+	{"content-type", "text/plain"},
+	{"content-type", "text/plain;charset=utf-8"},
+	{"range", "bytes=0-"},
+	{"strict-transport-security", "max-age=31536000"},
+	{"strict-transport-security", "max-age=31536000; includesubdomains"},
+	{"strict-transport-security", "max-age=31536000; includesubdomains; preload"},
+	{"vary", "accept-encoding"},
+	{"vary", "origin"},
+	{"x-content-type-options", "nosniff"},
+	{"x-xss-protection", "1; mode=block"},
+	{":status", "100"},
+	{":status", "204"},
+	{":status", "206"},
+	{":status", "302"},
+	{":status", "400"},
+	{":status", "403"},
+	{":status", "421"},
+	{":status", "425"},
+	{":status", "500"},
+	{"accept-language", ""},
+	{"access-control-allow-credentials", "FALSE"},
+	{"access-control-allow-credentials", "TRUE"},
+	{"access-control-allow-headers", "*"},
+	{"access-control-allow-methods", "get"},
+	{"access-control-allow-methods", "get, post, options"},
+	{"access-control-allow-methods", "options"},
+	{"access-control-expose-headers", "content-length"},
+	{"access-control-request-headers", "content-type"},
+	{"access-control-request-method", "get"},
+	{"access-control-request-method", "post"},
+	{"alt-svc", "clear"},
+	{"authorization", ""},
+	{"content-security-policy", "script-src 'none'; object-src 'none'; base-uri 'none'"},
+	{"early-data", "1"},
+	{"expect-ct", ""},
+	{"forwarded", ""},
+	{"if-range", ""},
+	{"origin", ""},
+	{"purpose", "prefetch"},
+	{"server", ""},
+	{"timing-allow-origin", "*"},
+	{"upgrade-insecure-requests", "1"},
+	{"user-agent", ""},
+	{"x-forwarded-for", ""},
+	{"x-frame-options", "deny"},
+	{"x-frame-options", "sameorigin"},
+}
+
+// DecodeQPACK decodes a field section as sent in a HEADERS frame, keeping how
+// every field was represented. The server doesn't allow a dynamic table, so
+// dynamic table references are reported without their name and value.
+func DecodeQPACK(block []byte) ([]types.Http3HeaderField, error) {
+	b := block
+	// Required Insert Count, then the sign bit and Delta Base
+	if _, err := readQPACKInt(&b, 8); err != nil {
+		return nil, err
+	}
+	if _, err := readQPACKInt(&b, 7); err != nil {
+		return nil, err
+	}
+
+	var fields []types.Http3HeaderField
+	for len(b) > 0 {
+		var field types.Http3HeaderField
+		var index uint64
+		var err error
+		first := b[0]
+		switch {
+		case first&0x80 != 0:
+			field.Representation = "indexed"
+			field.Table = qpackTable(first&0x40 != 0)
+			index, err = readQPACKInt(&b, 6)
+		case first&0xf0 == 0x10:
+			field.Representation = "indexed_post_base"
+			field.Table = "dynamic"
+			index, err = readQPACKInt(&b, 4)
+		case first&0xc0 == 0x40:
+			field.Representation = "literal_name_ref"
+			field.NeverIndexed = first&0x20 != 0
+			field.Table = qpackTable(first&0x10 != 0)
+			index, err = readQPACKInt(&b, 4)
+		case first&0xf0 == 0x00:
+			field.Representation = "literal_post_base_name_ref"
+			field.NeverIndexed = first&0x08 != 0
+			field.Table = "dynamic"
+			index, err = readQPACKInt(&b, 3)
+		default:
+			field.Representation = "literal"
+			field.NeverIndexed = first&0x10 != 0
+			field.HuffmanName = first&0x08 != 0
+			field.Name, err = readQPACKString(&b, 3)
+		}
+		if err != nil {
+			return fields, err
+		}
+
+		if field.Table != "" {
+			field.Index = &index
+			if field.Table == "static" {
+				if index >= uint64(len(qpackStaticTable)) {
+					return fields, fmt.Errorf("invalid static table index %d", index)
+				}
+				field.Name = qpackStaticTable[index][0]
+				if field.Representation == "indexed" {
+					field.Value = qpackStaticTable[index][1]
+				}
+			}
+		}
+		if field.Representation != "indexed" && field.Representation != "indexed_post_base" {
+			if len(b) == 0 {
+				return fields, errQPACKTruncated
+			}
+			field.HuffmanValue = b[0]&0x80 != 0
+			if field.Value, err = readQPACKString(&b, 7); err != nil {
+				return fields, err
+			}
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+func qpackTable(static bool) string {
+	if static {
+		return "static"
+	}
+	return "dynamic"
+}
+
+// readQPACKInt reads an integer with an n-bit prefix (RFC 7541, 5.1)
+func readQPACKInt(b *[]byte, n int) (uint64, error) {
+	if len(*b) == 0 {
+		return 0, errQPACKTruncated
+	}
+	mask := uint64(1)<<n - 1
+	v := uint64((*b)[0]) & mask
+	*b = (*b)[1:]
+	if v < mask {
+		return v, nil
+	}
+	for shift := 0; shift < 63; shift += 7 {
+		if len(*b) == 0 {
+			return 0, errQPACKTruncated
+		}
+		c := (*b)[0]
+		*b = (*b)[1:]
+		v += uint64(c&0x7f) << shift
+		if c&0x80 == 0 {
+			return v, nil
+		}
+	}
+	return 0, errors.New("integer is too large")
+}
+
+// readQPACKString reads a string literal whose length has an n-bit prefix,
+// preceded by the Huffman flag
+func readQPACKString(b *[]byte, n int) (string, error) {
+	huffman := (*b)[0]&(1<<n) != 0
+	length, err := readQPACKInt(b, n)
+	if err != nil {
+		return "", err
+	}
+	if uint64(len(*b)) < length {
+		return "", errQPACKTruncated
+	}
+	raw := (*b)[:length]
+	*b = (*b)[length:]
+	if huffman {
+		return hpack.HuffmanDecodeToString(raw)
+	}
+	return string(raw), nil
+}
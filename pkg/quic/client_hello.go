@@ -0,0 +1,119 @@
+package quic
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// TLS extensions used by the probes
+const (
+	extensionKeyShare            = 51
+	extensionTransportParameters = 57
+	// Transport parameter with the client's chosen and available versions (RFC 9368, 3)
+	transportParameterVersionInformation = 0x11
+)
+
+// clientHelloExtensions returns the extensions of a raw ClientHello handshake message
+func clientHelloExtensions(ch []byte) (map[uint16][]byte, error) {
+	// Handshake header, legacy version and random
+	pos := 4 + 2 + 32
+	skip := func(lenBytes int) error {
+		if len(ch) < pos+lenBytes {
+			return ErrTruncated
+		}
+		l := 0
+		for i := 0; i < lenBytes; i++ {
+			l = l<<8 | int(ch[pos+i])
+		}
+		pos += lenBytes + l
+		if len(ch) < pos {
+			return ErrTruncated
+		}
+		return nil
+	}
+	// Session ID, cipher suites and compression methods
+	for _, lenBytes := range []int{1, 2, 1} {
+		if err := skip(lenBytes); err != nil {
+			return nil, err
+		}
+	}
+	if len(ch) < pos+2 {
+		return nil, ErrTruncated
+	}
+	pos += 2
+
+	extensions := map[uint16][]byte{}
+	for len(ch) >= pos+4 {
+		extType := binary.BigEndian.Uint16(ch[pos:])
+		l := int(binary.BigEndian.Uint16(ch[pos+2:]))
+		pos += 4
+		if len(ch) < pos+l {
+			return nil, ErrTruncated
+		}
+		extensions[extType] = ch[pos : pos+l]
+		pos += l
+	}
+	return extensions, nil
+}
+
+// KeyShareGroups returns the groups a ClientHello contains key shares for
+func KeyShareGroups(ch []byte) ([]uint16, error) {
+	extensions, err := clientHelloExtensions(ch)
+	if err != nil {
+		return nil, err
+	}
+	data, ok := extensions[extensionKeyShare]
+	if !ok || len(data) < 2 {
+		return nil, nil
+	}
+	var groups []uint16
+	data = data[2:]
+	for len(data) >= 4 {
+		groups = append(groups, binary.BigEndian.Uint16(data))
+		l := int(binary.BigEndian.Uint16(data[2:]))
+		if len(data) < 4+l {
+			break
+		}
+		data = data[4+l:]
+	}
+	return groups, nil
+}
+
+// VersionInformation returns the chosen and available versions the client
+// sent in its transport parameters, if it supports compatible version negotiation
+func VersionInformation(ch []byte) (uint32, []uint32, error) {
+	extensions, err := clientHelloExtensions(ch)
+	if err != nil {
+		return 0, nil, err
+	}
+	params := extensions[extensionTransportParameters]
+	for len(params) > 0 {
+		id, n, err := readVarint(params)
+		if err != nil {
+			return 0, nil, err
+		}
+		params = params[n:]
+		l, n, err := readVarint(params)
+		if err != nil {
+			return 0, nil, err
+		}
+		params = params[n:]
+		if uint64(len(params)) < l {
+			return 0, nil, ErrTruncated
+		}
+		value := params[:l]
+		params = params[l:]
+		if id != transportParameterVersionInformation {
+			continue
+		}
+		if len(value) < 4 || len(value)%4 != 0 {
+			return 0, nil, fmt.Errorf("invalid version_information length %d", len(value))
+		}
+		var available []uint32
+		for i := 4; i < len(value); i += 4 {
+			available = append(available, binary.BigEndian.Uint32(value[i:]))
+		}
+		return binary.BigEndian.Uint32(value), available, nil
+	}
+	return 0, nil, nil
+}
@@ -0,0 +1,248 @@
+package quic
+
+import (
+	"crypto/hkdf"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// QUIC versions with known Initial protection
+const (
+	Version1 uint32 = 0x00000001
+	Version2 uint32 = 0x6b3343cf
+)
+
+// Salts used to derive the Initial secrets (RFC 9001, 5.2 and RFC 9369, 3.3.1)
+var (
+	saltV1 = []byte{0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17, 0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a}
+	saltV2 = []byte{0x0d, 0xed, 0xe3, 0xde, 0xf7, 0x00, 0xa6, 0xdb, 0x81, 0x93, 0x81, 0xbe, 0x6e, 0x26, 0x9d, 0xcb, 0xf9, 0xbd, 0x2e, 0xd9}
+)
+
+var (
+	ErrNotLongHeader      = errors.New("not a long header packet")
+	ErrTruncated          = errors.New("packet is truncated")
+	ErrUnsupportedVersion = errors.New("unsupported QUIC version")
+)
+
+// LongHeaderPacket is a QUIC packet with a long header, still protected
+type LongHeaderPacket struct {
+	Version uint32
+	// Type is "initial", "0-rtt", "handshake" or "retry"
+	Type  string
+	DCID  []byte
+	SCID  []byte
+	Token []byte
+	// Raw is the whole packet, including the header
+	Raw []byte
+	// pnOffset is where the protected packet number starts
+	pnOffset int
+}
+
+// readVarint reads a QUIC variable-length integer (RFC 9000, 16)
+func readVarint(b []byte) (uint64, int, error) {
+	if len(b) == 0 {
+		return 0, 0, ErrTruncated
+	}
+	l := 1 << (b[0] >> 6)
+	if len(b) < l {
+		return 0, 0, ErrTruncated
+	}
+	v := uint64(b[0] & 0x3f)
+	for i := 1; i < l; i++ {
+		v = v<<8 | uint64(b[i])
+	}
+	return v, l, nil
+}
+
+// packetType returns the name of a long header packet type, which is encoded
+// differently in QUIC v2
+func packetType(version uint32, bits byte) string {
+	if version == Version2 {
+		bits = (bits + 3) % 4
+	}
+	return [...]string{"initial", "0-rtt", "handshake", "retry"}[bits]
+}
+
+// ParseDatagram splits a UDP datagram into its coalesced long header packets.
+// It also returns the number of bytes after the last long header packet,
+// which are either a short header packet or padding.
+func ParseDatagram(datagram []byte) ([]LongHeaderPacket, int, error) {
+	var packets []LongHeaderPacket
+	b := datagram
+	for len(b) > 0 {
+		if b[0]&0x80 == 0 || len(b) < 7 {
+			if len(packets) == 0 {
+				return nil, 0, ErrNotLongHeader
+			}
+			break
+		}
+		p, err := parseLongHeader(b)
+		if err != nil {
+			return packets, len(b), err
+		}
+		packets = append(packets, p)
+		b = b[len(p.Raw):]
+	}
+	return packets, len(b), nil
+}
+
+func parseLongHeader(b []byte) (LongHeaderPacket, error) {
+	p := LongHeaderPacket{Version: binary.BigEndian.Uint32(b[1:5])}
+	if p.Version != Version1 && p.Version != Version2 {
+		return p, ErrUnsupportedVersion
+	}
+	p.Type = packetType(p.Version, (b[0]>>4)&0x3)
+
+	pos := 5
+	readConnID := func() ([]byte, error) {
+		if len(b) <= pos {
+			return nil, ErrTruncated
+		}
+		l := int(b[pos])
+		pos++
+		if len(b) < pos+l {
+			return nil, ErrTruncated
+		}
+		id := b[pos : pos+l]
+		pos += l
+		return id, nil
+	}
+	var err error
+	if p.DCID, err = readConnID(); err != nil {
+		return p, err
+	}
+	if p.SCID, err = readConnID(); err != nil {
+		return p, err
+	}
+	if p.Type == "retry" {
+		p.Raw = b
+		return p, nil
+	}
+	if p.Type == "initial" {
+		tokenLen, n, err := readVarint(b[pos:])
+		if err != nil {
+			return p, err
+		}
+		pos += n
+		if uint64(len(b)-pos) < tokenLen {
+			return p, ErrTruncated
+		}
+		p.Token = b[pos : pos+int(tokenLen)]
+		pos += int(tokenLen)
+	}
+	length, n, err := readVarint(b[pos:])
+	if err != nil {
+		return p, err
+	}
+	pos += n
+	if uint64(len(b)-pos) < length {
+		return p, ErrTruncated
+	}
+	p.pnOffset = pos
+	p.Raw = b[:pos+int(length)]
+	return p, nil
+}
+
+// initialKeys derives the client's Initial packet protection keys from the
+// destination connection ID of its first Initial packet (RFC 9001, 5.2)
+func initialKeys(version uint32, dcid []byte) (*Keys, error) {
+	salt := saltV1
+	if version == Version2 {
+		salt = saltV2
+	}
+	initialSecret, err := hkdf.Extract(sha256.New, dcid, salt)
+	if err != nil {
+		return nil, err
+	}
+	clientSecret, err := expandLabel(sha256.New, initialSecret, "client in", 32)
+	if err != nil {
+		return nil, err
+	}
+	return NewKeys(version, tls.TLS_AES_128_GCM_SHA256, clientSecret)
+}
+
+// DecryptInitial removes the protection of a client Initial packet. keyDCID is
+// the destination connection ID of the client's first Initial packet.
+func DecryptInitial(p LongHeaderPacket, keyDCID []byte) (uint64, []byte, error) {
+	if p.Type != "initial" {
+		return 0, nil, fmt.Errorf("can't decrypt %s packet", p.Type)
+	}
+	keys, err := initialKeys(p.Version, keyDCID)
+	if err != nil {
+		return 0, nil, err
+	}
+	pn, payload, err := keys.DecryptLongHeader(p, -1)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to decrypt Initial packet: %w", err)
+	}
+	return pn, payload, nil
+}
+
+// ParseFrames lists the frames of a decrypted Initial packet, in the same
+// format as the packet log. Runs of PADDING are merged into a single entry.
+func ParseFrames(payload []byte) []string {
+	var frames []string
+	b := payload
+	for len(b) > 0 {
+		frameType, n, err := readVarint(b)
+		if err != nil {
+			break
+		}
+		b = b[n:]
+
+		switch frameType {
+		case 0x00:
+			padding := 1
+			for len(b) > 0 && b[0] == 0 {
+				padding++
+				b = b[1:]
+			}
+			frames = append(frames, fmt.Sprintf("PADDING (%d)", padding))
+		case 0x01:
+			frames = append(frames, "PING")
+		case 0x02, 0x03:
+			// Largest acknowledged, delay, range count and first range, then the ranges
+			fields := make([]uint64, 4)
+			for i := range fields {
+				if fields[i], n, err = readVarint(b); err != nil {
+					return append(frames, "ACK")
+				}
+				b = b[n:]
+			}
+			skip := 2 * fields[2]
+			if frameType == 0x03 {
+				skip += 3
+			}
+			for i := uint64(0); i < skip; i++ {
+				if _, n, err = readVarint(b); err != nil {
+					return append(frames, "ACK")
+				}
+				b = b[n:]
+			}
+			frames = append(frames, "ACK")
+		case 0x06:
+			offset, n, err := readVarint(b)
+			if err != nil {
+				return frames
+			}
+			b = b[n:]
+			length, n, err := readVarint(b)
+			if err != nil || uint64(len(b)-n) < length {
+				return frames
+			}
+			b = b[n+int(length):]
+			frames = append(frames, fmt.Sprintf("CRYPTO (offset=%d, length=%d)", offset, length))
+		case 0x1c:
+			frames = append(frames, "CONNECTION_CLOSE")
+			return frames
+		default:
+			// Other frames aren't allowed in Initial packets
+			frames = append(frames, fmt.Sprintf("UNKNOWN (0x%x)", frameType))
+			return frames
+		}
+	}
+	return frames
+}
@@ -0,0 +1,176 @@
+package quic
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Keys remove the packet protection of one direction at one encryption level
+// (RFC 9001, 5)
+type Keys struct {
+	aead cipher.AEAD
+	iv   []byte
+	// mask computes the header protection mask from a sample of the ciphertext
+	mask func(sample []byte) []byte
+}
+
+// NewKeys derives the packet protection keys from a TLS 1.3 traffic secret,
+// like the ones crypto/tls writes to its KeyLogWriter
+func NewKeys(version uint32, cipherSuite uint16, secret []byte) (*Keys, error) {
+	prefix := "quic "
+	if version == Version2 {
+		prefix = "quicv2 "
+	}
+
+	var newHash func() hash.Hash
+	var keyLen int
+	switch cipherSuite {
+	case tls.TLS_AES_128_GCM_SHA256:
+		newHash, keyLen = sha256.New, 16
+	case tls.TLS_AES_256_GCM_SHA384:
+		newHash, keyLen = sha512.New384, 32
+	case tls.TLS_CHACHA20_POLY1305_SHA256:
+		newHash, keyLen = sha256.New, chacha20poly1305.KeySize
+	default:
+		return nil, fmt.Errorf("unsupported cipher suite 0x%04x", cipherSuite)
+	}
+
+	key, err := expandLabel(newHash, secret, prefix+"key", keyLen)
+	if err != nil {
+		return nil, err
+	}
+	iv, err := expandLabel(newHash, secret, prefix+"iv", 12)
+	if err != nil {
+		return nil, err
+	}
+	hpKey, err := expandLabel(newHash, secret, prefix+"hp", keyLen)
+	if err != nil {
+		return nil, err
+	}
+
+	k := &Keys{iv: iv}
+	if cipherSuite == tls.TLS_CHACHA20_POLY1305_SHA256 {
+		if k.aead, err = chacha20poly1305.New(key); err != nil {
+			return nil, err
+		}
+		k.mask = func(sample []byte) []byte {
+			// The sample is the block counter followed by the nonce (RFC 9001, 5.4.4)
+			mask := make([]byte, 5)
+			c, err := chacha20.NewUnauthenticatedCipher(hpKey, sample[4:16])
+			if err != nil {
+				return mask
+			}
+			c.SetCounter(binary.LittleEndian.Uint32(sample[:4]))
+			c.XORKeyStream(mask, mask)
+			return mask
+		}
+		return k, nil
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if k.aead, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+	hp, err := aes.NewCipher(hpKey)
+	if err != nil {
+		return nil, err
+	}
+	k.mask = func(sample []byte) []byte {
+		mask := make([]byte, aes.BlockSize)
+		hp.Encrypt(mask, sample[:aes.BlockSize])
+		return mask
+	}
+	return k, nil
+}
+
+// DecryptLongHeader removes the protection of a long header packet, like a
+// 0-RTT packet. largest is the largest packet number decrypted so far in the
+// packet number space, -1 if there was none.
+func (k *Keys) DecryptLongHeader(p LongHeaderPacket, largest int64) (uint64, []byte, error) {
+	return k.open(p.Raw, p.pnOffset, largest)
+}
+
+// DecryptShortHeader removes the protection of a 1-RTT packet, which is the
+// rest of a datagram. dcidLen is the length of the server's connection IDs,
+// largest the largest packet number decrypted so far, -1 if there was none.
+// Packets sent after a key update can't be decrypted.
+func (k *Keys) DecryptShortHeader(packet []byte, dcidLen int, largest int64) (uint64, []byte, error) {
+	if len(packet) == 0 || packet[0]&0xc0 != 0x40 {
+		return 0, nil, fmt.Errorf("not a short header packet")
+	}
+	return k.open(packet, 1+dcidLen, largest)
+}
+
+// open removes header protection (RFC 9001, 5.4) and decrypts the payload
+func (k *Keys) open(raw []byte, pnOffset int, largest int64) (uint64, []byte, error) {
+	if len(raw) < pnOffset+4+16 {
+		return 0, nil, ErrTruncated
+	}
+
+	header := make([]byte, pnOffset+4)
+	copy(header, raw)
+	mask := k.mask(raw[pnOffset+4 : pnOffset+4+16])
+	if header[0]&0x80 != 0 {
+		header[0] ^= mask[0] & 0x0f
+	} else {
+		header[0] ^= mask[0] & 0x1f
+	}
+	pnLen := int(header[0]&0x3) + 1
+	var truncated uint64
+	for i := 0; i < pnLen; i++ {
+		header[pnOffset+i] ^= mask[1+i]
+		truncated = truncated<<8 | uint64(header[pnOffset+i])
+	}
+	header = header[:pnOffset+pnLen]
+	pn := decodePacketNumber(largest, truncated, pnLen)
+
+	nonce := make([]byte, len(k.iv))
+	copy(nonce, k.iv)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	payload, err := k.aead.Open(nil, nonce, raw[len(header):], header)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to decrypt packet: %w", err)
+	}
+	return pn, payload, nil
+}
+
+// decodePacketNumber expands a truncated packet number (RFC 9000, A.3)
+func decodePacketNumber(largest int64, truncated uint64, pnLen int) uint64 {
+	expected := largest + 1
+	win := int64(1) << (8 * pnLen)
+	hwin := win / 2
+	candidate := (expected &^ (win - 1)) | int64(truncated)
+	switch {
+	case candidate <= expected-hwin && candidate < (1<<62)-win:
+		return uint64(candidate + win)
+	case candidate > expected+hwin && candidate >= win:
+		return uint64(candidate - win)
+	}
+	return uint64(candidate)
+}
+
+// expandLabel is HKDF-Expand-Label from TLS 1.3 (RFC 8446, 7.1) with an empty context
+func expandLabel(newHash func() hash.Hash, secret []byte, label string, length int) ([]byte, error) {
+	full := "tls13 " + label
+	info := make([]byte, 0, 4+len(full))
+	info = binary.BigEndian.AppendUint16(info, uint16(length))
+	info = append(info, byte(len(full)))
+	info = append(info, full...)
+	info = append(info, 0)
+	return hkdf.Expand(newHash, secret, string(info), length)
+}
@@ -0,0 +1,215 @@
+package quic
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+)
+
+// StreamFrame is the data of a STREAM frame
+type StreamFrame struct {
+	StreamID uint64
+	Offset   uint64
+	Data     []byte
+	Fin      bool
+}
+
+// ParseStreamFrames returns the STREAM frames of a decrypted 0-RTT or 1-RTT
+// packet. The other frames are skipped. An error is returned for frames it
+// doesn't know, as their length is unknown.
+func ParseStreamFrames(payload []byte) ([]StreamFrame, error) {
+	var frames []StreamFrame
+	b := payload
+	// skip reads n variable-length integers
+	skip := func(n int) error {
+		for i := 0; i < n; i++ {
+			_, l, err := readVarint(b)
+			if err != nil {
+				return err
+			}
+			b = b[l:]
+		}
+		return nil
+	}
+	// skipBytes reads a length and skips that many bytes
+	skipBytes := func() error {
+		length, l, err := readVarint(b)
+		if err != nil {
+			return err
+		}
+		if uint64(len(b)-l) < length {
+			return ErrTruncated
+		}
+		b = b[l+int(length):]
+		return nil
+	}
+
+	for len(b) > 0 {
+		frameType, n, err := readVarint(b)
+		if err != nil {
+			return frames, err
+		}
+		b = b[n:]
+
+		switch {
+		case frameType == 0x00, frameType == 0x01, frameType == 0x1e, frameType == 0x1f:
+			// PADDING, PING, HANDSHAKE_DONE, IMMEDIATE_ACK
+		case frameType == 0x02, frameType == 0x03:
+			// Largest acknowledged, delay, range count and first range, then the ranges
+			var ranges uint64
+			for i := 0; i < 4 && err == nil; i++ {
+				var v uint64
+				if v, n, err = readVarint(b); err == nil {
+					b = b[n:]
+					if i == 2 {
+						ranges = v
+					}
+				}
+			}
+			extra := 2 * int(ranges)
+			if frameType == 0x03 {
+				extra += 3
+			}
+			if err == nil {
+				err = skip(extra)
+			}
+		case frameType == 0x04:
+			err = skip(3)
+		case frameType == 0x05, frameType == 0x11, frameType == 0x15:
+			err = skip(2)
+		case frameType == 0x06:
+			if err = skip(1); err == nil {
+				err = skipBytes()
+			}
+		case frameType == 0x07:
+			err = skipBytes()
+		case frameType >= 0x08 && frameType <= 0x0f:
+			var f StreamFrame
+			f, err = parseStreamFrame(frameType, &b)
+			if err == nil {
+				frames = append(frames, f)
+			}
+		case frameType == 0x10, frameType == 0x12, frameType == 0x13, frameType == 0x14,
+			frameType == 0x16, frameType == 0x17, frameType == 0x19:
+			err = skip(1)
+		case frameType == 0x18:
+			// NEW_CONNECTION_ID: sequence, retire prior to, the ID and a 16 byte token
+			if err = skip(2); err == nil {
+				if len(b) == 0 || len(b) < 1+int(b[0])+16 {
+					return frames, ErrTruncated
+				}
+				b = b[1+int(b[0])+16:]
+			}
+		case frameType == 0x1a, frameType == 0x1b:
+			if len(b) < 8 {
+				return frames, ErrTruncated
+			}
+			b = b[8:]
+		case frameType == 0x1c, frameType == 0x1d:
+			// CONNECTION_CLOSE is the last frame that matters
+			return frames, nil
+		case frameType == 0x30:
+			// DATAGRAM without a length extends to the end of the packet
+			return frames, nil
+		case frameType == 0x31:
+			err = skipBytes()
+		case frameType == 0xaf:
+			// ACK_FREQUENCY (draft-ietf-quic-ack-frequency)
+			err = skip(4)
+		default:
+			return frames, fmt.Errorf("unknown frame type 0x%x", frameType)
+		}
+		if err != nil {
+			return frames, err
+		}
+	}
+	return frames, nil
+}
+
+// parseStreamFrame reads a STREAM frame, whose type bits say which fields are present (RFC 9000, 19.8)
+func parseStreamFrame(frameType uint64, b *[]byte) (StreamFrame, error) {
+	var f StreamFrame
+	id, n, err := readVarint(*b)
+	if err != nil {
+		return f, err
+	}
+	*b = (*b)[n:]
+	f.StreamID = id
+	if frameType&0x04 != 0 {
+		if f.Offset, n, err = readVarint(*b); err != nil {
+			return f, err
+		}
+		*b = (*b)[n:]
+	}
+	length := uint64(len(*b))
+	if frameType&0x02 != 0 {
+		if length, n, err = readVarint(*b); err != nil {
+			return f, err
+		}
+		*b = (*b)[n:]
+		if uint64(len(*b)) < length {
+			return f, ErrTruncated
+		}
+	}
+	f.Data = (*b)[:length]
+	f.Fin = frameType&0x01 != 0
+	*b = (*b)[length:]
+	return f, nil
+}
+
+// Streams reassembles the data of streams from their STREAM frames, keeping
+// at most limit bytes of every stream
+type Streams struct {
+	limit  int
+	frames map[uint64][]StreamFrame
+}
+
+// NewStreams creates an empty set of streams
+func NewStreams(limit int) *Streams {
+	return &Streams{limit: limit, frames: map[uint64][]StreamFrame{}}
+}
+
+// Add adds a frame, which may be a retransmission
+func (s *Streams) Add(f StreamFrame) {
+	if f.Offset >= uint64(s.limit) {
+		return
+	}
+	if end := f.Offset + uint64(len(f.Data)); end > uint64(s.limit) {
+		f.Data = f.Data[:uint64(s.limit)-f.Offset]
+		f.Fin = false
+	}
+	s.frames[f.StreamID] = append(s.frames[f.StreamID], f)
+}
+
+// IDs returns the IDs of the streams, in ascending order
+func (s *Streams) IDs() []uint64 {
+	ids := make([]uint64, 0, len(s.frames))
+	for id := range s.frames {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// Data returns the contiguous data of a stream from its start, and whether
+// that is all of it
+func (s *Streams) Data(id uint64) ([]byte, bool) {
+	frames := slices.Clone(s.frames[id])
+	slices.SortStableFunc(frames, func(a, b StreamFrame) int {
+		return cmp.Compare(a.Offset, b.Offset)
+	})
+	var data []byte
+	fin := false
+	for _, f := range frames {
+		if f.Offset > uint64(len(data)) {
+			break
+		}
+		if end := f.Offset + uint64(len(f.Data)); end > uint64(len(data)) {
+			data = append(data, f.Data[uint64(len(data))-f.Offset:]...)
+		}
+		if f.Fin && f.Offset+uint64(len(f.Data)) == uint64(len(data)) {
+			fin = true
+		}
+	}
+	return data, fin
+}
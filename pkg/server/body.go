@@ -0,0 +1,128 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	trackmehttp "github.com/pagpeter/trackme/pkg/http"
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+// Bodies larger than this are rejected, they are only hashed and measured anyway
+const maxBodySize = 8 * 1024 * 1024
+
+var ErrBodyTooLarge = errors.New("request body too large")
+
+func newRequestBody(data []byte, contentType, framing string, frameSizes []int) *types.RequestBody {
+	hash := sha256.Sum256(data)
+	return &types.RequestBody{
+		Size:        len(data),
+		SHA256:      hex.EncodeToString(hash[:]),
+		ContentType: contentType,
+		Framing:     framing,
+		FrameSizes:  frameSizes,
+		Data:        data,
+	}
+}
+
+// readTrailers reads the trailer section of a chunked body, up to and including the empty line
+func readTrailers(br *bufio.Reader) ([]byte, error) {
+	var head []byte
+	for {
+		line, err := br.ReadBytes('\n')
+		head = append(head, line...)
+		if err != nil {
+			return head, err
+		}
+		if len(head) > trackmehttp.MaxHTTP1HeadSize {
+			return head, fmt.Errorf("trailers exceed %d bytes", trackmehttp.MaxHTTP1HeadSize)
+		}
+		if strings.TrimRight(string(line), "\r\n") == "" {
+			return head, nil
+		}
+	}
+}
+
+// readHTTP1Body reads the request body as announced by the Transfer-Encoding
+// or Content-Length header. It returns nil if the request has no body.
+func readHTTP1Body(conn net.Conn, br *bufio.Reader, headers []string) (*types.RequestBody, error) {
+	contentType := getHeaderValue(headers, "content-type")
+	chunked := strings.Contains(strings.ToLower(getHeaderValue(headers, "transfer-encoding")), "chunked")
+	contentLength := getHeaderValue(headers, "content-length")
+	if !chunked && contentLength == "" {
+		return nil, nil
+	}
+
+	if strings.EqualFold(getHeaderValue(headers, "expect"), "100-continue") {
+		if _, err := conn.Write([]byte("HTTP/1.1 100 Continue\r\n\r\n")); err != nil {
+			return nil, fmt.Errorf("failed to write 100 Continue: %w", err)
+		}
+	}
+
+	if chunked {
+		data, sizes, err := readChunkedBody(br)
+		if err != nil {
+			return nil, err
+		}
+		return newRequestBody(data, contentType, "chunked", sizes), nil
+	}
+
+	length, err := strconv.Atoi(contentLength)
+	if err != nil || length < 0 {
+		return nil, fmt.Errorf("invalid Content-Length %q", contentLength)
+	}
+	if length > maxBodySize {
+		return nil, ErrBodyTooLarge
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(br, data); err != nil {
+		return nil, fmt.Errorf("failed to read body: %w", err)
+	}
+	return newRequestBody(data, contentType, "content-length", nil), nil
+}
+
+// readChunkedBody decodes a chunked body and returns the data and the size of every chunk
+func readChunkedBody(br *bufio.Reader) ([]byte, []int, error) {
+	var data []byte
+	sizes := []int{}
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read chunk size: %w", err)
+		}
+		// Chunk extensions are ignored
+		sizeStr := strings.TrimSpace(strings.SplitN(line, ";", 2)[0])
+		size, err := strconv.ParseInt(sizeStr, 16, 64)
+		if err != nil || size < 0 {
+			return nil, nil, fmt.Errorf("invalid chunk size %q", sizeStr)
+		}
+		if size == 0 {
+			break
+		}
+		if int64(len(data))+size > maxBodySize {
+			return nil, nil, ErrBodyTooLarge
+		}
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(br, chunk); err != nil {
+			return nil, nil, fmt.Errorf("failed to read chunk: %w", err)
+		}
+		data = append(data, chunk...)
+		sizes = append(sizes, int(size))
+		if _, err := br.ReadString('\n'); err != nil {
+			return nil, nil, fmt.Errorf("failed to read chunk terminator: %w", err)
+		}
+	}
+
+	// Skip the trailer section
+	if _, err := readTrailers(br); err != nil {
+		return nil, nil, fmt.Errorf("failed to read trailers: %w", err)
+	}
+	return data, sizes, nil
+}
@@ -1,10 +1,12 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
@@ -24,62 +26,20 @@ import (
 
 const HTTP2_PREAMBLE = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
 
-// parseHeaderValue safely extracts the value from a header string "key: value"
-func parseHeaderValue(header, prefix string) string {
-	if !strings.HasPrefix(header, prefix) {
-		return ""
-	}
-	parts := strings.SplitN(header, ": ", 2)
-	if len(parts) < 2 {
-		return ""
-	}
-	return parts[1]
-}
-
-func parseHTTP1(request []byte) types.Response {
-	// Split the request into lines
-	lines := strings.Split(string(request), "\r\n")
-	if len(lines) == 0 {
-		return types.Response{
-			HTTPVersion: "--",
-			Method:      "--",
-			Path:        "--",
+// getHeaderValue returns the trimmed value of the first "name: value" header
+// with the given name, compared case insensitively. It works on HTTP/1 header
+// lines as sent and on HTTP/2 headers, including pseudo-headers like ":path".
+func getHeaderValue(headers []string, name string) string {
+	for _, h := range headers {
+		if len(h) <= len(name) || !strings.EqualFold(h[:len(name)], name) {
+			continue
 		}
-	}
-
-	// Split the first line into the method, path and http version
-	firstLine := strings.Split(lines[0], " ")
-
-	// Split the headers into an array
-	var headers []string
-	var userAgent string
-	for _, line := range lines {
-		if strings.Contains(line, ":") {
-			headers = append(headers, line)
-			if strings.HasPrefix(strings.ToLower(line), "user-agent") {
-				if val := parseHeaderValue(line, ""); val != "" {
-					userAgent = strings.TrimSpace(val)
-				}
-			}
-		}
-	}
-
-	if len(firstLine) != 3 {
-		return types.Response{
-			HTTPVersion: "--",
-			Method:      "--",
-			Path:        "--",
+		// HTTP/1 allows whitespace before the colon, even if it's an anomaly
+		if rest := strings.TrimLeft(h[len(name):], " \t"); strings.HasPrefix(rest, ":") {
+			return strings.TrimSpace(rest[1:])
 		}
 	}
-	return types.Response{
-		HTTPVersion: firstLine[2],
-		Path:        firstLine[1],
-		Method:      firstLine[0],
-		UserAgent:   userAgent,
-		Http1: &types.Http1Details{
-			Headers: headers,
-		},
-	}
+	return ""
 }
 
 func parseHTTP2(f *http2.Framer, c chan types.ParsedFrame) {
@@ -145,7 +105,8 @@ func parseHTTP2(f *http2.Framer, c chan types.ParsedFrame) {
 				}
 			}
 		case *http2.DataFrame:
-			p.Payload = frame.Data()
+			// The framer reuses its buffer for the next frame, so the payload has to be copied
+			p.Payload = append([]byte(nil), frame.Data()...)
 		case *http2.WindowUpdateFrame:
 			p.Increment = frame.Increment
 		case *http2.PriorityFrame:
@@ -162,13 +123,23 @@ func parseHTTP2(f *http2.Framer, c chan types.ParsedFrame) {
 			p.GoAway.LastStreamID = frame.LastStreamID
 			p.GoAway.ErrCode = uint32(frame.ErrCode)
 			p.GoAway.DebugData = frame.DebugData()
+		case *http2.RSTStreamFrame:
+			p.ErrCode = frame.ErrCode.String()
 		}
 
 		c <- p
 	}
 }
 
+// How long a client may take for the TLS handshake and a complete request,
+// and how long writing a response may take
+const requestTimeout = 15 * time.Second
+
 func (srv *Server) HandleTLSConnection(conn net.Conn) error {
+	if err := conn.SetReadDeadline(time.Now().Add(requestTimeout)); err != nil {
+		return fmt.Errorf("failed to set read deadline: %w", err)
+	}
+
 	// Read the first line of the request
 	// We only read the first line to determine if the connection is HTTP1 or HTTP2
 	// If we know that it isnt HTTP2, we can read the rest of the request and then start processing it
@@ -177,8 +148,10 @@ func (srv *Server) HandleTLSConnection(conn net.Conn) error {
 	l := len([]byte(HTTP2_PREAMBLE))
 	request := make([]byte, l)
 
-	_, err := conn.Read(request)
+	n, err := conn.Read(request)
 	if err != nil {
+		// The ClientHello is fingerprinted even if the handshake failed
+		srv.recordFailedHandshake(conn, err)
 		if strings.HasSuffix(err.Error(), "unknown certificate") && srv.IsLocal() {
 			// Local development error - don't close connection
 			return nil
@@ -186,7 +159,29 @@ func (srv *Server) HandleTLSConnection(conn net.Conn) error {
 		return fmt.Errorf("failed to read request: %w", err)
 	}
 
-	hs := conn.(*utls.Conn).ClientHello
+	// The handshake is complete after the first read
+	defer srv.trackTCPConnection(conn)()
+
+	tlsDetails, err := getTLSDetails(conn.(*utls.Conn))
+	if err != nil {
+		return err
+	}
+
+	// Check if the first line is HTTP/2
+	if string(request) == HTTP2_PREAMBLE {
+		srv.handleHTTP2(conn, conn, tlsDetails, nil)
+	} else {
+		// Read the rest of the request, starting with what we already read
+		br := bufio.NewReader(io.MultiReader(bytes.NewReader(request[:n]), conn))
+		return srv.serveHTTP1(conn, br, tlsDetails)
+	}
+	return nil
+}
+
+// getTLSDetails fingerprints the ClientHello of a TLS connection. The
+// handshake doesn't need to be complete.
+func getTLSDetails(conn *utls.Conn) (*types.TLSDetails, error) {
+	hs := conn.ClientHello
 
 	parsedClientHello := tls.ParseClientHello(hs)
 	JA3Data := tls.CalculateJA3(parsedClientHello)
@@ -195,48 +190,32 @@ func (srv *Server) HandleTLSConnection(conn net.Conn) error {
 	// Convert raw bytes to hex and base64
 	rawBytes, err := hex.DecodeString(hs)
 	if err != nil {
-		return fmt.Errorf("failed to decode hex: %w", err)
+		return nil, fmt.Errorf("failed to decode hex: %w", err)
 	}
 	rawB64 := base64.StdEncoding.EncodeToString(rawBytes)
 
-	tlsDetails := types.TLSDetails{
-		Ciphers:          JA3Data.ReadableCiphers,
-		Extensions:       parsedClientHello.Extensions,
-		RecordVersion:    JA3Data.Version,
-		NegotiatedVesion: fmt.Sprintf("%v", conn.(*utls.Conn).ConnectionState().Version),
-		JA3:              JA3Data.JA3,
-		JA3Hash:          JA3Data.JA3Hash,
-		PeetPrint:        peetfp,
-		PeetPrintHash:    peetprintHash,
-		SessionID:        parsedClientHello.SessionID,
-		ClientRandom:     parsedClientHello.ClientRandom,
-		RawBytes:         hs,
-		RawB64:           rawB64,
+	tlsDetails := &types.TLSDetails{
+		Ciphers:        JA3Data.ReadableCiphers,
+		Extensions:     parsedClientHello.Extensions,
+		RecordVersion:  JA3Data.Version,
+		JA3:            JA3Data.JA3,
+		JA3Hash:        JA3Data.JA3Hash,
+		PeetPrint:      peetfp,
+		PeetPrintHash:  peetprintHash,
+		SessionID:      parsedClientHello.SessionID,
+		ClientRandom:   parsedClientHello.ClientRandom,
+		RawBytes:       hs,
+		RawB64:         rawB64,
+		HandshakeRTTMs: getTLSHandshakeRTT(conn),
 	}
-
-	// Check if the first line is HTTP/2
-	if string(request) == HTTP2_PREAMBLE {
-		srv.handleHTTP2(conn, &tlsDetails)
-	} else {
-		// Read the rest of the request
-		r2 := make([]byte, 1024-l)
-		_, err := conn.Read(r2)
-		if err != nil {
-			return fmt.Errorf("failed to read HTTP/1 request: %w", err)
-		}
-		// Append it to the first line
-		request = append(request, r2...)
-
-		// Parse and handle the request
-		details := parseHTTP1(request)
-		details.IP = conn.RemoteAddr().String()
-		details.TLS = &tlsDetails
-		srv.respondToHTTP1(conn, details)
+	if version := conn.ConnectionState().Version; version != 0 {
+		tlsDetails.NegotiatedVesion = fmt.Sprintf("%v", version)
 	}
-	return nil
+	return tlsDetails, nil
 }
 
-func (srv *Server) respondToHTTP1(conn net.Conn, resp types.Response) {
+// respondToHTTP1 answers a request and closes the connection unless keepAlive is set
+func (srv *Server) respondToHTTP1(conn net.Conn, resp types.Response, keepAlive bool) error {
 	var isAdmin bool
 	var res []byte
 	var ctype = "text/plain"
@@ -271,38 +250,59 @@ func (srv *Server) respondToHTTP1(conn net.Conn, resp types.Response) {
 	}
 	res1 += "Server: TrackMe\r\n"
 	res1 += "Alt-Svc: h3=\":443\"; ma=86400\r\n"
+	if !keepAlive {
+		res1 += "Connection: close\r\n"
+	} else if resp.HTTPVersion == "HTTP/1.0" {
+		res1 += "Connection: keep-alive\r\n"
+	}
 	res1 += "\r\n"
 	res1 += string(res)
-	res1 += "\r\n\r\n"
 
 	if _, err := conn.Write([]byte(res1)); err != nil {
-		log.Println("Error writing HTTP/1 data:", err)
-		return
+		return fmt.Errorf("failed to write HTTP/1 data: %w", err)
+	}
+	if keepAlive {
+		return nil
 	}
 	if err := conn.Close(); err != nil {
 		log.Println("Error closing HTTP/1 connection:", err)
 	}
+	return nil
 }
 
 // https://stackoverflow.com/questions/52002623/golang-tcp-server-how-to-write-http2-data
-func (srv *Server) handleHTTP2(conn net.Conn, tlsFingerprint *types.TLSDetails) {
+// Frames are read from r, which is conn unless some bytes were buffered already.
+// upgrade is the HTTP/1 request of an h2c upgrade, which is answered on stream 1.
+func (srv *Server) handleHTTP2(conn net.Conn, r io.Reader, tlsFingerprint *types.TLSDetails, upgrade *types.Response) {
 	// make a new framer to encode/decode frames
-	fr := http2.NewFramer(conn, conn)
+	fr := http2.NewFramer(conn, r)
 	c := make(chan types.ParsedFrame)
 	var frames []types.ParsedFrame
+	start := time.Now()
+	windowUpdates := []types.Http2WindowUpdate{}
 
-	// Same settings that google uses
-	if err := fr.WriteSettings(
-		http2.Setting{
-			ID: http2.SettingInitialWindowSize, Val: 1048576,
-		},
-		http2.Setting{
-			ID: http2.SettingMaxConcurrentStreams, Val: 100,
-		},
-		http2.Setting{
-			ID: http2.SettingMaxHeaderListSize, Val: 65536,
-		},
-	); err != nil {
+	// Accept frames up to the largest size any profile advertises
+	fr.SetMaxReadFrameSize(16777215)
+
+	// The connection carries a single request, which has to arrive in time
+	if err := conn.SetReadDeadline(time.Now().Add(requestTimeout)); err != nil {
+		log.Println("Error setting read deadline:", err)
+		return
+	}
+
+	// The profile can be picked by the hostname, eg nginx.tls.peet.ws. Our
+	// SETTINGS are sent right away, so they never depend on the request.
+	var host string
+	if tlsConn, ok := conn.(*utls.Conn); ok {
+		host = tlsConn.ConnectionState().ServerName
+	} else if upgrade != nil && upgrade.Http1 != nil {
+		host, _, _ = strings.Cut(getHeaderValue(upgrade.Http1.Headers, "host"), ":")
+	}
+	profileName, profile, ok := srv.h2ProfileFromHost(host)
+	if !ok {
+		profileName, profile = srv.defaultH2Profile()
+	}
+	if err := writeH2Profile(fr, profile); err != nil {
 		log.Println("Error writing settings:", err)
 		return
 	}
@@ -310,11 +310,36 @@ func (srv *Server) handleHTTP2(conn net.Conn, tlsFingerprint *types.TLSDetails)
 	var frame types.ParsedFrame
 	var headerFrame types.ParsedFrame
 	var isAdmin bool
+	var bodyData []byte
+	var bodySizes []int
+	var windowProbe *h2WindowProbe
+	var probeStall <-chan time.Time
+
+	// The upgraded request is complete already, so we only wait for the
+	// client's preface frames, up to the ACK of our SETTINGS
+	var upgradeTimeout <-chan time.Time
+	if upgrade != nil {
+		headerFrame = h2cUpgradeFrame(upgrade)
+		upgradeTimeout = time.After(h2cPrefaceTimeout)
+	}
 
 	go parseHTTP2(fr, c)
 
+readFrames:
 	for {
-		frame = <-c
+		select {
+		case frame = <-c:
+		case <-upgradeTimeout:
+			break readFrames
+		case <-probeStall:
+			// The client waits with window left, eg for room for a whole frame
+			probeStall = nil
+			if err := windowProbe.refill(fr, "stalled"); err != nil {
+				log.Println("Error writing window update:", err)
+				return
+			}
+			continue
+		}
 		if frame.Type == "ERROR_CLOSE" {
 			if err := conn.Close(); err != nil {
 				log.Println("Error closing connection:", err)
@@ -324,38 +349,94 @@ func (srv *Server) handleHTTP2(conn net.Conn, tlsFingerprint *types.TLSDetails)
 			return
 		}
 		frames = append(frames, frame)
-		if frame.Type == "HEADERS" {
+		if frame.Type == "WINDOW_UPDATE" {
+			windowUpdates = append(windowUpdates, types.Http2WindowUpdate{
+				Stream:          frame.Stream,
+				Increment:       frame.Increment,
+				ReceivedAfterMs: float64(time.Since(start).Microseconds()) / 1000,
+			})
+		}
+		if frame.Type == "HEADERS" && headerFrame.Type == "" {
 			headerFrame = frame
+			if upgrade == nil && !isEndStream(frame) && wantsHTTP2Probe(getHeaderValue(frame.Headers, ":path")) {
+				windowProbe = newH2WindowProbe(profile)
+			}
 		}
-		if len(frame.Flags) > 0 && frame.Flags[0] == "EndStream (0x1)" {
+		if err := ackSettings(fr, frame); err != nil {
+			log.Println("Error writing settings ack:", err)
+			return
+		}
+		if frame.Type == "DATA" && headerFrame.Type != "" && frame.Stream == headerFrame.Stream {
+			bodyData = append(bodyData, frame.Payload...)
+			bodySizes = append(bodySizes, len(frame.Payload))
+			if len(bodyData) > maxBodySize {
+				log.Println("Error reading HTTP/2 body:", ErrBodyTooLarge)
+				if err := conn.Close(); err != nil {
+					log.Println("Error closing connection:", err)
+				}
+				return
+			}
+			if windowProbe != nil {
+				exhausted, err := windowProbe.receive(fr, frame)
+				if err == nil && exhausted && !isEndStream(frame) {
+					err = windowProbe.refill(fr, "exhausted")
+				}
+				if err != nil {
+					log.Println("Error writing window update:", err)
+					return
+				}
+				probeStall = time.After(h2ProbeStallTimeout)
+			} else if err := returnFlowControlCredit(fr, frame); err != nil {
+				// Give the flow control credit back, so bodies can be larger than the initial window
+				log.Println("Error writing window update:", err)
+				return
+			}
+		}
+		if isEndStream(frame) {
 			break
 		}
+		if upgrade != nil && frame.Type == "SETTINGS" && isAck(frame) {
+			break
+		}
+	}
+
+	// The client only has to keep up with the probe and the response from now on
+	if err := conn.SetDeadline(time.Now().Add(requestTimeout)); err != nil {
+		log.Println("Error setting deadline:", err)
+		return
 	}
 
 	// get method, path and user-agent from the header frame
-	var path string
-	var method string
-	var userAgent string
+	method := getHeaderValue(headerFrame.Headers, ":method")
+	path := getHeaderValue(headerFrame.Headers, ":path")
+	userAgent := getHeaderValue(headerFrame.Headers, "user-agent")
+	contentType := getHeaderValue(headerFrame.Headers, "content-type")
 	key, isKeySet := srv.GetAdmin()
-
 	for _, h := range headerFrame.Headers {
-		if val := parseHeaderValue(h, ":method"); val != "" {
-			method = val
-		}
-		if val := parseHeaderValue(h, ":path"); val != "" {
-			path = val
-		}
-		if val := parseHeaderValue(h, "user-agent"); val != "" {
-			userAgent = val
-		}
 		if isKeySet && strings.HasPrefix(h, key) {
 			isAdmin = true
 		}
 	}
 
+	var probe *types.Http2Probe
+	if wantsHTTP2Probe(path) {
+		var ok bool
+		probe, ok = probeHTTP2(conn, fr, c, headerFrame.Stream, 1-countSettingsAcks(frames), profile)
+		if !ok {
+			return
+		}
+		if windowProbe != nil {
+			probe.Window = windowProbe.result
+		}
+	}
+
+	httpVersion := "h2"
+	if tlsFingerprint == nil {
+		httpVersion = "h2c"
+	}
 	resp := types.Response{
 		IP:          conn.RemoteAddr().String(),
-		HTTPVersion: "h2",
+		HTTPVersion: httpVersion,
 		Path:        path,
 		Method:      method,
 		UserAgent:   userAgent,
@@ -363,9 +444,26 @@ func (srv *Server) handleHTTP2(conn net.Conn, tlsFingerprint *types.TLSDetails)
 			SendFrames:            frames,
 			AkamaiFingerprint:     trackmehttp.GetAkamaiFingerprint(frames),
 			AkamaiFingerprintHash: utils.GetMD5Hash(trackmehttp.GetAkamaiFingerprint(frames)),
+			Probe:                 probe,
+			ServerProfile:         profileName,
+			WindowUpdates:         windowUpdates,
 		},
 		TLS: tlsFingerprint,
 	}
+	resp.Http2.PreviousResponse = srv.getPreviousHTTP2Response(path)
+	// The token links how the client reads this response to its next request
+	if token, err := newToken(); err == nil {
+		resp.Http2.ResponseToken = token
+	} else {
+		log.Println("Error generating response token:", err)
+	}
+	if bodySizes != nil {
+		resp.Body = newRequestBody(bodyData, contentType, "data-frames", bodySizes)
+	}
+	if upgrade != nil {
+		resp.Http1 = upgrade.Http1
+		resp.Body = upgrade.Body
+	}
 
 	var res []byte
 	var ctype = "text/plain"
@@ -401,15 +499,23 @@ func (srv *Server) handleHTTP2(conn net.Conn, tlsFingerprint *types.TLSDetails)
 		return
 	}
 
-	chunks := utils.SplitBytesIntoChunks(res, 1024)
-	for _, chunk := range chunks {
-		if err := fr.WriteData(headerFrame.Stream, false, chunk); err != nil {
-			log.Println("Error writing data chunk:", err)
-			return
+	window := newH2SendWindow(headerFrame.Stream, frames)
+	window.limitFrameSize(profile.MaxDataFrameSize)
+	if probe != nil {
+		for _, f := range probe.ReceivedFrames {
+			window.apply(f.ParsedFrame)
 		}
 	}
-	if err := fr.WriteData(headerFrame.Stream, true, []byte{}); err != nil {
-		log.Println("Error writing final data frame:", err)
+	sent, err := writeHTTP2Body(fr, c, window, res)
+	if resp.Http2.ResponseToken != "" {
+		srv.GetHTTP2Responses().Store(resp.Http2.ResponseToken, sent)
+	}
+	if err != nil {
+		log.Println("Error writing HTTP/2 body:", err)
+		if err := conn.Close(); err != nil {
+			log.Println("Error closing HTTP/2 connection:", err)
+		}
+		return
 	}
 	if err := fr.WriteGoAway(headerFrame.Stream, http2.ErrCodeNo, []byte{}); err != nil {
 		log.Println("Error writing GoAway:", err)
@@ -421,8 +527,8 @@ func (srv *Server) handleHTTP2(conn net.Conn, tlsFingerprint *types.TLSDetails)
 	}
 }
 
-// HandleHTTP3 handles HTTP/3 requests
-func (srv *Server) HandleHTTP3() http.Handler {
+// HandleHTTP3 handles HTTP/3 requests. probe is the probe mode of the server, if any.
+func (srv *Server) HandleHTTP3(probe string) http.Handler {
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -439,6 +545,8 @@ func (srv *Server) HandleHTTP3() http.Handler {
 		}
 
 		h3state := h3c.ConnectionState()
+		// The streams of the client read from its decrypted packets, nil if they can't be read
+		streams := srv.readHTTP3Streams(r.RemoteAddr, h3state.ClientHello, h3state.TLS.CipherSuite)
 
 		// Extract TLS fingerprint from QUIC ClientHello
 		var tlsDetails *types.TLSDetails
@@ -478,18 +586,21 @@ func (srv *Server) HandleHTTP3() http.Handler {
 			}
 		}
 
-		// Extract headers in order (pseudo-headers first, then regular headers)
-		var headers []string
-		// Add pseudo-headers in the order they would appear
-		headers = append(headers, fmt.Sprintf(":method: %s", r.Method))
-		headers = append(headers, fmt.Sprintf(":authority: %s", r.Host))
-		headers = append(headers, ":scheme: https")
-		headers = append(headers, fmt.Sprintf(":path: %s", r.URL.RequestURI()))
-		// Add regular headers
-		for name, values := range r.Header {
-			for _, value := range values {
-				headers = append(headers, fmt.Sprintf("%s: %s", strings.ToLower(name), value))
+		// Extract headers in the order the client sent them
+		headers, headerFields := getHTTP3Headers(r, streams)
+
+		var body *types.RequestBody
+		if r.Body != nil && r.ContentLength != 0 {
+			data, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+			if err != nil {
+				http.Error(w, "Failed to read body", http.StatusBadRequest)
+				return
 			}
+			if len(data) > maxBodySize {
+				http.Error(w, ErrBodyTooLarge.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
+			body = newRequestBody(data, r.Header.Get("Content-Type"), "data-frames", nil)
 		}
 
 		// Generate fingerprint
@@ -514,7 +625,22 @@ func (srv *Server) HandleHTTP3() http.Handler {
 				AkamaiFingerprint:                  fingerprint,
 				AkamaiFingerprintHash:              fingerprintHash,
 				Headers:                            headers,
+				HeaderFields:                       headerFields,
 			},
+			Body: body,
+		}
+
+		if rec := srv.getQUICRecorder(r.Context()); rec != nil {
+			if streams != nil {
+				rec.setHTTP3Streams(streams)
+			}
+			resp.Http3.Streams = rec.getStreams()
+			resp.Http3.Packets = rec.getPackets()
+		}
+		resp.Http3.QUICInitial = srv.getQUICInitial(r.RemoteAddr)
+		resp.Http3.Probe = srv.getQUICProbe(probe, r.RemoteAddr, h3state.ClientHello)
+		if tcpip, ok := srv.GetUDPFingerprints().Lookup(r.RemoteAddr, srv.getFingerprintWait()); ok {
+			resp.TCPIP = tcpip
 		}
 
 		res, ctype, err := Router(r.URL.Path, resp, srv)
@@ -0,0 +1,37 @@
+package server
+
+import "testing"
+
+func TestGetHeaderValue(t *testing.T) {
+	headers := []string{
+		":method: GET",
+		":path: /api/all?x=1:2",
+		"Content-Type:  text/plain ",
+		"X-Empty:",
+		"X-Spaced \t: value",
+		"Host: first.example",
+		"host: second.example",
+		"invalid line",
+	}
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: ":method", want: "GET"},
+		{name: ":path", want: "/api/all?x=1:2"},
+		{name: "content-type", want: "text/plain"},
+		{name: "CONTENT-TYPE", want: "text/plain"},
+		{name: "x-empty", want: ""},
+		{name: "x-spaced", want: "value"},
+		{name: "host", want: "first.example"},
+		{name: "content", want: ""},
+		{name: "path", want: ""},
+		{name: "invalid", want: ""},
+		{name: "missing", want: ""},
+	}
+	for _, tt := range tests {
+		if got := getHeaderValue(headers, tt.name); got != tt.want {
+			t.Errorf("getHeaderValue(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pagpeter/trackme/pkg/tls"
+	"github.com/pagpeter/trackme/pkg/types"
+	utls "github.com/wwhtrbbtt/utls"
+)
+
+// maxFailedHandshakes is how many failed handshakes are kept
+const maxFailedHandshakes = 1000
+
+// HandshakeLog keeps the most recent failed TLS handshakes
+type HandshakeLog struct {
+	mu     sync.Mutex
+	events []types.HandshakeEvent
+	total  int
+}
+
+// NewHandshakeLog creates an empty log
+func NewHandshakeLog() *HandshakeLog {
+	return &HandshakeLog{}
+}
+
+// Add appends an event, dropping the oldest one if the log is full
+func (l *HandshakeLog) Add(event types.HandshakeEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, event)
+	if len(l.events) > maxFailedHandshakes {
+		l.events = l.events[1:]
+	}
+	l.total++
+}
+
+// ForIP returns the events of a client IP, the most recent first
+func (l *HandshakeLog) ForIP(ip string) []types.HandshakeEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	events := []types.HandshakeEvent{}
+	for i := len(l.events) - 1; i >= 0; i-- {
+		if host, _, err := net.SplitHostPort(l.events[i].IP); err == nil && host == ip {
+			events = append(events, l.events[i])
+		}
+	}
+	return events
+}
+
+// Total returns how many events were added since the start
+func (l *HandshakeLog) Total() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.total
+}
+
+// getHandshakeAlert returns the alert that ended a handshake, nil if there
+// was none. utls fails with a net.OpError when it received an alert, and when
+// it sent one while reading. Other alerts the server sent are only seen if
+// they were sent in plaintext, see getSentAlert.
+func getHandshakeAlert(conn net.Conn, err error) *types.TLSAlert {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Err != nil {
+		if code, ok := tls.GetAlertCode(opErr.Err); ok {
+			switch opErr.Op {
+			case "remote error":
+				return newTLSAlert("client", code)
+			case "local error":
+				return newTLSAlert("server", code)
+			}
+		}
+	}
+	if code := getSentAlert(conn); code >= 0 {
+		return newTLSAlert("server", code)
+	}
+	return nil
+}
+
+func newTLSAlert(sentBy string, code int) *types.TLSAlert {
+	return &types.TLSAlert{SentBy: sentBy, Code: code, Description: tls.GetAlertDescription(code)}
+}
+
+// recordFailedHandshake fingerprints the ClientHello of a TLS connection
+// whose handshake failed or was aborted, and logs and keeps it. Connections
+// that never sent a ClientHello are ignored.
+func (srv *Server) recordFailedHandshake(conn net.Conn, err error) {
+	tlsConn, ok := conn.(*utls.Conn)
+	if !ok || tlsConn.ClientHello == "" || tlsConn.ConnectionState().HandshakeComplete {
+		return
+	}
+	tlsDetails, detailsErr := getTLSDetails(tlsConn)
+	if detailsErr != nil {
+		return
+	}
+	tlsDetails.JA4 = tls.CalculateJa4(tlsDetails)
+	tlsDetails.JA4_r = tls.CalculateJa4_r(tlsDetails)
+
+	event := types.HandshakeEvent{
+		Time:  time.Now().UTC().Format(time.RFC3339),
+		IP:    conn.RemoteAddr().String(),
+		Error: err.Error(),
+		Alert: getHandshakeAlert(conn, err),
+		TLS:   tlsDetails,
+	}
+	if tcpip, ok := srv.GetTCPFingerprints().Lookup(event.IP, srv.getTCPFingerprintWait(event.IP)); ok {
+		event.TCPIP = &tcpip
+	}
+	srv.GetFailedHandshakes().Add(event)
+
+	alert := "-"
+	if event.Alert != nil {
+		alert = event.Alert.SentBy + ":" + event.Alert.Description
+	}
+	Log(fmt.Sprintf("%v handshake failed %v %v: %v", cleanIP(event.IP), tlsDetails.JA3Hash, alert, err))
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+// Defaults of the fingerprint stores, used if the config doesn't set them
+const (
+	defaultFingerprintTTL        = 2 * time.Minute
+	defaultFingerprintMaxEntries = 100000
+	defaultFingerprintWait       = 100 * time.Millisecond
+)
+
+type fingerprintEntry[V any] struct {
+	key    string
+	value  V
+	stored time.Time
+}
+
+// FingerprintStore holds details of clients by their address, like their
+// TCP/IP fingerprint. It keeps at most maxEntries, evicts them after ttl (never
+// if it's negative), and lets lookups wait for details that were not captured yet.
+type FingerprintStore[V any] struct {
+	mu         sync.Mutex
+	maxEntries int
+	ttl        time.Duration
+	// order lists the entries from least to most recently stored
+	order   *list.List
+	entries map[string]*list.Element
+	waiters map[string][]chan struct{}
+	stats   types.FingerprintStoreStats
+}
+
+// NewFingerprintStore creates a store with the default limits
+func NewFingerprintStore[V any]() *FingerprintStore[V] {
+	return &FingerprintStore[V]{
+		maxEntries: defaultFingerprintMaxEntries,
+		ttl:        defaultFingerprintTTL,
+		order:      list.New(),
+		entries:    map[string]*list.Element{},
+		waiters:    map[string][]chan struct{}{},
+	}
+}
+
+// SetLimits changes the size limit and TTL of the store, zero values keep the
+// current ones and a negative TTL keeps entries until they are evicted by size
+func (s *FingerprintStore[V]) SetLimits(maxEntries int, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if maxEntries > 0 {
+		s.maxEntries = maxEntries
+	}
+	if ttl != 0 {
+		s.ttl = ttl
+	}
+}
+
+// Store saves the details of an address, replacing earlier ones
+func (s *FingerprintStore[V]) Store(key string, value V) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.store(key, value)
+}
+
+// LoadOrStore returns the details of an address if there are any, and saves
+// value otherwise
+func (s *FingerprintStore[V]) LoadOrStore(key string, value V) (V, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if existing, ok := s.load(key); ok {
+		return existing, true
+	}
+	s.store(key, value)
+	return value, false
+}
+
+// Update changes the details of an address in place if there are any. update
+// returns false if it changed nothing.
+func (s *FingerprintStore[V]) Update(key string, update func(*V) bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok {
+		return false
+	}
+	return update(&e.Value.(*fingerprintEntry[V]).value)
+}
+
+// Lookup returns the details of an address. If they are not there yet, it
+// waits up to wait for the capture to catch up.
+func (s *FingerprintStore[V]) Lookup(key string, wait time.Duration) (V, bool) {
+	s.mu.Lock()
+	if value, ok := s.load(key); ok || wait <= 0 {
+		if ok {
+			s.stats.Hits++
+		} else {
+			s.stats.Misses++
+		}
+		s.mu.Unlock()
+		return value, ok
+	}
+	stored := make(chan struct{})
+	s.waiters[key] = append(s.waiters[key], stored)
+	s.mu.Unlock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-stored:
+	case <-timer.C:
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removeWaiter(key, stored)
+	value, ok := s.load(key)
+	if ok {
+		s.stats.WaitHits++
+	} else {
+		s.stats.Misses++
+		s.stats.WaitTimeouts++
+	}
+	return value, ok
+}
+
+// Stats returns the counters of the store
+func (s *FingerprintStore[V]) Stats() types.FingerprintStoreStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.evictExpired(time.Now())
+	stats := s.stats
+	stats.Entries = len(s.entries)
+	stats.MaxEntries = s.maxEntries
+	stats.TTLSeconds = s.ttl.Seconds()
+	return stats
+}
+
+func (s *FingerprintStore[V]) load(key string) (V, bool) {
+	var zero V
+	e, ok := s.entries[key]
+	if !ok {
+		return zero, false
+	}
+	entry := e.Value.(*fingerprintEntry[V])
+	if s.expired(entry, time.Now()) {
+		s.remove(e)
+		s.stats.ExpiredEvictions++
+		return zero, false
+	}
+	return entry.value, true
+}
+
+func (s *FingerprintStore[V]) store(key string, value V) {
+	now := time.Now()
+	if e, ok := s.entries[key]; ok {
+		s.remove(e)
+	}
+	s.entries[key] = s.order.PushBack(&fingerprintEntry[V]{key: key, value: value, stored: now})
+	s.stats.Stores++
+
+	s.evictExpired(now)
+	for len(s.entries) > s.maxEntries {
+		s.remove(s.order.Front())
+		s.stats.SizeEvictions++
+	}
+
+	for _, stored := range s.waiters[key] {
+		close(stored)
+	}
+	delete(s.waiters, key)
+}
+
+// evictExpired removes the entries older than the TTL, which are at the front
+func (s *FingerprintStore[V]) evictExpired(now time.Time) {
+	for e := s.order.Front(); e != nil; e = s.order.Front() {
+		if !s.expired(e.Value.(*fingerprintEntry[V]), now) {
+			return
+		}
+		s.remove(e)
+		s.stats.ExpiredEvictions++
+	}
+}
+
+func (s *FingerprintStore[V]) expired(entry *fingerprintEntry[V], now time.Time) bool {
+	return s.ttl > 0 && now.Sub(entry.stored) > s.ttl
+}
+
+func (s *FingerprintStore[V]) remove(e *list.Element) {
+	delete(s.entries, e.Value.(*fingerprintEntry[V]).key)
+	s.order.Remove(e)
+}
+
+func (s *FingerprintStore[V]) removeWaiter(key string, stored chan struct{}) {
+	waiters := s.waiters[key]
+	for i, w := range waiters {
+		if w == stored {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(s.waiters, key)
+	} else {
+		s.waiters[key] = waiters
+	}
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	trackmehttp "github.com/pagpeter/trackme/pkg/http"
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+// How long we wait for the preface frames of an upgraded client before answering
+const h2cPrefaceTimeout = 1 * time.Second
+
+// HandlePlainConnection handles a connection on the plain HTTP port. Clients
+// speaking cleartext HTTP/2 (h2c), either with prior knowledge or by sending
+// "Upgrade: h2c", are fingerprinted like on the TLS port. All other requests
+// are fingerprinted and redirected to the HTTPS site.
+func (srv *Server) HandlePlainConnection(conn net.Conn) error {
+	defer srv.trackTCPConnection(conn)()
+	if err := conn.SetReadDeadline(time.Now().Add(requestTimeout)); err != nil {
+		return fmt.Errorf("failed to set read deadline: %w", err)
+	}
+	br := bufio.NewReader(conn)
+
+	isPreface, err := peekHTTP2Preface(br)
+	if err != nil {
+		return fmt.Errorf("failed to read request: %w", err)
+	}
+	if isPreface {
+		if _, err := br.Discard(len(HTTP2_PREAMBLE)); err != nil {
+			return fmt.Errorf("failed to read preface: %w", err)
+		}
+		srv.handleHTTP2(conn, br, nil, nil)
+		return nil
+	}
+
+	details, err := trackmehttp.ParseHTTP1(br)
+	if err != nil {
+		return fmt.Errorf("failed to read HTTP/1 request: %w", err)
+	}
+	details.IP = conn.RemoteAddr().String()
+	if details.Http1 == nil || !isH2CUpgrade(details.Http1.Headers) {
+		srv.redirectHTTP1(conn, details)
+		return nil
+	}
+
+	// The body of the upgraded request has to be read before switching protocols
+	body, err := readHTTP1Body(conn, br, details.Http1.Headers)
+	if err != nil {
+		return fmt.Errorf("failed to read HTTP/1 body: %w", err)
+	}
+	details.Body = body
+
+	res := "HTTP/1.1 101 Switching Protocols\r\n"
+	res += "Connection: Upgrade\r\n"
+	res += "Upgrade: h2c\r\n"
+	res += "\r\n"
+	if _, err := conn.Write([]byte(res)); err != nil {
+		return fmt.Errorf("failed to write upgrade response: %w", err)
+	}
+
+	preface := make([]byte, len(HTTP2_PREAMBLE))
+	if _, err := io.ReadFull(br, preface); err != nil {
+		return fmt.Errorf("failed to read preface: %w", err)
+	}
+	if string(preface) != HTTP2_PREAMBLE {
+		return fmt.Errorf("invalid preface after upgrade")
+	}
+	srv.handleHTTP2(conn, br, nil, &details)
+	return nil
+}
+
+// peekHTTP2Preface checks if the connection starts with the HTTP/2 preface. It
+// stops peeking at the first mismatching byte, so short HTTP/1 requests don't block.
+func peekHTTP2Preface(br *bufio.Reader) (bool, error) {
+	for i := 1; i <= len(HTTP2_PREAMBLE); i++ {
+		b, err := br.Peek(i)
+		if err != nil {
+			return false, err
+		}
+		if !strings.HasPrefix(HTTP2_PREAMBLE, string(b)) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// isH2CUpgrade checks for the headers of an upgrade to h2c (RFC 7540, 3.2)
+func isH2CUpgrade(headers []string) bool {
+	for _, proto := range strings.Split(getHeaderValue(headers, "upgrade"), ",") {
+		if strings.EqualFold(strings.TrimSpace(proto), "h2c") {
+			return getHeaderValue(headers, "http2-settings") != ""
+		}
+	}
+	return false
+}
+
+// h2cUpgradeFrame turns the HTTP/1 request of an h2c upgrade into the headers
+// of stream 1, as if they had been sent in a HEADERS frame
+func h2cUpgradeFrame(upgrade *types.Response) types.ParsedFrame {
+	headers := []string{
+		":method: " + upgrade.Method,
+		":path: " + upgrade.Path,
+		":scheme: http",
+	}
+	if upgrade.Http1 != nil {
+		for _, h := range upgrade.Http1.Headers {
+			name, value, ok := strings.Cut(h, ":")
+			if !ok {
+				continue
+			}
+			headers = append(headers, strings.ToLower(strings.TrimSpace(name))+": "+strings.TrimSpace(value))
+		}
+	}
+	return types.ParsedFrame{Type: "HEADERS", Stream: 1, Headers: headers}
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	trackmehttp "github.com/pagpeter/trackme/pkg/http"
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+// How long an idle keep-alive connection may wait for its next request
+const h1KeepAliveTimeout = 5 * time.Second
+
+// serveHTTP1 serves all requests on a persistent (and possibly pipelined)
+// HTTP/1 connection. Every request carries the history of the connection, so
+// clients that change their headers after the first request can be spotted.
+func (srv *Server) serveHTTP1(conn net.Conn, br *bufio.Reader, tlsDetails *types.TLSDetails) error {
+	var previous *types.Response
+	var previousAt time.Time
+
+	for index := 0; ; index++ {
+		// Later requests may only keep the connection idle for a short while
+		timeout := requestTimeout
+		if index > 0 {
+			timeout = h1KeepAliveTimeout
+		}
+		if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return fmt.Errorf("failed to set read deadline: %w", err)
+		}
+		details, err := trackmehttp.ParseHTTP1(br)
+		if err != nil {
+			if index > 0 && (errors.Is(err, io.EOF) || errors.Is(err, os.ErrDeadlineExceeded)) {
+				// The client is done with the connection
+				if err := conn.Close(); err != nil {
+					log.Println("Error closing HTTP/1 connection:", err)
+				}
+				return nil
+			}
+			return fmt.Errorf("failed to read HTTP/1 request: %w", err)
+		}
+		// Reading the body and writing the response get a deadline of their own
+		receivedAt := time.Now()
+		if err := conn.SetDeadline(receivedAt.Add(requestTimeout)); err != nil {
+			return fmt.Errorf("failed to set deadline: %w", err)
+		}
+
+		details.IP = conn.RemoteAddr().String()
+		details.TLS = tlsDetails
+		body, err := readHTTP1Body(conn, br, details.Http1.Headers)
+		if err != nil {
+			return fmt.Errorf("failed to read HTTP/1 body: %w", err)
+		}
+		details.Body = body
+		details.Http1.History = getHTTP1History(index, previous, previousAt, details.Http1)
+
+		keepAlive := wantsKeepAlive(details)
+		if err := srv.respondToHTTP1(conn, details, keepAlive); err != nil {
+			return err
+		}
+		if !keepAlive {
+			return nil
+		}
+		previous = &details
+		previousAt = receivedAt
+	}
+}
+
+// wantsKeepAlive checks if the connection stays open after the request,
+// following the Connection header and the defaults of HTTP/1.1 and HTTP/1.0
+func wantsKeepAlive(resp types.Response) bool {
+	var tokens []string
+	for _, t := range strings.Split(getHeaderValue(resp.Http1.Headers, "connection"), ",") {
+		tokens = append(tokens, strings.ToLower(strings.TrimSpace(t)))
+	}
+	switch resp.HTTPVersion {
+	case "HTTP/1.1":
+		return !slices.Contains(tokens, "close")
+	case "HTTP/1.0":
+		return slices.Contains(tokens, "keep-alive")
+	}
+	return false
+}
+
+// getHeaderNames returns the lowercased header names in the order they were sent
+func getHeaderNames(headers []string) []string {
+	var names []string
+	for _, h := range headers {
+		if name, _, ok := strings.Cut(h, ":"); ok {
+			names = append(names, strings.ToLower(strings.TrimSpace(name)))
+		}
+	}
+	return names
+}
+
+// getHTTP1History compares a request with the previous one on the same connection
+func getHTTP1History(index int, previous *types.Response, previousAt time.Time, current *types.Http1Details) *types.Http1History {
+	history := &types.Http1History{RequestIndex: index}
+	if previous == nil || previous.Http1 == nil {
+		return history
+	}
+	history.SincePreviousMs = msSince(previousAt)
+
+	before := getHeaderNames(previous.Http1.Headers)
+	after := getHeaderNames(current.Headers)
+	var commonBefore, commonAfter []string
+	for _, name := range before {
+		if slices.Contains(after, name) {
+			commonBefore = append(commonBefore, name)
+		} else {
+			history.RemovedHeaders = append(history.RemovedHeaders, name)
+		}
+	}
+	for _, name := range after {
+		if slices.Contains(before, name) {
+			commonAfter = append(commonAfter, name)
+		} else {
+			history.AddedHeaders = append(history.AddedHeaders, name)
+		}
+	}
+	history.HeaderOrderChanged = !slices.Equal(commonBefore, commonAfter)
+	return history
+}
@@ -0,0 +1,219 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pagpeter/trackme/pkg/types"
+	"golang.org/x/net/http2"
+)
+
+// How long we wait for the client to open its window before giving up on the response
+const h2WindowUpdateTimeout = 5 * time.Second
+
+// Query parameter that carries the token of the previous response
+const http2ResponseTokenParam = "h2_token"
+
+const (
+	h2DefaultWindowSize   = 65535
+	h2DefaultMaxFrameSize = 16384
+)
+
+// h2SendWindow tracks the send side flow control state of a single response
+// stream, as dictated by the client's SETTINGS and WINDOW_UPDATE frames.
+type h2SendWindow struct {
+	stream        uint32
+	conn          int64
+	window        int64
+	initialWindow int64
+	maxFrameSize  int64
+}
+
+func newH2SendWindow(stream uint32, frames []types.ParsedFrame) *h2SendWindow {
+	w := &h2SendWindow{
+		stream:        stream,
+		conn:          h2DefaultWindowSize,
+		window:        h2DefaultWindowSize,
+		initialWindow: h2DefaultWindowSize,
+		maxFrameSize:  h2DefaultMaxFrameSize,
+	}
+	for _, f := range frames {
+		w.apply(f)
+	}
+	return w
+}
+
+// apply updates the windows according to a frame received from the client
+func (w *h2SendWindow) apply(frame types.ParsedFrame) {
+	switch frame.Type {
+	case "SETTINGS":
+		for _, setting := range frame.Settings {
+			parts := strings.Split(setting, " = ")
+			if len(parts) != 2 {
+				continue
+			}
+			val, err := strconv.ParseInt(parts[1], 10, 64)
+			if err != nil {
+				continue
+			}
+			switch parts[0] {
+			case "INITIAL_WINDOW_SIZE":
+				// 6.9.2: a change of SETTINGS_INITIAL_WINDOW_SIZE adjusts all open stream windows
+				w.window += val - w.initialWindow
+				w.initialWindow = val
+			case "MAX_FRAME_SIZE":
+				w.maxFrameSize = val
+			}
+		}
+	case "WINDOW_UPDATE":
+		if frame.Stream == 0 {
+			w.conn += int64(frame.Increment)
+		} else if frame.Stream == w.stream {
+			w.window += int64(frame.Increment)
+		}
+	}
+}
+
+// limitFrameSize caps the DATA frame size below the client's limit, 0 means no cap
+func (w *h2SendWindow) limitFrameSize(size uint32) {
+	if size > 0 {
+		w.maxFrameSize = min(w.maxFrameSize, int64(size))
+	}
+}
+
+// available returns how many bytes may be put into the next DATA frame
+func (w *h2SendWindow) available() int64 {
+	return min(w.conn, w.window, w.maxFrameSize)
+}
+
+func (w *h2SendWindow) consume(n int64) {
+	w.conn -= n
+	w.window -= n
+}
+
+func isAck(frame types.ParsedFrame) bool {
+	return len(frame.Flags) > 0 && frame.Flags[0] == "Ack (0x1)"
+}
+
+func isEndStream(frame types.ParsedFrame) bool {
+	return len(frame.Flags) > 0 && frame.Flags[0] == "EndStream (0x1)"
+}
+
+// ackSettings acknowledges a SETTINGS frame of the client. Clients only start
+// using their own settings (like a smaller receive window) once they are
+// acknowledged, so without it both sides disagree about the window.
+func ackSettings(fr *http2.Framer, frame types.ParsedFrame) error {
+	if frame.Type != "SETTINGS" || isAck(frame) {
+		return nil
+	}
+	return fr.WriteSettingsAck()
+}
+
+// returnFlowControlCredit sends WINDOW_UPDATEs for a received DATA frame on
+// both the connection and the stream, so the client can keep sending.
+func returnFlowControlCredit(fr *http2.Framer, frame types.ParsedFrame) error {
+	if frame.Length == 0 {
+		return nil
+	}
+	if err := fr.WriteWindowUpdate(0, frame.Length); err != nil {
+		return err
+	}
+	if isEndStream(frame) {
+		return nil
+	}
+	return fr.WriteWindowUpdate(frame.Stream, frame.Length)
+}
+
+// getPreviousHTTP2Response returns how the client read the response whose
+// token the request path carries, nil if it carries none
+func (srv *Server) getPreviousHTTP2Response(path string) *types.Http2SentResponse {
+	u, err := url.Parse(path)
+	if err != nil {
+		return nil
+	}
+	token := u.Query().Get(http2ResponseTokenParam)
+	if token == "" {
+		return nil
+	}
+	previous, ok := srv.GetHTTP2Responses().Lookup(token, 0)
+	if !ok {
+		return nil
+	}
+	return &previous
+}
+
+// writeHTTP2Body writes the response body on the stream, never exceeding the
+// client's flow control windows or maximum frame size. Frames the client sends
+// in the meantime are read from c, and its WINDOW_UPDATEs are recorded in the
+// returned description. Sending stops as soon as the client resets the stream
+// or sends a GOAWAY.
+func writeHTTP2Body(fr *http2.Framer, c chan types.ParsedFrame, w *h2SendWindow, body []byte) (types.Http2SentResponse, error) {
+	sent := types.Http2SentResponse{Size: len(body), WindowUpdates: []types.Http2WindowUpdate{}}
+	start := time.Now()
+	handle := func(frame types.ParsedFrame) error {
+		switch {
+		case frame.Type == "ERROR_CLOSE" || frame.Type == "ERROR":
+			return fmt.Errorf("connection closed while sending")
+		case frame.Type == "RST_STREAM" && frame.Stream == w.stream:
+			return fmt.Errorf("stream reset by client: %s", frame.ErrCode)
+		case frame.Type == "GOAWAY":
+			return fmt.Errorf("client sent GOAWAY while sending")
+		case frame.Type == "WINDOW_UPDATE":
+			sent.WindowUpdates = append(sent.WindowUpdates, types.Http2WindowUpdate{
+				Stream:          frame.Stream,
+				Increment:       frame.Increment,
+				ReceivedAfterMs: float64(time.Since(start).Microseconds()) / 1000,
+			})
+		}
+		w.apply(frame)
+		return ackSettings(fr, frame)
+	}
+	fail := func(err error) (types.Http2SentResponse, error) {
+		sent.Error = err.Error()
+		return sent, err
+	}
+
+	for len(body) > 0 {
+		n := w.available()
+		if n <= 0 {
+			select {
+			case frame := <-c:
+				if err := handle(frame); err != nil {
+					return fail(err)
+				}
+			case <-time.After(h2WindowUpdateTimeout):
+				return fail(fmt.Errorf("timed out waiting for WINDOW_UPDATE"))
+			}
+			continue
+		}
+
+		n = min(n, int64(len(body)))
+		if err := fr.WriteData(w.stream, false, body[:n]); err != nil {
+			return fail(fmt.Errorf("failed to write data chunk: %w", err))
+		}
+		w.consume(n)
+		sent.SentBytes += int(n)
+		body = body[n:]
+
+		// Pick up frames that arrived while we were writing without blocking
+	drain:
+		for {
+			select {
+			case frame := <-c:
+				if err := handle(frame); err != nil {
+					return fail(err)
+				}
+			default:
+				break drain
+			}
+		}
+	}
+
+	if err := fr.WriteData(w.stream, true, []byte{}); err != nil {
+		return fail(fmt.Errorf("failed to write final data frame: %w", err))
+	}
+	return sent, nil
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"log"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/pagpeter/trackme/pkg/types"
+	"golang.org/x/net/http2"
+)
+
+// Probe mode is requested by adding ?probe to the URL. The server then sends
+// frames that a passive observer never gets to see the client react to.
+const (
+	h2ProbeTimeout           = 500 * time.Millisecond
+	h2ProbeInitialWindowSize = 65535
+	h2ProbeWindowIncrement   = 1
+	h2MaxWindowSize          = 1<<31 - 1
+	// The connection window of a probed request body is refilled by this much
+	// once the client used it up, or sent nothing for h2ProbeStallTimeout
+	h2ProbeBodyIncrement = 4096
+	h2ProbeStallTimeout  = 50 * time.Millisecond
+)
+
+var h2ProbePingData = [8]byte{'T', 'r', 'a', 'c', 'k', 'M', 'e', '!'}
+
+func wantsHTTP2Probe(path string) bool {
+	u, err := url.Parse(path)
+	if err != nil {
+		return false
+	}
+	_, ok := u.Query()["probe"]
+	return ok
+}
+
+// countSettingsAcks returns how many SETTINGS frames the client acknowledged
+func countSettingsAcks(frames []types.ParsedFrame) int {
+	n := 0
+	for _, f := range frames {
+		if f.Type == "SETTINGS" && isAck(f) {
+			n++
+		}
+	}
+	return n
+}
+
+func msSince(t time.Time) float64 {
+	return float64(time.Since(t).Microseconds()) / 1000
+}
+
+// probeHTTP2 sends a PING, a second SETTINGS with a changed INITIAL_WINDOW_SIZE
+// and tiny WINDOW_UPDATEs, then records how the client responds until both
+// ACKs arrived or the probe timed out. pendingAcks is the number of SETTINGS
+// frames sent earlier that the client has not acknowledged yet, so their ACKs
+// are not mistaken for the probe's. It returns false if the connection died.
+func probeHTTP2(conn net.Conn, fr *http2.Framer, c chan types.ParsedFrame, stream uint32, pendingAcks int, profile types.H2Profile) (*types.Http2Probe, bool) {
+	// The new INITIAL_WINDOW_SIZE has to differ from what the profile announced
+	initialWindowSize := uint32(h2ProbeInitialWindowSize)
+	for _, s := range profile.Settings {
+		if http2.SettingID(s.ID) == http2.SettingInitialWindowSize && s.Value == initialWindowSize {
+			initialWindowSize /= 2
+		}
+	}
+
+	start := time.Now()
+	if err := fr.WritePing(false, h2ProbePingData); err != nil {
+		log.Println("Error writing probe ping:", err)
+		return nil, false
+	}
+	if err := fr.WriteSettings(http2.Setting{
+		ID: http2.SettingInitialWindowSize, Val: initialWindowSize,
+	}); err != nil {
+		log.Println("Error writing probe settings:", err)
+		return nil, false
+	}
+	// Profiles that already opened the connection window fully can't grow it any further
+	if h2DefaultWindowSize+int64(profile.WindowUpdate)+h2ProbeWindowIncrement <= h2MaxWindowSize {
+		if err := fr.WriteWindowUpdate(0, h2ProbeWindowIncrement); err != nil {
+			log.Println("Error writing probe window update:", err)
+			return nil, false
+		}
+	}
+	if err := fr.WriteWindowUpdate(stream, h2ProbeWindowIncrement); err != nil {
+		log.Println("Error writing probe window update:", err)
+		return nil, false
+	}
+
+	probe := &types.Http2Probe{ReceivedFrames: []types.Http2ProbeFrame{}}
+	timeout := time.After(h2ProbeTimeout)
+	for !probe.PingAcked || !probe.SettingsAcked {
+		select {
+		case frame := <-c:
+			if frame.Type == "ERROR_CLOSE" {
+				if err := conn.Close(); err != nil {
+					log.Println("Error closing connection:", err)
+				}
+				return nil, false
+			} else if frame.Type == "ERROR" {
+				return nil, false
+			}
+			if err := ackSettings(fr, frame); err != nil {
+				log.Println("Error writing settings ack:", err)
+				return nil, false
+			}
+			elapsed := msSince(start)
+			probe.ReceivedFrames = append(probe.ReceivedFrames, types.Http2ProbeFrame{
+				ParsedFrame:     frame,
+				ReceivedAfterMs: elapsed,
+			})
+
+			switch frame.Type {
+			case "PING":
+				if isAck(frame) {
+					probe.PingAcked = true
+					probe.PingAckLatencyMs = elapsed
+				}
+			case "SETTINGS":
+				if isAck(frame) {
+					if pendingAcks > 0 {
+						pendingAcks--
+						continue
+					}
+					probe.SettingsAcked = true
+					probe.SettingsAckLatencyMs = elapsed
+				}
+			case "WINDOW_UPDATE":
+				probe.WindowUpdates = append(probe.WindowUpdates, elapsed)
+			case "RST_STREAM":
+				probe.ResetStream = true
+			}
+		case <-timeout:
+			return probe, true
+		}
+	}
+	return probe, true
+}
+
+// h2WindowProbe reads the body of a probed request through a small connection
+// window. HTTP/2 has no way to shrink the connection window, so no credit is
+// returned for the body until the client used up the 65535 bytes every
+// connection starts with (plus the WINDOW_UPDATE of the profile), and then
+// only h2ProbeBodyIncrement at a time. The stream window is refilled as usual.
+type h2WindowProbe struct {
+	start  time.Time
+	window int64
+	result *types.Http2WindowProbe
+}
+
+func newH2WindowProbe(profile types.H2Profile) *h2WindowProbe {
+	window := int64(h2DefaultWindowSize) + int64(profile.WindowUpdate)
+	return &h2WindowProbe{
+		start:  time.Now(),
+		window: window,
+		result: &types.Http2WindowProbe{
+			InitialWindow: window,
+			DataFrames:    []types.Http2ProbeData{},
+		},
+	}
+}
+
+// receive records a DATA frame of the body and returns its stream credit. It
+// reports whether the connection window is used up.
+func (p *h2WindowProbe) receive(fr *http2.Framer, frame types.ParsedFrame) (bool, error) {
+	size := int64(frame.Length)
+	p.result.DataFrames = append(p.result.DataFrames, types.Http2ProbeData{
+		Size:            int(size),
+		WindowBefore:    p.window,
+		ReceivedAfterMs: msSince(p.start),
+	})
+	if size > p.window {
+		p.result.ExceededWindow = true
+	}
+	p.window -= size
+	if size > 0 && !isEndStream(frame) {
+		if err := fr.WriteWindowUpdate(frame.Stream, uint32(size)); err != nil {
+			return false, err
+		}
+	}
+	return p.window <= 0, nil
+}
+
+// refill grants the client more connection window, reason is why
+func (p *h2WindowProbe) refill(fr *http2.Framer, reason string) error {
+	increment := int64(h2ProbeBodyIncrement)
+	if p.window < 0 {
+		// The client sent more than it was allowed to
+		increment -= p.window
+	}
+	if err := fr.WriteWindowUpdate(0, uint32(increment)); err != nil {
+		return err
+	}
+	p.result.Refills = append(p.result.Refills, types.Http2ProbeRefill{
+		SentAfterMs:  msSince(p.start),
+		WindowBefore: p.window,
+		Reason:       reason,
+	})
+	p.window += increment
+	return nil
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/pagpeter/trackme/pkg/types"
+	"golang.org/x/net/http2"
+)
+
+var h2Profiles = map[string]types.H2Profile{
+	// Same settings that google uses
+	"google": {
+		Settings: []types.H2Setting{
+			{ID: uint16(http2.SettingInitialWindowSize), Value: 1048576},
+			{ID: uint16(http2.SettingMaxConcurrentStreams), Value: 100},
+			{ID: uint16(http2.SettingMaxHeaderListSize), Value: 65536},
+		},
+	},
+	"cloudflare": {
+		Settings: []types.H2Setting{
+			{ID: uint16(http2.SettingMaxConcurrentStreams), Value: 256},
+			{ID: uint16(http2.SettingInitialWindowSize), Value: 65536},
+			{ID: uint16(http2.SettingMaxFrameSize), Value: 16777215},
+		},
+		WindowUpdate: 2147418112,
+	},
+	"nginx": {
+		Settings: []types.H2Setting{
+			{ID: uint16(http2.SettingMaxConcurrentStreams), Value: 128},
+			{ID: uint16(http2.SettingInitialWindowSize), Value: 65536},
+			{ID: uint16(http2.SettingMaxFrameSize), Value: 16777215},
+		},
+		WindowUpdate:     2147418112,
+		MaxDataFrameSize: 8192,
+	},
+}
+
+// getH2Profile looks up a profile by name, "custom" is the one from the config
+func (srv *Server) getH2Profile(name string) (types.H2Profile, bool) {
+	if name == "custom" {
+		if srv.GetConfig().H2CustomProfile == nil {
+			return types.H2Profile{}, false
+		}
+		return *srv.GetConfig().H2CustomProfile, true
+	}
+	profile, ok := h2Profiles[name]
+	return profile, ok
+}
+
+// defaultH2Profile returns the profile selected in the config, falling back to google
+func (srv *Server) defaultH2Profile() (string, types.H2Profile) {
+	name := srv.GetConfig().H2Profile
+	if profile, ok := srv.getH2Profile(name); ok {
+		return name, profile
+	}
+	return "google", h2Profiles["google"]
+}
+
+// h2ProfileFromHost picks a profile by the first label of the hostname, eg nginx.tls.peet.ws
+func (srv *Server) h2ProfileFromHost(host string) (string, types.H2Profile, bool) {
+	label, _, found := strings.Cut(host, ".")
+	if !found {
+		return "", types.H2Profile{}, false
+	}
+	profile, ok := srv.getH2Profile(label)
+	return label, profile, ok
+}
+
+// writeH2Profile sends the SETTINGS and the initial WINDOW_UPDATE of a profile
+func writeH2Profile(fr *http2.Framer, profile types.H2Profile) error {
+	settings := make([]http2.Setting, 0, len(profile.Settings))
+	for _, s := range profile.Settings {
+		settings = append(settings, http2.Setting{ID: http2.SettingID(s.ID), Val: s.Value})
+	}
+	if err := fr.WriteSettings(settings...); err != nil {
+		return err
+	}
+	if profile.WindowUpdate > 0 {
+		return fr.WriteWindowUpdate(0, profile.WindowUpdate)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pagpeter/quic-go"
+	"github.com/pagpeter/quic-go/http3"
+	trackmehttp "github.com/pagpeter/trackme/pkg/http"
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+// getHTTP3Headers returns the request's header fields in the order the client
+// sent them. They are decoded from the HEADERS frame of the request stream,
+// together with how each field was represented. If the stream couldn't be
+// read, the fields are rebuilt from the request, see rebuildHTTP3Headers.
+func getHTTP3Headers(r *http.Request, streams map[int64]trackmehttp.HTTP3Stream) ([]string, []types.Http3HeaderField) {
+	// The request body knows its stream. ResponseWriter.HTTPStream would
+	// hijack the stream, so the response would never be finished.
+	str, ok := r.Body.(interface{ StreamID() quic.StreamID })
+	if !ok {
+		return rebuildHTTP3Headers(r), nil
+	}
+	stream := streams[int64(str.StreamID())]
+	if len(stream.HeaderBlocks) == 0 {
+		return rebuildHTTP3Headers(r), nil
+	}
+	fields, err := trackmehttp.DecodeQPACK(stream.HeaderBlocks[0])
+	if err != nil {
+		return rebuildHTTP3Headers(r), nil
+	}
+
+	var headers []string
+	for _, field := range fields {
+		if field.Table == "dynamic" {
+			// The name or value is in a dynamic table the server never allowed
+			return rebuildHTTP3Headers(r), fields
+		}
+		headers = append(headers, fmt.Sprintf("%s: %s", field.Name, field.Value))
+	}
+	return headers, fields
+}
+
+// rebuildHTTP3Headers returns the header fields in the order they were
+// QPACK-decoded by quic-go. The fork only exposes the field names in wire
+// order, so the values are taken from the parsed request again.
+func rebuildHTTP3Headers(r *http.Request) []string {
+	names, ok := r.Context().Value(http3.RawHeaderFieldsContextKey).([]string)
+	if !ok {
+		return synthesizeHTTP3Headers(r)
+	}
+
+	cookies := 0
+	for _, name := range names {
+		if name == "cookie" {
+			cookies++
+		}
+	}
+
+	var headers []string
+	used := map[string]int{}
+	for _, name := range names {
+		var values []string
+		switch name {
+		case ":method":
+			values = []string{r.Method}
+		case ":authority":
+			values = []string{r.Host}
+		case ":scheme":
+			values = []string{r.URL.Scheme}
+			if r.URL.Scheme == "" {
+				values = []string{"https"}
+			}
+		case ":path":
+			values = []string{r.RequestURI}
+		case ":protocol":
+			values = []string{r.Proto}
+		case "cookie":
+			// Cookie fields have been joined into a single header
+			values = r.Header.Values(name)
+			if cookies > 1 && len(values) == 1 {
+				values = strings.SplitN(values[0], "; ", cookies)
+			}
+		default:
+			values = r.Header.Values(name)
+		}
+
+		value := ""
+		if i := used[name]; i < len(values) {
+			value = values[i]
+		}
+		used[name]++
+		headers = append(headers, fmt.Sprintf("%s: %s", name, value))
+	}
+	return headers
+}
+
+// synthesizeHTTP3Headers rebuilds the headers when the wire order isn't
+// available. Pseudo-headers get a fixed order and regular headers a random one.
+func synthesizeHTTP3Headers(r *http.Request) []string {
+	headers := []string{
+		fmt.Sprintf(":method: %s", r.Method),
+		fmt.Sprintf(":authority: %s", r.Host),
+		":scheme: https",
+		fmt.Sprintf(":path: %s", r.URL.RequestURI()),
+	}
+	for name, values := range r.Header {
+		for _, value := range values {
+			headers = append(headers, fmt.Sprintf("%s: %s", strings.ToLower(name), value))
+		}
+	}
+	return headers
+}
@@ -0,0 +1,279 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/pagpeter/quic-go"
+	"github.com/pagpeter/quic-go/http3"
+	"github.com/pagpeter/quic-go/logging"
+	trackmehttp "github.com/pagpeter/trackme/pkg/http"
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+// Limits for what is recorded per QUIC connection
+const (
+	quicMaxPackets         = 128
+	quicMaxFramesPerStream = 64
+)
+
+// quicRecorder records what a client sent on a QUIC connection, as seen by
+// the connection tracer. The tracer only sees frame metadata, the HTTP/3
+// frames inside the streams are added from the decrypted packets, see
+// readHTTP3Streams.
+type quicRecorder struct {
+	mu      sync.Mutex
+	start   time.Time
+	packets []types.QUICPacket
+	streams map[int64]*types.Http3Stream
+	order   []int64
+}
+
+func newQUICRecorder() *quicRecorder {
+	return &quicRecorder{
+		start:   time.Now(),
+		streams: map[int64]*types.Http3Stream{},
+	}
+}
+
+// NewQUICTracer is used as quic.Config.Tracer. It records the packets and
+// streams of every connection, until the connection is closed.
+func (srv *Server) NewQUICTracer(ctx context.Context, p logging.Perspective, _ quic.ConnectionID) *logging.ConnectionTracer {
+	id, ok := ctx.Value(quic.ConnectionTracingKey).(quic.ConnectionTracingID)
+	if !ok || p != logging.PerspectiveServer {
+		return nil
+	}
+	rec := newQUICRecorder()
+	srv.GetQUICConnections().Store(id, rec)
+	var remoteAddr string
+
+	return &logging.ConnectionTracer{
+		StartedConnection: func(_, remote net.Addr, _, _ logging.ConnectionID) {
+			remoteAddr = remote.String()
+			if v, ok := srv.GetQUICInitials().Load(remoteAddr); ok {
+				v.(*quicInitialFlight).setConnected()
+			}
+		},
+		ReceivedLongHeaderPacket: func(hdr *logging.ExtendedHeader, size logging.ByteCount, _ logging.ECN, frames []logging.Frame) {
+			rec.receivedPacket(hdr.Type.String(), size, frames)
+		},
+		ReceivedShortHeaderPacket: func(_ *logging.ShortHeader, size logging.ByteCount, _ logging.ECN, frames []logging.Frame) {
+			rec.receivedPacket("1-RTT", size, frames)
+		},
+		Close: func() {
+			srv.GetQUICConnections().Delete(id)
+			if remoteAddr != "" {
+				srv.GetQUICInitials().Delete(remoteAddr)
+			}
+		},
+	}
+}
+
+// getQUICRecorder returns the recorder of the connection a request was made on
+func (srv *Server) getQUICRecorder(ctx context.Context) *quicRecorder {
+	id, ok := ctx.Value(quic.ConnectionTracingKey).(quic.ConnectionTracingID)
+	if !ok {
+		return nil
+	}
+	v, ok := srv.GetQUICConnections().Load(id)
+	if !ok {
+		return nil
+	}
+	return v.(*quicRecorder)
+}
+
+// HTTP3UniStreamHijacker is used as http3.Server.UniStreamHijacker. quic-go
+// only hands over unidirectional streams of unknown types, like GREASE
+// streams, so their type is recorded and the data is discarded.
+func (srv *Server) HTTP3UniStreamHijacker(st http3.StreamType, id quic.ConnectionTracingID, str *quic.ReceiveStream, err error) bool {
+	if err != nil {
+		return false
+	}
+	if v, ok := srv.GetQUICConnections().Load(id); ok {
+		v.(*quicRecorder).setStreamType(int64(str.StreamID()), uint64(st))
+	}
+	go func() {
+		_, _ = io.Copy(io.Discard, str)
+	}()
+	return true
+}
+
+func (rec *quicRecorder) receivedPacket(packetType string, size logging.ByteCount, frames []logging.Frame) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	receivedAfter := msSince(rec.start)
+	var summary []string
+	for _, f := range frames {
+		summary = append(summary, describeQUICFrame(f))
+		if sf, ok := f.(*logging.StreamFrame); ok {
+			rec.receivedStreamFrame(sf, receivedAfter)
+		}
+	}
+	if len(rec.packets) < quicMaxPackets {
+		rec.packets = append(rec.packets, types.QUICPacket{
+			Type:            packetType,
+			Size:            int(size),
+			ReceivedAfterMs: receivedAfter,
+			Frames:          summary,
+		})
+	}
+}
+
+func (rec *quicRecorder) getStream(id int64, openedAfter float64) *types.Http3Stream {
+	s, ok := rec.streams[id]
+	if !ok {
+		s = &types.Http3Stream{ID: id, OpenedAfterMs: openedAfter}
+		rec.streams[id] = s
+		rec.order = append(rec.order, id)
+	}
+	return s
+}
+
+func (rec *quicRecorder) receivedStreamFrame(f *logging.StreamFrame, receivedAfter float64) {
+	s := rec.getStream(int64(f.StreamID), receivedAfter)
+	if end := int64(f.Offset + f.Length); end > s.Size {
+		s.Size = end
+	}
+	s.Fin = s.Fin || f.Fin
+	if len(s.Frames) < quicMaxFramesPerStream {
+		s.Frames = append(s.Frames, types.Http3StreamFrame{
+			Offset:          int64(f.Offset),
+			Length:          int64(f.Length),
+			Fin:             f.Fin,
+			ReceivedAfterMs: receivedAfter,
+		})
+	}
+}
+
+func (rec *quicRecorder) setStreamType(id int64, streamType uint64) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.getStream(id, msSince(rec.start)).StreamType = &streamType
+}
+
+// setHTTP3Streams adds the stream types and HTTP/3 frames read from the
+// decrypted stream data
+func (rec *quicRecorder) setHTTP3Streams(streams map[int64]trackmehttp.HTTP3Stream) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	for id, stream := range streams {
+		s := rec.getStream(id, msSince(rec.start))
+		if stream.StreamType != nil {
+			s.StreamType = stream.StreamType
+		}
+		s.Http3Frames = stream.Frames
+		if len(s.Http3Frames) > quicMaxFramesPerStream {
+			s.Http3Frames = s.Http3Frames[:quicMaxFramesPerStream]
+		}
+	}
+}
+
+// getPackets returns a copy of the packets received so far
+func (rec *quicRecorder) getPackets() []types.QUICPacket {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return slices.Clone(rec.packets)
+}
+
+// getStreams returns a copy of the client's streams received so far, in the
+// order they were opened
+func (rec *quicRecorder) getStreams() []types.Http3Stream {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	var streams []types.Http3Stream
+	for _, id := range rec.order {
+		s := *rec.streams[id]
+		s.Frames = slices.Clone(s.Frames)
+		s.Http3Frames = slices.Clone(s.Http3Frames)
+		s.Type = getHTTP3StreamType(s)
+		streams = append(streams, s)
+	}
+	return streams
+}
+
+// getHTTP3StreamType classifies a client stream. Bidirectional streams are
+// requests, unidirectional streams are told apart by the type they start with.
+func getHTTP3StreamType(s types.Http3Stream) string {
+	if s.ID%4 == 0 {
+		return "request"
+	}
+	if s.StreamType == nil {
+		return "unknown"
+	}
+	switch *s.StreamType {
+	case trackmehttp.HTTP3StreamControl:
+		return "control"
+	case trackmehttp.HTTP3StreamPush:
+		return "push"
+	case trackmehttp.HTTP3StreamQPACKEncoder:
+		return "qpack_encoder"
+	case trackmehttp.HTTP3StreamQPACKDecoder:
+		return "qpack_decoder"
+	}
+	if trackmehttp.IsHTTP3Grease(*s.StreamType) {
+		return "grease"
+	}
+	return "unknown"
+}
+
+// describeQUICFrame summarizes a QUIC frame for the packet log
+func describeQUICFrame(f logging.Frame) string {
+	switch f := f.(type) {
+	case *logging.CryptoFrame:
+		return fmt.Sprintf("CRYPTO (offset=%d, length=%d)", f.Offset, f.Length)
+	case *logging.StreamFrame:
+		fin := ""
+		if f.Fin {
+			fin = ", fin"
+		}
+		return fmt.Sprintf("STREAM (id=%d, offset=%d, length=%d%s)", f.StreamID, f.Offset, f.Length, fin)
+	case *logging.DatagramFrame:
+		return fmt.Sprintf("DATAGRAM (length=%d)", f.Length)
+	case *logging.AckFrame:
+		return "ACK"
+	case *logging.PingFrame:
+		return "PING"
+	case *logging.ConnectionCloseFrame:
+		return "CONNECTION_CLOSE"
+	case *logging.HandshakeDoneFrame:
+		return "HANDSHAKE_DONE"
+	case *logging.MaxDataFrame:
+		return fmt.Sprintf("MAX_DATA (%d)", f.MaximumData)
+	case *logging.MaxStreamDataFrame:
+		return fmt.Sprintf("MAX_STREAM_DATA (id=%d, %d)", f.StreamID, f.MaximumStreamData)
+	case *logging.MaxStreamsFrame:
+		return fmt.Sprintf("MAX_STREAMS (%d)", f.MaxStreamNum)
+	case *logging.DataBlockedFrame:
+		return "DATA_BLOCKED"
+	case *logging.StreamDataBlockedFrame:
+		return fmt.Sprintf("STREAM_DATA_BLOCKED (id=%d)", f.StreamID)
+	case *logging.StreamsBlockedFrame:
+		return "STREAMS_BLOCKED"
+	case *logging.NewConnectionIDFrame:
+		return "NEW_CONNECTION_ID"
+	case *logging.RetireConnectionIDFrame:
+		return "RETIRE_CONNECTION_ID"
+	case *logging.NewTokenFrame:
+		return "NEW_TOKEN"
+	case *logging.PathChallengeFrame:
+		return "PATH_CHALLENGE"
+	case *logging.PathResponseFrame:
+		return "PATH_RESPONSE"
+	case *logging.ResetStreamFrame:
+		return fmt.Sprintf("RESET_STREAM (id=%d)", f.StreamID)
+	case *logging.StopSendingFrame:
+		return fmt.Sprintf("STOP_SENDING (id=%d)", f.StreamID)
+	case *logging.AckFrequencyFrame:
+		return "ACK_FREQUENCY"
+	case *logging.ImmediateAckFrame:
+		return "IMMEDIATE_ACK"
+	}
+	return fmt.Sprintf("%T", f)
+}
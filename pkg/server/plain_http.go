@@ -0,0 +1,133 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+const (
+	// Query parameter of the redirect that links the HTTPS request to the plain HTTP one
+	plainHTTPTokenParam = "http_token"
+	// How long a plain HTTP request can be linked after the redirect
+	plainHTTPTokenTTL = 60 * time.Second
+	// How many plain HTTP requests are kept for linking at most
+	plainHTTPMaxRequests = 10000
+	// How much of the raw plain HTTP request is kept
+	plainHTTPMaxRaw = 8192
+)
+
+type plainHTTPRequest struct {
+	details    types.PlainHTTPDetails
+	receivedAt time.Time
+}
+
+// newPlainHTTPRequestStore creates the store of plain HTTP requests waiting to be linked
+func newPlainHTTPRequestStore() *FingerprintStore[plainHTTPRequest] {
+	store := NewFingerprintStore[plainHTTPRequest]()
+	store.SetLimits(plainHTTPMaxRequests, plainHTTPTokenTTL)
+	return store
+}
+
+// newToken generates a random, unguessable token, like the redirect tokens
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// storePlainHTTPRequest keeps a plain HTTP request until it expires or is
+// pushed out by newer ones, and returns the token it can be looked up with
+func (srv *Server) storePlainHTTPRequest(req types.Response) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate redirect token: %w", err)
+	}
+
+	details := types.PlainHTTPDetails{
+		IP:          req.IP,
+		Method:      req.Method,
+		Path:        req.Path,
+		HTTPVersion: req.HTTPVersion,
+		UserAgent:   req.UserAgent,
+	}
+	if req.Http1 != nil {
+		http1 := *req.Http1
+		if len(http1.Raw) > plainHTTPMaxRaw {
+			http1.Raw = http1.Raw[:plainHTTPMaxRaw]
+		}
+		details.Http1 = &http1
+	}
+	if tcpip, ok := srv.GetTCPFingerprints().Lookup(req.IP, srv.getTCPFingerprintWait(req.IP)); ok {
+		details.TCPIP = &tcpip
+	}
+
+	srv.GetPlainHTTPRequests().Store(token, plainHTTPRequest{details: details, receivedAt: time.Now()})
+	return token, nil
+}
+
+// linkPlainHTTPRequest attaches the plain HTTP request with the given redirect
+// token to an HTTPS request, and compares the two
+func (srv *Server) linkPlainHTTPRequest(res *types.Response, token string) {
+	req, ok := srv.GetPlainHTTPRequests().Lookup(token, 0)
+	if !ok {
+		return
+	}
+	details := req.details
+	details.SecondsBeforeHTTPS = time.Since(req.receivedAt).Seconds()
+	details.SameUserAgent = details.UserAgent == GetUserAgent(*res)
+	if res.Http1 != nil && details.Http1 != nil {
+		matches := res.Http1.HeaderOrderHash == details.Http1.HeaderOrderHash
+		details.HeaderOrderMatches = &matches
+	}
+	res.PlainHTTP = &details
+}
+
+// redirectLocation returns the HTTPS URL for a plain HTTP request, carrying the redirect token
+func (srv *Server) redirectLocation(path, token string) string {
+	if !strings.HasPrefix(path, "/") {
+		path = "/"
+	}
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	return strings.TrimSuffix(srv.GetConfig().HTTPRedirect, "/") + path + sep + plainHTTPTokenParam + "=" + url.QueryEscape(token)
+}
+
+// redirectHTTP1 fingerprints a plain HTTP/1 request and redirects it to the
+// HTTPS site, with a token that links both requests. The redirect is
+// temporary and not cacheable, as the token is only valid for this request.
+func (srv *Server) redirectHTTP1(conn net.Conn, req types.Response) {
+	Log(fmt.Sprintf("%v %v %v %v %v", cleanIP(req.IP), req.Method, req.HTTPVersion, req.Path, "redirect"))
+
+	location := srv.GetConfig().HTTPRedirect
+	if token, err := srv.storePlainHTTPRequest(req); err != nil {
+		log.Println("Error storing plain HTTP request:", err)
+	} else {
+		location = srv.redirectLocation(req.Path, token)
+	}
+
+	res := "HTTP/1.1 307 Temporary Redirect\r\n"
+	res += "Location: " + location + "\r\n"
+	res += "Cache-Control: no-store\r\n"
+	res += "Content-Length: 0\r\n"
+	res += "Connection: close\r\n"
+	res += "Server: TrackMe\r\n"
+	res += "\r\n"
+	if _, err := conn.Write([]byte(res)); err != nil {
+		log.Println("Error writing redirect:", err)
+	}
+	if err := conn.Close(); err != nil {
+		log.Println("Error closing redirected connection:", err)
+	}
+}
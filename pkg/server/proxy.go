@@ -0,0 +1,143 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pagpeter/trackme/pkg/types"
+	"github.com/pagpeter/trackme/pkg/utils"
+)
+
+// An RTT is only suspicious if it exceeds the TCP RTT by both of these. The
+// TLS handshake RTT also includes the client's processing time.
+const (
+	proxyRTTMinDifferenceMs = 15
+	proxyRTTMinFactor       = 2
+)
+
+// tunnelMSS maps MSS values that are typical for tunnels to what they suggest.
+// Plain Ethernet is 1460, PPPoE 1452.
+var tunnelMSS = map[int]string{
+	1400: "IPsec or a VPN with an MTU of 1440",
+	1380: "WireGuard over IPv4 (MTU 1420)",
+	1360: "WireGuard over IPv6 or OpenVPN",
+	1350: "OpenVPN",
+	1340: "a VPN with an MTU of 1380",
+	1320: "a VPN with an MTU of 1360",
+}
+
+// getClaimedOS returns the OS a user agent claims, empty if it claims none
+func getClaimedOS(ua string) string {
+	switch {
+	case strings.Contains(ua, "Windows"):
+		return "Windows"
+	case strings.Contains(ua, "iPhone"), strings.Contains(ua, "iPad"):
+		return "iOS"
+	case strings.Contains(ua, "Macintosh"), strings.Contains(ua, "Mac OS X"):
+		return "Mac OS X"
+	case strings.Contains(ua, "Android"):
+		return "Android"
+	case strings.Contains(ua, "CrOS"):
+		return "Chrome OS"
+	case strings.Contains(ua, "Linux"):
+		return "Linux"
+	}
+	return ""
+}
+
+// getExpectedInitialTTL returns the initial TTL the claimed OS sends packets with
+func getExpectedInitialTTL(os string) int {
+	if os == "Windows" {
+		return 128
+	}
+	return 64
+}
+
+// osMatchesClaim reports whether an OS guessed from the SYN fits the claimed OS
+func osMatchesClaim(guessed, claimed string) bool {
+	switch claimed {
+	case "Android", "Chrome OS", "Linux":
+		return guessed == claimed || guessed == "Linux" || guessed == "Android"
+	case "iOS", "Mac OS X":
+		return guessed == "iOS" || guessed == "Mac OS X"
+	}
+	return guessed == claimed
+}
+
+// getProxyLikelihood weighs the signals that a client connects through a
+// proxy or VPN. The TCP connection of a proxied client ends at the proxy, so
+// its TCP RTT is shorter than the RTT of the TLS and HTTP/2 exchanges with the
+// real client. Tunnels lower the MSS, and the TTL or SYN may not fit the OS
+// the user agent claims.
+func getProxyLikelihood(res types.Response) *types.ProxyLikelihood {
+	p := &types.ProxyLikelihood{Evidence: []types.ProxyEvidence{}}
+	add := func(signal string, weight int, format string, args ...any) {
+		p.Evidence = append(p.Evidence, types.ProxyEvidence{
+			Signal: signal,
+			Detail: fmt.Sprintf(format, args...),
+			Weight: weight,
+		})
+		p.Score += weight
+	}
+
+	if info := res.TCPIP.TCPInfo; info != nil && info.Handshake != nil {
+		p.TCPRTTMs = info.Handshake.MinRTTMs
+	}
+	if res.TLS != nil {
+		p.TLSRTTMs = res.TLS.HandshakeRTTMs
+	}
+	if res.Http2 != nil && res.Http2.Probe != nil && res.Http2.Probe.PingAcked {
+		p.H2PingRTTMs = res.Http2.Probe.PingAckLatencyMs
+	}
+	if p.TCPRTTMs > 0 {
+		for _, rtt := range []struct {
+			name  string
+			value float64
+		}{
+			{"tls_rtt", p.TLSRTTMs},
+			{"h2_ping_rtt", p.H2PingRTTMs},
+		} {
+			if rtt.value-p.TCPRTTMs >= proxyRTTMinDifferenceMs && rtt.value >= p.TCPRTTMs*proxyRTTMinFactor {
+				add(rtt.name, 35, "%s of %.1fms is %.1fx the TCP RTT of %.1fms", strings.ReplaceAll(rtt.name, "_", " "), rtt.value, rtt.value/p.TCPRTTMs, p.TCPRTTMs)
+			}
+		}
+	}
+
+	if res.TCPIP.TCP.MSS > 0 {
+		p.MSS = res.TCPIP.TCP.MSS
+		if tunnel, ok := tunnelMSS[p.MSS]; ok {
+			add("mss", 25, "MSS of %d is typical for %s", p.MSS, tunnel)
+		} else if p.MSS < 1400 {
+			add("mss", 15, "MSS of %d is lower than common links use", p.MSS)
+		}
+	}
+
+	ua := res.UserAgent
+	if ua == "" {
+		ua = GetUserAgent(res)
+	}
+	p.ClaimedOS = getClaimedOS(ua)
+	if res.TCPIP.IP.TTL > 0 {
+		p.TTL = res.TCPIP.IP.TTL
+		p.InitialTTL = utils.GuessInitialTTL(p.TTL)
+		if expected := getExpectedInitialTTL(p.ClaimedOS); p.ClaimedOS != "" && p.InitialTTL != expected {
+			add("ttl", 30, "initial TTL of %d doesn't fit %s, which uses %d", p.InitialTTL, p.ClaimedOS, expected)
+		}
+	}
+	if os := res.TCPIP.OS; os != nil && p.ClaimedOS != "" && (os.Quality == "exact" || os.Quality == "generic") {
+		if !osMatchesClaim(os.Name, p.ClaimedOS) {
+			add("os", 20, "SYN matches %s, but the user agent claims %s", os.Label, p.ClaimedOS)
+		}
+	}
+
+	p.Score = min(p.Score, 100)
+	switch {
+	case p.Score >= 60:
+		p.Likelihood = "high"
+	case p.Score >= 25:
+		p.Likelihood = "medium"
+	default:
+		p.Likelihood = "low"
+	}
+	return p
+}
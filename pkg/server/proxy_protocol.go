@@ -0,0 +1,440 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+// proxyHeaderTimeout is how long a trusted source has to send its PROXY header
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyV1Prefix starts every PROXY protocol v1 header
+const proxyV1Prefix = "PROXY "
+
+// proxyV2Signature starts every PROXY protocol v2 header
+var proxyV2Signature = []byte{0x0d, 0x0a, 0x0d, 0x0a, 0x00, 0x0d, 0x0a, 0x51, 0x55, 0x49, 0x54, 0x0a}
+
+// PROXY protocol v2 TLV types
+const (
+	proxyTLVALPN      = 0x01
+	proxyTLVAuthority = 0x02
+	proxyTLVUniqueID  = 0x05
+	proxyTLVSSL       = 0x20
+	proxyTLVSSLVer    = 0x21
+	proxyTLVSSLCN     = 0x22
+	proxyTLVSSLCipher = 0x23
+	proxyTLVSSLSigAlg = 0x24
+	proxyTLVSSLKeyAlg = 0x25
+)
+
+// proxyConn is a connection from a load balancer. Its addresses are the ones
+// of the client's connection to the balancer.
+type proxyConn struct {
+	net.Conn
+	srv *Server
+	// pending was read past the PROXY header and is returned first
+	pending []byte
+	// remote and local are nil if the header has no addresses, header is nil
+	// for the LOCAL command of v2
+	remote, local net.Addr
+	header        *types.ProxyProtocolDetails
+	closeOnce     sync.Once
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+// NetConn returns the connection to the load balancer
+func (c *proxyConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *proxyConn) Close() error {
+	c.closeOnce.Do(func() {
+		if c.header != nil {
+			c.srv.GetProxyProtocolHeaders().Delete(c.RemoteAddr().String())
+		}
+	})
+	return c.Conn.Close()
+}
+
+type proxyProtocolListener struct {
+	net.Listener
+	srv     *Server
+	trusted []*net.IPNet
+	conns   chan net.Conn
+	errs    chan error
+	// done is closed with the listener, so pending sends give up
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// AcceptProxyProtocol wraps a listener so connections from the trusted
+// sources of the config can start with a PROXY protocol v1 or v2 header. The
+// headers are read in the background, so slow sources don't hold up Accept.
+// The listener is returned as is if no source is trusted.
+func (srv *Server) AcceptProxyProtocol(l net.Listener) (net.Listener, error) {
+	var trusted []*net.IPNet
+	for _, source := range srv.GetConfig().ProxyProtocolTrusted {
+		if !strings.Contains(source, "/") {
+			if strings.Contains(source, ":") {
+				source += "/128"
+			} else {
+				source += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(source)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted PROXY protocol source: %w", err)
+		}
+		trusted = append(trusted, network)
+	}
+	if len(trusted) == 0 {
+		return l, nil
+	}
+
+	pl := &proxyProtocolListener{
+		Listener: l,
+		srv:      srv,
+		trusted:  trusted,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		done:     make(chan struct{}),
+	}
+	go pl.acceptLoop()
+	return pl, nil
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *proxyProtocolListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	return l.Listener.Close()
+}
+
+// deliver hands a connection to Accept, and closes it if the listener was closed first
+func (l *proxyProtocolListener) deliver(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		if err := conn.Close(); err != nil {
+			Log(fmt.Sprintf("Error closing connection: %v", err))
+		}
+	}
+}
+
+func (l *proxyProtocolListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.done:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if !l.isTrusted(conn.RemoteAddr()) {
+			l.deliver(conn)
+			continue
+		}
+		go func() {
+			proxied, err := l.srv.readProxyHeader(conn)
+			if err != nil {
+				Log(fmt.Sprintf("Invalid PROXY header from %s: %v", conn.RemoteAddr(), err))
+				if err := conn.Close(); err != nil {
+					Log(fmt.Sprintf("Error closing connection: %v", err))
+				}
+				return
+			}
+			l.deliver(proxied)
+		}()
+	}
+}
+
+func (l *proxyProtocolListener) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range l.trusted {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// readProxyHeader reads the PROXY header of a connection from a trusted
+// source. A trusted source has to send one, otherwise the balancer would be
+// taken for the client.
+func (srv *Server) readProxyHeader(conn net.Conn) (*proxyConn, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout)); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReaderSize(conn, 512)
+	first, err := br.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &proxyConn{Conn: conn, srv: srv}
+	switch prefix, _ := br.Peek(len(proxyV1Prefix)); {
+	case string(prefix) == proxyV1Prefix:
+		err = c.readV1(br)
+	case first[0] == proxyV2Signature[0]:
+		err = c.readV2(br)
+	default:
+		// Likely a ClientHello or an HTTP request sent directly
+		err = errors.New("no PROXY header")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+
+	buffered, _ := br.Peek(br.Buffered())
+	c.pending = append([]byte(nil), buffered...)
+	if c.header != nil {
+		c.header.ProxyAddr = conn.RemoteAddr().String()
+		srv.GetProxyProtocolHeaders().Store(c.RemoteAddr().String(), c.header)
+	}
+	return c, nil
+}
+
+// readV1 reads a header like "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"
+func (c *proxyConn) readV1(br *bufio.Reader) error {
+	line, err := br.ReadSlice('\n')
+	if err != nil {
+		return fmt.Errorf("failed to read v1 header: %w", err)
+	}
+	if len(line) > 107 || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return errors.New("v1 header too long or not terminated by CRLF")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 {
+		return errors.New("v1 header has no protocol")
+	}
+	c.header = &types.ProxyProtocolDetails{Version: 1, Protocol: fields[1]}
+	if fields[1] == "UNKNOWN" {
+		// The balancer doesn't know the client's address
+		return nil
+	}
+	if (fields[1] != "TCP4" && fields[1] != "TCP6") || len(fields) != 6 {
+		return fmt.Errorf("invalid v1 header %q", strings.TrimSpace(string(line)))
+	}
+	src, err := parseV1Addr(fields[2], fields[4])
+	if err != nil {
+		return err
+	}
+	dst, err := parseV1Addr(fields[3], fields[5])
+	if err != nil {
+		return err
+	}
+	c.remote, c.local = src, dst
+	c.header.SourceAddr, c.header.DestinationAddr = src.String(), dst.String()
+	return nil
+}
+
+func parseV1Addr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid v1 address %q", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid v1 port %q", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// readV2 reads a binary header and its TLVs
+func (c *proxyConn) readV2(br *bufio.Reader) error {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return fmt.Errorf("failed to read v2 header: %w", err)
+	}
+	if !bytes.Equal(hdr[:12], proxyV2Signature) {
+		return errors.New("not a v2 header")
+	}
+	if hdr[12]>>4 != 2 {
+		return fmt.Errorf("unsupported PROXY protocol version %d", hdr[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return fmt.Errorf("failed to read v2 header: %w", err)
+	}
+
+	switch hdr[12] & 0x0f {
+	case 0x0:
+		// LOCAL, like health checks of the balancer itself
+		return nil
+	case 0x1:
+	default:
+		return fmt.Errorf("unknown v2 command %d", hdr[12]&0x0f)
+	}
+
+	c.header = &types.ProxyProtocolDetails{Version: 2}
+	var addrLen int
+	switch hdr[13] >> 4 {
+	case 0x1:
+		addrLen = 12
+	case 0x2:
+		addrLen = 36
+	case 0x3:
+		addrLen = 216
+	}
+	switch hdr[13] & 0x0f {
+	case 0x1:
+		c.header.Protocol = "TCP"
+	case 0x2:
+		c.header.Protocol = "UDP"
+	default:
+		c.header.Protocol = "UNSPEC"
+	}
+	if len(body) < addrLen {
+		return errors.New("v2 addresses are truncated")
+	}
+
+	if ipLen := (addrLen - 4) / 2; addrLen == 12 || addrLen == 36 {
+		src := &net.TCPAddr{IP: net.IP(body[:ipLen]), Port: int(binary.BigEndian.Uint16(body[2*ipLen:]))}
+		dst := &net.TCPAddr{IP: net.IP(body[ipLen : 2*ipLen]), Port: int(binary.BigEndian.Uint16(body[2*ipLen+2:]))}
+		if addrLen == 12 {
+			c.header.Protocol += "4"
+		} else {
+			c.header.Protocol += "6"
+		}
+		c.remote, c.local = src, dst
+		c.header.SourceAddr, c.header.DestinationAddr = src.String(), dst.String()
+	}
+	return parseProxyTLVs(body[addrLen:], c.header)
+}
+
+// walkProxyTLVs calls fn for every TLV of a v2 header
+func walkProxyTLVs(b []byte, fn func(typ byte, value []byte) error) error {
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return errors.New("v2 TLV is truncated")
+		}
+		length := int(binary.BigEndian.Uint16(b[1:]))
+		if len(b) < 3+length {
+			return errors.New("v2 TLV is truncated")
+		}
+		if err := fn(b[0], b[3:3+length]); err != nil {
+			return err
+		}
+		b = b[3+length:]
+	}
+	return nil
+}
+
+// parseProxyTLVs adds the TLVs of a v2 header to its details
+func parseProxyTLVs(b []byte, details *types.ProxyProtocolDetails) error {
+	return walkProxyTLVs(b, func(typ byte, value []byte) error {
+		details.TLVs = append(details.TLVs, types.ProxyProtocolTLV{Type: int(typ), Value: hex.EncodeToString(value)})
+		switch typ {
+		case proxyTLVALPN:
+			details.ALPN = string(value)
+		case proxyTLVAuthority:
+			details.Authority = string(value)
+		case proxyTLVUniqueID:
+			details.UniqueID = hex.EncodeToString(value)
+		case proxyTLVSSL:
+			ssl, err := parseProxySSL(value)
+			if err != nil {
+				return err
+			}
+			details.SSL = ssl
+		}
+		return nil
+	})
+}
+
+// parseProxySSL parses the SSL TLV, which describes the TLS connection
+// between the client and the balancer
+func parseProxySSL(b []byte) (*types.ProxyProtocolSSL, error) {
+	if len(b) < 5 {
+		return nil, errors.New("v2 SSL TLV is truncated")
+	}
+	ssl := &types.ProxyProtocolSSL{
+		Client:   int(b[0]),
+		Verified: binary.BigEndian.Uint32(b[1:5]) == 0,
+	}
+	err := walkProxyTLVs(b[5:], func(typ byte, value []byte) error {
+		switch typ {
+		case proxyTLVSSLVer:
+			ssl.Version = string(value)
+		case proxyTLVSSLCN:
+			ssl.CN = string(value)
+		case proxyTLVSSLCipher:
+			ssl.Cipher = string(value)
+		case proxyTLVSSLSigAlg:
+			ssl.SigAlg = string(value)
+		case proxyTLVSSLKeyAlg:
+			ssl.KeyAlg = string(value)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ssl, nil
+}
+
+// getProxyProtocol returns the PROXY header a client's connection came with,
+// nil if there was none
+func (srv *Server) getProxyProtocol(addr string) *types.ProxyProtocolDetails {
+	v, ok := srv.GetProxyProtocolHeaders().Load(addr)
+	if !ok {
+		return nil
+	}
+	return v.(*types.ProxyProtocolDetails)
+}
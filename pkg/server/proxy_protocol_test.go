@@ -0,0 +1,299 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+const proxyV2Sig = "\r\n\r\n\x00\r\nQUIT\n"
+
+// v2TCP4 is a PROXY TCP4 header from 192.0.2.1:56324 to 198.51.100.1:443 with
+// the ALPN, authority, unique ID and SSL TLVs
+const v2TCP4 = proxyV2Sig + "\x21\x11\x00\x58" +
+	"\xc0\x00\x02\x01" + "\xc6\x33\x64\x01" + "\xdc\x04" + "\x01\xbb" +
+	"\x01\x00\x02h2" +
+	"\x02\x00\x0bexample.com" +
+	"\x05\x00\x04\xde\xad\xbe\xef" +
+	"\x20\x00\x2f" + "\x01" + "\x00\x00\x00\x00" +
+	"\x21\x00\x07TLSv1.3" +
+	"\x22\x00\x04test" +
+	"\x23\x00\x16TLS_AES_128_GCM_SHA256"
+
+// v2TCP6 is a PROXY TCP6 header from [2001:db8::1]:56324 to [2001:db8::2]:443
+const v2TCP6 = proxyV2Sig + "\x21\x21\x00\x24" +
+	"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+	"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02" +
+	"\xdc\x04" + "\x01\xbb"
+
+// v2Local is a LOCAL header, its body is ignored
+const v2Local = proxyV2Sig + "\x20\x00\x00\x04" + "\x00\x00\x00\x00"
+
+// readProxyHeaderFrom feeds data to readProxyHeader over a pipe, followed by
+// a payload that must be passed through
+func readProxyHeaderFrom(t *testing.T, srv *Server, data string) (*proxyConn, error) {
+	t.Helper()
+	client, conn := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		conn.Close()
+	})
+	go func() {
+		client.Write([]byte(data))
+		client.Close()
+	}()
+	return srv.readProxyHeader(conn)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   string
+		remote string
+		header *types.ProxyProtocolDetails
+	}{
+		{
+			name:   "v1 TCP4",
+			data:   "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n",
+			remote: "192.0.2.1:56324",
+			header: &types.ProxyProtocolDetails{Version: 1, Protocol: "TCP4", SourceAddr: "192.0.2.1:56324", DestinationAddr: "198.51.100.1:443"},
+		},
+		{
+			name:   "v1 TCP6",
+			data:   "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n",
+			remote: "[2001:db8::1]:56324",
+			header: &types.ProxyProtocolDetails{Version: 1, Protocol: "TCP6", SourceAddr: "[2001:db8::1]:56324", DestinationAddr: "[2001:db8::2]:443"},
+		},
+		{
+			name:   "v1 UNKNOWN",
+			data:   "PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n",
+			remote: "pipe",
+			header: &types.ProxyProtocolDetails{Version: 1, Protocol: "UNKNOWN"},
+		},
+		{
+			name:   "v2 TCP4 with TLVs",
+			data:   v2TCP4,
+			remote: "192.0.2.1:56324",
+			header: &types.ProxyProtocolDetails{
+				Version:         2,
+				Protocol:        "TCP4",
+				SourceAddr:      "192.0.2.1:56324",
+				DestinationAddr: "198.51.100.1:443",
+				ALPN:            "h2",
+				Authority:       "example.com",
+				UniqueID:        "deadbeef",
+				SSL: &types.ProxyProtocolSSL{
+					Client:   1,
+					Verified: true,
+					Version:  "TLSv1.3",
+					CN:       "test",
+					Cipher:   "TLS_AES_128_GCM_SHA256",
+				},
+			},
+		},
+		{
+			name:   "v2 TCP6",
+			data:   v2TCP6,
+			remote: "[2001:db8::1]:56324",
+			header: &types.ProxyProtocolDetails{Version: 2, Protocol: "TCP6", SourceAddr: "[2001:db8::1]:56324", DestinationAddr: "[2001:db8::2]:443"},
+		},
+		{
+			name:   "v2 LOCAL",
+			data:   v2Local,
+			remote: "pipe",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := NewServer()
+			c, err := readProxyHeaderFrom(t, srv, tt.data+"payload")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := c.RemoteAddr().String(); got != tt.remote {
+				t.Errorf("remote address = %s, want %s", got, tt.remote)
+			}
+			if rest, _ := io.ReadAll(c); string(rest) != "payload" {
+				t.Errorf("read after the header: %q", rest)
+			}
+
+			stored := srv.getProxyProtocol(c.RemoteAddr().String())
+			if tt.header == nil {
+				if c.header != nil || stored != nil {
+					t.Errorf("header recorded for LOCAL: %+v", c.header)
+				}
+				return
+			}
+			if stored != c.header {
+				t.Error("header was not stored by the client address")
+			}
+			got := *c.header
+			got.TLVs, got.ProxyAddr = nil, ""
+			if !reflect.DeepEqual(got, *tt.header) {
+				t.Errorf("header = %+v, want %+v", got, *tt.header)
+			}
+			if c.header.ProxyAddr != "pipe" {
+				t.Errorf("proxy address = %q", c.header.ProxyAddr)
+			}
+
+			c.Close()
+			if srv.getProxyProtocol(c.RemoteAddr().String()) != nil {
+				t.Error("header kept after closing the connection")
+			}
+		})
+	}
+}
+
+func TestReadProxyHeaderTLVs(t *testing.T) {
+	c, err := readProxyHeaderFrom(t, NewServer(), v2TCP4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []types.ProxyProtocolTLV{
+		{Type: proxyTLVALPN, Value: "6832"},
+		{Type: proxyTLVAuthority, Value: "6578616d706c652e636f6d"},
+		{Type: proxyTLVUniqueID, Value: "deadbeef"},
+	}
+	tlvs := c.header.TLVs
+	if len(tlvs) != 4 || tlvs[3].Type != proxyTLVSSL {
+		t.Fatalf("TLVs = %+v", tlvs)
+	}
+	for i, tlv := range want {
+		if tlvs[i] != tlv {
+			t.Errorf("TLV %d = %+v, want %+v", i, tlvs[i], tlv)
+		}
+	}
+}
+
+func TestReadProxyHeaderErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{name: "empty", data: ""},
+		{name: "no header", data: "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"},
+		{name: "TLS without header", data: "\x16\x03\x01\x02\x00\x01\x00\x01\xfc\x03\x03"},
+		{name: "v1 without CRLF", data: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n"},
+		{name: "v1 truncated", data: "PROXY TCP4 192.0.2.1 198.51.100.1"},
+		{name: "v1 too long", data: "PROXY TCP6 " + strings.Repeat("f", 100) + " ::1 1 2\r\n"},
+		{name: "v1 no protocol", data: "PROXY \r\n"},
+		{name: "v1 unknown protocol", data: "PROXY UDP4 192.0.2.1 198.51.100.1 56324 443\r\n"},
+		{name: "v1 missing port", data: "PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n"},
+		{name: "v1 bad address", data: "PROXY TCP4 192.0.2 198.51.100.1 56324 443\r\n"},
+		{name: "v1 bad port", data: "PROXY TCP4 192.0.2.1 198.51.100.1 65536 443\r\n"},
+		{name: "v2 bad signature", data: "\r\n\r\n\x00\r\nQUIX\n\x21\x11\x00\x00"},
+		{name: "v2 version 1", data: proxyV2Sig + "\x11\x11\x00\x00"},
+		{name: "v2 unknown command", data: proxyV2Sig + "\x22\x11\x00\x00"},
+		{name: "v2 truncated signature", data: proxyV2Sig[:8]},
+		{name: "v2 truncated body", data: v2TCP4[:40]},
+		{name: "v2 length past the data", data: proxyV2Sig + "\x21\x11\xff\xff" + v2TCP4[16:]},
+		{name: "v2 addresses truncated", data: proxyV2Sig + "\x21\x21\x00\x0c" + v2TCP4[16:28]},
+		{name: "v2 TLV header truncated", data: proxyV2Sig + "\x21\x11\x00\x0e" + v2TCP4[16:28] + "\x01\x00"},
+		{name: "v2 TLV length past the body", data: proxyV2Sig + "\x21\x11\x00\x10" + v2TCP4[16:28] + "\x01\x00\x05h"},
+		{name: "v2 SSL TLV truncated", data: proxyV2Sig + "\x21\x11\x00\x12" + v2TCP4[16:28] + "\x20\x00\x03\x01\x00\x00"},
+		{
+			name: "v2 SSL sub-TLV length past the SSL TLV",
+			data: proxyV2Sig + "\x21\x11\x00\x17" + v2TCP4[16:28] + "\x20\x00\x08\x01\x00\x00\x00\x00\x21\x00\x07",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := NewServer()
+			if _, err := readProxyHeaderFrom(t, srv, tt.data); err == nil {
+				t.Fatal("no error")
+			}
+			stored := 0
+			srv.GetProxyProtocolHeaders().Range(func(_, _ any) bool {
+				stored++
+				return true
+			})
+			if stored != 0 {
+				t.Errorf("%d headers stored for an invalid header", stored)
+			}
+		})
+	}
+}
+
+// Every truncation of a valid header must fail cleanly
+func TestReadProxyHeaderTruncated(t *testing.T) {
+	headers := map[string]string{
+		"v1":      "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n",
+		"v2 TCP4": v2TCP4,
+		"v2 TCP6": v2TCP6,
+	}
+	for name, header := range headers {
+		for i := range len(header) {
+			if _, err := readProxyHeaderFrom(t, NewServer(), header[:i]); err == nil {
+				t.Errorf("%s truncated to %d bytes: no error", name, i)
+			}
+		}
+	}
+}
+
+func TestAcceptProxyProtocol(t *testing.T) {
+	srv := NewServer()
+	srv.GetConfig().ProxyProtocolTrusted = []string{"127.0.0.1"}
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := srv.AcceptProxyProtocol(inner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dial := func(data string) net.Conn {
+		conn, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	// A trusted source without a header is closed, not taken for the client
+	direct := dial("GET / HTTP/1.1\r\n\r\n")
+	defer direct.Close()
+	if err := direct.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := direct.Read(make([]byte, 1)); err == nil {
+		t.Error("connection without a header was not closed")
+	}
+
+	proxied := dial("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n")
+	defer proxied.Close()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := conn.RemoteAddr().String(); got != "192.0.2.1:56324" {
+		t.Errorf("remote address = %s", got)
+	}
+	conn.Close()
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept after Close = %v, want %v", err, net.ErrClosed)
+	}
+}
+
+func TestAcceptProxyProtocolInvalidSource(t *testing.T) {
+	srv := NewServer()
+	srv.GetConfig().ProxyProtocolTrusted = []string{"10.0.0.0/33"}
+	if _, err := srv.AcceptProxyProtocol(nil); err == nil {
+		t.Error("no error for an invalid CIDR")
+	}
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"strings"
+	"time"
+
+	trackmehttp "github.com/pagpeter/trackme/pkg/http"
+	trackmequic "github.com/pagpeter/trackme/pkg/quic"
+)
+
+const (
+	// Only this much of every client stream is reassembled
+	quicMaxStreamData = 64 * 1024
+	// How many connections the secrets are kept for at most
+	quicMaxSecrets = 10000
+	// Secrets are dropped after this long, so later requests on a connection
+	// don't report HTTP/3 frames anymore
+	quicSecretTTL = 10 * time.Minute
+)
+
+// quicSecrets are the client's TLS traffic secrets of an HTTP/3 connection
+type quicSecrets struct {
+	early   []byte
+	traffic []byte
+}
+
+// newQUICSecretStore creates the store of the client traffic secrets
+func newQUICSecretStore() *FingerprintStore[quicSecrets] {
+	store := NewFingerprintStore[quicSecrets]()
+	store.SetLimits(quicMaxSecrets, quicSecretTTL)
+	return store
+}
+
+// quicKeyLog is the KeyLogWriter of the HTTP/3 server. It keeps the client's
+// traffic secrets, so the 0-RTT and 1-RTT packets of the client can be
+// decrypted to read the HTTP/3 frames quic-go consumes itself.
+type quicKeyLog struct {
+	srv *Server
+}
+
+// QUICKeyLog returns the writer to use as tls.Config.KeyLogWriter of the HTTP/3 server
+func (srv *Server) QUICKeyLog() io.Writer {
+	return quicKeyLog{srv: srv}
+}
+
+// Write receives a line of the NSS key log format: label, client random and secret
+func (l quicKeyLog) Write(line []byte) (int, error) {
+	fields := strings.Fields(string(line))
+	if len(fields) != 3 {
+		return len(line), nil
+	}
+	secret, err := hex.DecodeString(fields[2])
+	if err != nil {
+		return len(line), nil
+	}
+	if fields[0] != "CLIENT_EARLY_TRAFFIC_SECRET" && fields[0] != "CLIENT_TRAFFIC_SECRET_0" {
+		return len(line), nil
+	}
+	store := l.srv.GetQUICSecrets()
+	store.LoadOrStore(fields[1], quicSecrets{})
+	store.Update(fields[1], func(s *quicSecrets) bool {
+		if fields[0] == "CLIENT_EARLY_TRAFFIC_SECRET" {
+			s.early = secret
+		} else {
+			s.traffic = secret
+		}
+		return true
+	})
+	return len(line), nil
+}
+
+// addProtected keeps a copy of a 0-RTT or 1-RTT packet of the client
+func (f *quicInitialFlight) addProtected(packet []byte) {
+	if len(f.protected) < quicMaxPackets {
+		f.protected = append(f.protected, bytes.Clone(packet))
+	}
+}
+
+// recordQUICShortHeader keeps a 1-RTT packet of a client whose Initial flight was recorded
+func (srv *Server) recordQUICShortHeader(addr string, data []byte) {
+	v, ok := srv.GetQUICInitials().Load(addr)
+	if !ok {
+		return
+	}
+	f := v.(*quicInitialFlight)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.addProtected(data)
+}
+
+// readHTTP3Streams decrypts the 0-RTT and 1-RTT packets recorded from a
+// client and reads the HTTP/3 frames of the streams it opened. It returns nil
+// if the packets can't be decrypted. Packets sent after a key update are
+// skipped, as are streams longer than what was recorded.
+func (srv *Server) readHTTP3Streams(addr string, clientHello []byte, cipherSuite uint16) map[int64]trackmehttp.HTTP3Stream {
+	// The client random follows the handshake header and the legacy version
+	if len(clientHello) < 38 {
+		return nil
+	}
+	secrets, ok := srv.GetQUICSecrets().Lookup(hex.EncodeToString(clientHello[6:38]), 0)
+	if !ok || secrets.traffic == nil {
+		return nil
+	}
+	v, ok := srv.GetQUICInitials().Load(addr)
+	if !ok {
+		return nil
+	}
+	f := v.(*quicInitialFlight)
+	f.mu.Lock()
+	version, cidLen, packets := f.version, f.serverCIDLen, f.protected
+	f.mu.Unlock()
+	if cidLen == 0 {
+		return nil
+	}
+
+	keys, err := trackmequic.NewKeys(version, cipherSuite, secrets.traffic)
+	if err != nil {
+		return nil
+	}
+	var earlyKeys *trackmequic.Keys
+	if secrets.early != nil {
+		earlyKeys, _ = trackmequic.NewKeys(version, cipherSuite, secrets.early)
+	}
+
+	// 0-RTT and 1-RTT packets share the application data packet number space
+	streams := trackmequic.NewStreams(quicMaxStreamData)
+	largest := int64(-1)
+	for _, raw := range packets {
+		var pn uint64
+		var payload []byte
+		if raw[0]&0x80 != 0 {
+			long, _, err := trackmequic.ParseDatagram(raw)
+			if err != nil || len(long) == 0 || earlyKeys == nil {
+				continue
+			}
+			pn, payload, err = earlyKeys.DecryptLongHeader(long[0], largest)
+			if err != nil {
+				continue
+			}
+		} else if pn, payload, err = keys.DecryptShortHeader(raw, cidLen, largest); err != nil {
+			continue
+		}
+		largest = max(largest, int64(pn))
+		frames, _ := trackmequic.ParseStreamFrames(payload)
+		for _, frame := range frames {
+			// Only the streams opened by the client, which have the lowest bit unset
+			if frame.StreamID&0x1 == 0 {
+				streams.Add(frame)
+			}
+		}
+	}
+
+	parsed := map[int64]trackmehttp.HTTP3Stream{}
+	for _, id := range streams.IDs() {
+		data, _ := streams.Data(id)
+		parsed[int64(id)] = trackmehttp.ParseHTTP3Stream(data, id&0x2 != 0)
+	}
+	return parsed
+}
@@ -0,0 +1,327 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	trackmequic "github.com/pagpeter/trackme/pkg/quic"
+	"github.com/pagpeter/trackme/pkg/types"
+	"github.com/pagpeter/trackme/pkg/utils"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	// Only this many datagrams of an Initial flight are recorded
+	quicInitialMaxDatagrams = 16
+	// Flights that didn't turn into a connection are dropped after this long
+	quicInitialTimeout = 10 * time.Second
+)
+
+// quicInitialFlight is the Initial flight of a client, identified by its address
+type quicInitialFlight struct {
+	mu        sync.Mutex
+	start     time.Time
+	keyDCID   []byte
+	token     []byte
+	version   uint32
+	probe     *quicProbeEvents
+	datagrams []types.QUICInitialDatagram
+	connected bool
+	// serverCIDLen is the length of the connection IDs the server chose,
+	// learned from the client's Handshake packets
+	serverCIDLen int
+	// protected are the client's 0-RTT and 1-RTT packets, still encrypted
+	protected [][]byte
+}
+
+// initialRecordingConn records the Initial flights of QUIC clients before
+// passing the datagrams on to quic-go. The UDP socket is embedded, so quic-go
+// still finds the methods it needs for ECN and GSO, and ReadBatch keeps the
+// batched reads while recording every datagram of the batch.
+type initialRecordingConn struct {
+	*net.UDPConn
+	batch *ipv4.PacketConn
+	srv   *Server
+}
+
+// RecordQUICInitials wraps the UDP socket of the HTTP/3 server, so the
+// client's Initial packets can be inspected before they are processed
+func (srv *Server) RecordQUICInitials(conn *net.UDPConn) net.PacketConn {
+	return &initialRecordingConn{UDPConn: conn, batch: ipv4.NewPacketConn(conn), srv: srv}
+}
+
+func (c *initialRecordingConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.UDPConn.ReadFrom(p)
+	if err == nil {
+		c.record(addr, p[:n])
+	}
+	return n, addr, err
+}
+
+func (c *initialRecordingConn) ReadMsgUDP(b, oob []byte) (int, int, int, *net.UDPAddr, error) {
+	n, oobn, flags, addr, err := c.UDPConn.ReadMsgUDP(b, oob)
+	if err == nil {
+		c.record(addr, b[:n])
+	}
+	return n, oobn, flags, addr, err
+}
+
+// ReadBatch is used by quic-go instead of ReadMsgUDP where the platform supports it
+func (c *initialRecordingConn) ReadBatch(ms []ipv4.Message, flags int) (int, error) {
+	n, err := c.batch.ReadBatch(ms, flags)
+	for _, m := range ms[:n] {
+		if len(m.Buffers) > 0 && m.Addr != nil {
+			c.record(m.Addr, m.Buffers[0][:m.N])
+		}
+	}
+	return n, err
+}
+
+func (c *initialRecordingConn) record(addr net.Addr, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	if data[0]&0x80 != 0 {
+		c.srv.recordQUICDatagram(addr.String(), data)
+	} else {
+		c.srv.recordQUICShortHeader(addr.String(), data)
+	}
+}
+
+// recordQUICDatagram adds a datagram with long header packets to the client's Initial flight
+func (srv *Server) recordQUICDatagram(addr string, data []byte) {
+	packets, trailing, err := trackmequic.ParseDatagram(data)
+	if len(packets) == 0 || err == trackmequic.ErrUnsupportedVersion {
+		return
+	}
+
+	var flight *quicInitialFlight
+	if v, ok := srv.GetQUICInitials().Load(addr); ok {
+		flight = v.(*quicInitialFlight)
+	}
+	if flight == nil || !flight.decrypts(packets) {
+		first := slices.IndexFunc(packets, func(p trackmequic.LongHeaderPacket) bool {
+			return p.Type == "initial"
+		})
+		if first == -1 {
+			return
+		}
+		// A new connection, or the client started over after a Retry
+		previous := flight
+		flight = &quicInitialFlight{
+			start:   time.Now(),
+			keyDCID: bytes.Clone(packets[first].DCID),
+			token:   bytes.Clone(packets[first].Token),
+			version: packets[first].Version,
+			probe:   &quicProbeEvents{firstVersion: packets[first].Version},
+		}
+		if previous != nil {
+			flight.probe = previous.probe
+		}
+		srv.GetQUICInitials().Store(addr, flight)
+		time.AfterFunc(quicInitialTimeout, func() {
+			if !flight.isConnected() {
+				srv.GetQUICInitials().CompareAndDelete(addr, flight)
+			}
+		})
+	}
+	flight.add(packets, len(data), data[len(data)-trailing:])
+}
+
+// decrypts checks if the first Initial packet of a datagram belongs to the flight
+func (f *quicInitialFlight) decrypts(packets []trackmequic.LongHeaderPacket) bool {
+	for _, p := range packets {
+		if p.Type == "initial" {
+			_, _, err := trackmequic.DecryptInitial(p, f.keyDCID)
+			return err == nil
+		}
+	}
+	return true
+}
+
+func (f *quicInitialFlight) add(packets []trackmequic.LongHeaderPacket, size int, rest []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, p := range packets {
+		switch p.Type {
+		case "handshake":
+			f.serverCIDLen = len(p.DCID)
+		case "0-rtt":
+			f.addProtected(p.Raw)
+		}
+	}
+	if len(rest) > 0 && rest[0]&0xc0 == 0x40 {
+		f.addProtected(rest)
+	}
+	if len(f.datagrams) >= quicInitialMaxDatagrams {
+		return
+	}
+
+	datagram := types.QUICInitialDatagram{
+		Size:            size,
+		ReceivedAfterMs: msSince(f.start),
+	}
+	for _, p := range packets {
+		packet := types.QUICInitialPacket{
+			Type:        p.Type,
+			Size:        len(p.Raw),
+			DCIDLength:  len(p.DCID),
+			SCIDLength:  len(p.SCID),
+			TokenLength: len(p.Token),
+		}
+		if p.Type == "initial" {
+			if pn, payload, err := trackmequic.DecryptInitial(p, f.keyDCID); err == nil {
+				packet.PacketNumber = pn
+				packet.Frames = trackmequic.ParseFrames(payload)
+			}
+		}
+		datagram.Packets = append(datagram.Packets, packet)
+	}
+	if len(rest) > 0 && rest[0]&0xc0 == 0x40 {
+		// A short header packet can only be the last one in a datagram
+		datagram.Packets = append(datagram.Packets, types.QUICInitialPacket{Type: "1-rtt", Size: len(rest)})
+	} else {
+		datagram.TrailingBytes = len(rest)
+	}
+	f.datagrams = append(f.datagrams, datagram)
+}
+
+func (f *quicInitialFlight) setConnected() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.connected = true
+}
+
+func (f *quicInitialFlight) isConnected() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.connected
+}
+
+// getQUICInitial returns the Initial flight of a client with its fingerprint
+func (srv *Server) getQUICInitial(addr string) *types.QUICInitial {
+	v, ok := srv.GetQUICInitials().Load(addr)
+	if !ok {
+		return nil
+	}
+	f := v.(*quicInitialFlight)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.datagrams) == 0 {
+		return nil
+	}
+
+	initial := &types.QUICInitial{
+		FirstDatagramLen: f.datagrams[0].Size,
+		CryptoOrder:      "sequential",
+		Datagrams:        slices.Clone(f.datagrams),
+	}
+	var cryptoEnd int64
+	seenFirst := false
+	for _, d := range f.datagrams {
+		if len(d.Packets) > 1 && slices.ContainsFunc(d.Packets, func(p types.QUICInitialPacket) bool {
+			return p.Type == "initial"
+		}) {
+			initial.Coalesced = true
+		}
+		for _, p := range d.Packets {
+			if p.Type != "initial" {
+				continue
+			}
+			if !seenFirst {
+				seenFirst = true
+				initial.DCIDLength = p.DCIDLength
+				initial.SCIDLength = p.SCIDLength
+				initial.TokenLength = p.TokenLength
+			}
+			hasCrypto := false
+			for _, frame := range p.Frames {
+				name, details, _ := strings.Cut(frame, " ")
+				if !slices.Contains(initial.FrameTypes, name) {
+					initial.FrameTypes = append(initial.FrameTypes, name)
+				}
+				if name != "CRYPTO" {
+					continue
+				}
+				hasCrypto = true
+				if offset, length, ok := parseCryptoFrame(details); ok {
+					if offset != cryptoEnd {
+						initial.CryptoOrder = "reordered"
+					}
+					cryptoEnd = max(cryptoEnd, offset+length)
+				}
+			}
+			if hasCrypto {
+				initial.CryptoPackets++
+			}
+		}
+	}
+	slices.Sort(initial.FrameTypes)
+	initial.Version = quicVersionName(f.version)
+
+	coalesced := 0
+	if initial.Coalesced {
+		coalesced = 1
+	}
+	token := 0
+	if initial.TokenLength > 0 {
+		token = 1
+	}
+	initial.Fingerprint = fmt.Sprintf("%s|%d|%d|%d|%d|%d|%s|%s|%d",
+		initial.Version,
+		initial.DCIDLength,
+		initial.SCIDLength,
+		token,
+		initial.FirstDatagramLen,
+		initial.CryptoPackets,
+		initial.CryptoOrder,
+		strings.Join(initial.FrameTypes, ","),
+		coalesced,
+	)
+	initial.FingerprintHash = utils.GetMD5Hash(initial.Fingerprint)
+	return initial
+}
+
+// quicVersionName returns a short name for a QUIC version
+func quicVersionName(version uint32) string {
+	switch version {
+	case trackmequic.Version1:
+		return "v1"
+	case trackmequic.Version2:
+		return "v2"
+	}
+	return fmt.Sprintf("0x%08x", version)
+}
+
+// parseCryptoFrame reads the offset and length of a CRYPTO frame entry
+func parseCryptoFrame(details string) (int64, int64, bool) {
+	var offset, length int64
+	if _, err := fmt.Sscanf(details, "(offset=%d, length=%d)", &offset, &length); err != nil {
+		return 0, 0, false
+	}
+	return offset, length, true
+}
+
+// cryptoLength returns how many bytes of CRYPTO data the client sent in its Initial packets
+func (f *quicInitialFlight) cryptoLength() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var end int64
+	for _, d := range f.datagrams {
+		for _, p := range d.Packets {
+			for _, frame := range p.Frames {
+				if name, details, _ := strings.Cut(frame, " "); name == "CRYPTO" {
+					if offset, length, ok := parseCryptoFrame(details); ok {
+						end = max(end, offset+length)
+					}
+				}
+			}
+		}
+	}
+	return end
+}
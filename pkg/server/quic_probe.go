@@ -0,0 +1,169 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/pagpeter/quic-go"
+	"github.com/pagpeter/quic-go/logging"
+	trackmequic "github.com/pagpeter/trackme/pkg/quic"
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+// Modes of the additional HTTP/3 servers that probe clients
+const (
+	QUICProbeRetry              = "retry"
+	QUICProbeVersionNegotiation = "version_negotiation"
+	QUICProbeHelloRetryRequest  = "hello_retry_request"
+)
+
+// quicProbeEvents is what the server sent to probe a client before it
+// started over with a new Initial flight
+type quicProbeEvents struct {
+	mu           sync.Mutex
+	firstVersion uint32
+	retrySentAt  time.Time
+	retryToken   []byte
+	retrySCID    []byte
+	vnSentAt     time.Time
+	vnVersions   []uint32
+}
+
+// ConfigureQUICProbe changes the configuration of an HTTP/3 server so it probes its clients:
+//   - retry: every new connection has to validate its address with a Retry
+//   - version_negotiation: only QUIC v2 is accepted, so v1 clients get a Version Negotiation packet
+//   - hello_retry_request: only P-256 is accepted for the key exchange, so most clients get a HelloRetryRequest
+func ConfigureQUICProbe(probe string, tr *quic.Transport, conf *quic.Config, tlsConf *tls.Config) {
+	switch probe {
+	case QUICProbeRetry:
+		tr.VerifySourceAddress = func(net.Addr) bool { return true }
+	case QUICProbeVersionNegotiation:
+		conf.Versions = []quic.Version{quic.Version2}
+	case QUICProbeHelloRetryRequest:
+		tlsConf.CurvePreferences = []tls.CurveID{tls.CurveP256}
+	}
+}
+
+// NewQUICTransportTracer records the Retry and Version Negotiation packets
+// sent to clients, which happens before a connection is created
+func (srv *Server) NewQUICTransportTracer() *logging.Tracer {
+	return &logging.Tracer{
+		SentPacket: func(dest net.Addr, hdr *logging.Header, _ logging.ByteCount, _ []logging.Frame) {
+			if hdr.Type.String() != "Retry" {
+				return
+			}
+			// A Retry is sent for every Initial packet, but clients only use the first one
+			if ev := srv.getQUICProbeEvents(dest.String()); ev != nil {
+				ev.mu.Lock()
+				defer ev.mu.Unlock()
+				if !ev.retrySentAt.IsZero() {
+					return
+				}
+				ev.retrySentAt = time.Now()
+				ev.retryToken = bytes.Clone(hdr.Token)
+				ev.retrySCID = bytes.Clone(hdr.SrcConnectionID.Bytes())
+			}
+		},
+		SentVersionNegotiationPacket: func(dest net.Addr, _, _ logging.ArbitraryLenConnectionID, versions []logging.Version) {
+			if ev := srv.getQUICProbeEvents(dest.String()); ev != nil {
+				ev.mu.Lock()
+				defer ev.mu.Unlock()
+				if !ev.vnSentAt.IsZero() {
+					return
+				}
+				ev.vnSentAt = time.Now()
+				for _, v := range versions {
+					ev.vnVersions = append(ev.vnVersions, uint32(v))
+				}
+			}
+		},
+	}
+}
+
+func (srv *Server) getQUICProbeEvents(addr string) *quicProbeEvents {
+	v, ok := srv.GetQUICInitials().Load(addr)
+	if !ok {
+		return nil
+	}
+	return v.(*quicInitialFlight).probe
+}
+
+// getQUICProbe returns how a client reacted to the probe of the server it connected to
+func (srv *Server) getQUICProbe(probe, addr string, clientHello []byte) *types.QUICProbe {
+	if probe == "" {
+		return nil
+	}
+	result := &types.QUICProbe{Mode: probe}
+	v, ok := srv.GetQUICInitials().Load(addr)
+	if !ok {
+		return result
+	}
+	flight := v.(*quicInitialFlight)
+	flight.mu.Lock()
+	start, keyDCID, token, version := flight.start, flight.keyDCID, flight.token, flight.version
+	flight.mu.Unlock()
+
+	ev := flight.probe
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+
+	switch probe {
+	case QUICProbeRetry:
+		result.Retry = &types.QUICRetryProbe{
+			RetrySent:   !ev.retrySentAt.IsZero(),
+			TokenLength: len(token),
+		}
+		if result.Retry.RetrySent {
+			result.Retry.TokenEchoed = bytes.Equal(token, ev.retryToken)
+			result.Retry.DCIDFromRetry = bytes.Equal(keyDCID, ev.retrySCID)
+			result.Retry.RetryLatencyMs = float64(start.Sub(ev.retrySentAt).Microseconds()) / 1000
+		}
+	case QUICProbeVersionNegotiation:
+		vn := &types.QUICVersionProbe{
+			VersionNegotiationSent: !ev.vnSentAt.IsZero(),
+			OfferedVersion:         quicVersionName(ev.firstVersion),
+			ChosenVersion:          quicVersionName(version),
+		}
+		for _, v := range ev.vnVersions {
+			vn.ServerVersions = append(vn.ServerVersions, quicVersionName(v))
+		}
+		_, available, err := trackmequic.VersionInformation(clientHello)
+		if err == nil {
+			for _, v := range available {
+				vn.ClientVersions = append(vn.ClientVersions, quicVersionName(v))
+			}
+		}
+		if vn.VersionNegotiationSent {
+			vn.ValidChoice = slices.Contains(ev.vnVersions, version) && (len(available) == 0 || slices.Contains(available, version))
+			vn.RetryLatencyMs = float64(start.Sub(ev.vnSentAt).Microseconds()) / 1000
+		}
+		result.VersionNegotiation = vn
+	case QUICProbeHelloRetryRequest:
+		hrr := &types.QUICHelloRetryProbe{
+			SelectedGroup:        tls.CurveP256.String(),
+			FirstClientHelloSize: len(clientHello),
+		}
+		groups, _ := trackmequic.KeyShareGroups(clientHello)
+		for _, g := range groups {
+			hrr.KeyShareGroups = append(hrr.KeyShareGroups, getGroupName(g))
+		}
+		hrr.HelloRetryRequest = len(clientHello) > 0 && !slices.Contains(groups, uint16(tls.CurveP256))
+		if hrr.HelloRetryRequest {
+			hrr.SecondClientHelloSize = int(flight.cryptoLength()) - len(clientHello)
+		}
+		result.HelloRetryRequest = hrr
+	}
+	return result
+}
+
+// getGroupName returns the name of a TLS key exchange group
+func getGroupName(group uint16) string {
+	if group&0x0f0f == 0x0a0a && group>>8 == group&0xff {
+		return "GREASE"
+	}
+	return tls.CurveID(group).String()
+}
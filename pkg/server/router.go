@@ -23,8 +23,13 @@ func cleanIP(ip string) string {
 
 // Router returns bytes, content type, and error that should be sent to the client
 func Router(path string, res types.Response, srv *Server) ([]byte, string, error) {
-	if v, ok := srv.GetTCPFingerprints().Load(res.IP); ok {
-		res.TCPIP = v.(types.TCPIPDetails)
+	// HTTP/3 requests get the details of their UDP datagrams in HandleHTTP3
+	if res.HTTPVersion != "h3" {
+		if tcpip, ok := srv.GetTCPFingerprints().Lookup(res.IP, srv.getTCPFingerprintWait(res.IP)); ok {
+			res.TCPIP = tcpip
+		}
+		res.TCPIP.TCPInfo = srv.getTCPInfoDetails(res.IP)
+		res.ProxyProtocol = srv.getProxyProtocol(res.IP)
 	}
 	res.Donate = "Please consider donating to keep this API running. Visit https://tls.peet.ws"
 	if res.TLS != nil {
@@ -52,7 +57,11 @@ func Router(path string, res types.Response, srv *Server) ([]byte, string, error
 		}
 	}
 
-	paths := getAllPaths()
+	if token := m[plainHTTPTokenParam]; len(token) > 0 {
+		srv.linkPlainHTTPRequest(&res, token[0])
+	}
+
+	paths := getAllPaths(srv)
 	if u != nil {
 		if val, ok := paths[u.Path]; ok {
 			return val(res, m)
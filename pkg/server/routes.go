@@ -4,7 +4,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/url"
+	"sort"
 	"strings"
 
 	"github.com/pagpeter/trackme/pkg/types"
@@ -29,6 +31,7 @@ func staticFile(file string) RouteHandler {
 }
 
 func apiAll(res types.Response, _ url.Values) ([]byte, string, error) {
+	res.ProxyLikelihood = getProxyLikelihood(res)
 	return []byte(res.ToJson()), "application/json", nil
 }
 
@@ -38,10 +41,11 @@ func apiTLS(res types.Response, _ url.Values) ([]byte, string, error) {
 	}.ToJson()), "application/json", nil
 }
 
-func apiClean(res types.Response, _ url.Values) ([]byte, string, error) {
+// getSmallResponse collects the fingerprints of a request
+func getSmallResponse(res types.Response) types.SmallResponse {
 	akamai := "-"
 	hash := "-"
-	if res.HTTPVersion == "h2" && res.Http2 != nil {
+	if (res.HTTPVersion == "h2" || res.HTTPVersion == "h2c") && res.Http2 != nil {
 		akamai = res.Http2.AkamaiFingerprint
 		hash = utils.GetMD5Hash(res.Http2.AkamaiFingerprint)
 	} else if res.HTTPVersion == "h3" && res.Http3 != nil {
@@ -55,6 +59,11 @@ func apiClean(res types.Response, _ url.Values) ([]byte, string, error) {
 		HTTPVersion: res.HTTPVersion,
 	}
 
+	if res.TCPIP.OS != nil {
+		smallRes.OS = res.TCPIP.OS.Label
+		smallRes.OSMatchQuality = res.TCPIP.OS.Quality
+	}
+
 	if res.TLS != nil {
 		smallRes.JA3 = res.TLS.JA3
 		smallRes.JA3Hash = res.TLS.JA3Hash
@@ -64,7 +73,24 @@ func apiClean(res types.Response, _ url.Values) ([]byte, string, error) {
 		smallRes.PeetPrintHash = res.TLS.PeetPrintHash
 	}
 
-	return []byte(smallRes.ToJson()), "application/json", nil
+	return smallRes
+}
+
+func apiClean(res types.Response, _ url.Values) ([]byte, string, error) {
+	return []byte(getSmallResponse(res).ToJson()), "application/json", nil
+}
+
+func apiEcho(res types.Response, _ url.Values) ([]byte, string, error) {
+	body := res.Body
+	if body == nil {
+		body = newRequestBody(nil, "", "none", nil)
+	}
+	return []byte(types.EchoResponse{
+		Method:       res.Method,
+		HTTPVersion:  res.HTTPVersion,
+		Body:         body,
+		Fingerprints: getSmallResponse(res),
+	}.ToJson()), "application/json", nil
 }
 
 func apiRaw(res types.Response, _ url.Values) ([]byte, string, error) {
@@ -86,13 +112,50 @@ func index(r types.Response, v url.Values) ([]byte, string, error) {
 	return []byte(strings.ReplaceAll(string(res), "/*DATA*/", string(data))), ct, nil
 }
 
-func getAllPaths() map[string]RouteHandler {
+// apiStats returns the counters of the fingerprint stores
+func (srv *Server) apiStats(_ types.Response, _ url.Values) ([]byte, string, error) {
+	stats := types.StatsResponse{
+		TCPFingerprints:  srv.GetTCPFingerprints().Stats(),
+		UDPFingerprints:  srv.GetUDPFingerprints().Stats(),
+		FailedHandshakes: srv.GetFailedHandshakes().Total(),
+	}
+	srv.GetCaptureStats().Range(func(_, v any) bool {
+		stats.Capture = append(stats.Capture, v.(types.CaptureStats))
+		return true
+	})
+	sort.Slice(stats.Capture, func(i, j int) bool {
+		return stats.Capture[i].Device < stats.Capture[j].Device
+	})
+	data, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to marshal stats: %w", err)
+	}
+	return data, "application/json", nil
+}
+
+// apiFailedHandshakes returns the failed TLS handshakes of the client's IP
+func (srv *Server) apiFailedHandshakes(res types.Response, _ url.Values) ([]byte, string, error) {
+	ip, _, err := net.SplitHostPort(res.IP)
+	if err != nil {
+		ip = res.IP
+	}
+	data, err := json.MarshalIndent(srv.GetFailedHandshakes().ForIP(ip), "", "  ")
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to marshal failed handshakes: %w", err)
+	}
+	return data, "application/json", nil
+}
+
+func getAllPaths(srv *Server) map[string]RouteHandler {
 	return map[string]RouteHandler{
-		"/":          index,
-		"/explore":   staticFile("static/explore.html"),
-		"/api/all":   apiAll,
-		"/api/tls":   apiTLS,
-		"/api/clean": apiClean,
-		"/api/raw":   apiRaw,
+		"/":                      index,
+		"/explore":               staticFile("static/explore.html"),
+		"/api/all":               apiAll,
+		"/api/tls":               apiTLS,
+		"/api/clean":             apiClean,
+		"/api/raw":               apiRaw,
+		"/api/echo":              apiEcho,
+		"/api/stats":             srv.apiStats,
+		"/api/failed-handshakes": srv.apiFailedHandshakes,
 	}
 }
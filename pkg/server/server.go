@@ -3,15 +3,43 @@ package server
 import (
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/pagpeter/trackme/pkg/types"
 )
 
+// How many client IPs TCP timestamp clocks are kept for at most
+const tcpClockMaxIPs = 100000
+
 // State holds all the global state previously scattered across the application
 type State struct {
 	Config          *types.Config
-	TCPFingerprints sync.Map
-	Local           bool
+	TCPFingerprints *FingerprintStore[types.TCPIPDetails]
+	// UDPFingerprints holds the IP details of the first datagram of HTTP/3 clients
+	UDPFingerprints *FingerprintStore[types.TCPIPDetails]
+	// HTTP2Responses maps response tokens to how the client read the HTTP/2 response
+	HTTP2Responses *FingerprintStore[types.Http2SentResponse]
+	// PlainHTTPRequests maps redirect tokens to plain HTTP requests
+	PlainHTTPRequests *FingerprintStore[plainHTTPRequest]
+	// QUICSecrets maps TLS client randoms to the client's traffic secrets of their HTTP/3 connection
+	QUICSecrets *FingerprintStore[quicSecrets]
+	// QUICConnections maps QUIC connection tracing IDs to what was recorded about them
+	QUICConnections sync.Map
+	// QUICInitials maps client addresses to their QUIC Initial flight
+	QUICInitials sync.Map
+	// TCPConnections maps client addresses to their open TCP connections
+	TCPConnections sync.Map
+	// TCPClocks maps client IPs to the TCP timestamp clocks seen from them,
+	// which are kept by the tcp package
+	TCPClocks *FingerprintStore[any]
+	// FailedHandshakes keeps the most recent failed TLS handshakes
+	FailedHandshakes *HandshakeLog
+	// CaptureStats maps capture devices to their packet counters
+	CaptureStats sync.Map
+	// ProxyProtocolHeaders maps the client addresses of open connections to
+	// the PROXY header they came with
+	ProxyProtocolHeaders sync.Map
+	Local                bool
 }
 
 // Server provides access to shared state and functionality
@@ -23,8 +51,14 @@ type Server struct {
 func NewServer() *Server {
 	return &Server{
 		State: &State{
-			Config:          &types.Config{},
-			TCPFingerprints: sync.Map{},
+			Config:            &types.Config{},
+			TCPFingerprints:   NewFingerprintStore[types.TCPIPDetails](),
+			UDPFingerprints:   NewFingerprintStore[types.TCPIPDetails](),
+			HTTP2Responses:    NewFingerprintStore[types.Http2SentResponse](),
+			PlainHTTPRequests: newPlainHTTPRequestStore(),
+			QUICSecrets:       newQUICSecretStore(),
+			TCPClocks:         newTCPClockStore(),
+			FailedHandshakes:  NewHandshakeLog(),
 		},
 	}
 }
@@ -34,9 +68,110 @@ func (s *Server) GetConfig() *types.Config {
 	return s.State.Config
 }
 
-// GetTCPFingerprints returns the TCP fingerprints map
-func (s *Server) GetTCPFingerprints() *sync.Map {
-	return &s.State.TCPFingerprints
+// GetTCPFingerprints returns the TCP fingerprints store
+func (s *Server) GetTCPFingerprints() *FingerprintStore[types.TCPIPDetails] {
+	return s.State.TCPFingerprints
+}
+
+// GetUDPFingerprints returns the UDP fingerprints store
+func (s *Server) GetUDPFingerprints() *FingerprintStore[types.TCPIPDetails] {
+	return s.State.UDPFingerprints
+}
+
+// GetHTTP2Responses returns how clients read their HTTP/2 responses, by response token
+func (s *Server) GetHTTP2Responses() *FingerprintStore[types.Http2SentResponse] {
+	return s.State.HTTP2Responses
+}
+
+// ConfigureFingerprintStores applies the limits of the loaded config to the fingerprint stores
+func (s *Server) ConfigureFingerprintStores() {
+	ttl := time.Duration(s.State.Config.FingerprintTTLSeconds) * time.Second
+	captureTTL := ttl
+	if s.State.Config.CaptureFile != "" {
+		// Replayed fingerprints are stored once at startup, the wall clock
+		// says nothing about when their connections were made
+		captureTTL = -1
+	}
+	s.State.TCPFingerprints.SetLimits(s.State.Config.FingerprintMaxEntries, captureTTL)
+	s.State.UDPFingerprints.SetLimits(s.State.Config.FingerprintMaxEntries, captureTTL)
+	s.State.HTTP2Responses.SetLimits(s.State.Config.FingerprintMaxEntries, ttl)
+}
+
+// getFingerprintWait returns how long a request waits for its fingerprint to
+// be captured. Only sniffed fingerprints can be late, replayed ones never
+// belong to live connections.
+func (s *Server) getFingerprintWait() time.Duration {
+	switch {
+	case s.State.Config.Device == "", s.State.Config.CaptureFile != "", s.State.Config.FingerprintWaitMs < 0:
+		return 0
+	case s.State.Config.FingerprintWaitMs == 0:
+		return defaultFingerprintWait
+	}
+	return time.Duration(s.State.Config.FingerprintWaitMs) * time.Millisecond
+}
+
+// getTCPFingerprintWait returns how long a request from addr waits for its
+// TCP fingerprint. The sniffer only sees the SYN of the load balancer for
+// clients that came with a PROXY header, so they don't wait for it at all.
+func (s *Server) getTCPFingerprintWait(addr string) time.Duration {
+	if s.getProxyProtocol(addr) != nil {
+		return 0
+	}
+	return s.getFingerprintWait()
+}
+
+// GetPlainHTTPRequests returns the plain HTTP requests waiting to be linked
+func (s *Server) GetPlainHTTPRequests() *FingerprintStore[plainHTTPRequest] {
+	return s.State.PlainHTTPRequests
+}
+
+// GetQUICSecrets returns the client traffic secrets of the HTTP/3 connections
+func (s *Server) GetQUICSecrets() *FingerprintStore[quicSecrets] {
+	return s.State.QUICSecrets
+}
+
+// GetQUICConnections returns the recorders of the open QUIC connections
+func (s *Server) GetQUICConnections() *sync.Map {
+	return &s.State.QUICConnections
+}
+
+// GetQUICInitials returns the recorded QUIC Initial flights
+func (s *Server) GetQUICInitials() *sync.Map {
+	return &s.State.QUICInitials
+}
+
+// GetTCPConnections returns the open TCP connections
+func (s *Server) GetTCPConnections() *sync.Map {
+	return &s.State.TCPConnections
+}
+
+// GetTCPClocks returns the TCP timestamp clocks of the client IPs
+func (s *Server) GetTCPClocks() *FingerprintStore[any] {
+	return s.State.TCPClocks
+}
+
+// newTCPClockStore creates the store of the TCP timestamp clocks. The clocks
+// of an IP are dropped once it sent no SYN for an hour, which is when their
+// samples would be too old anyway.
+func newTCPClockStore() *FingerprintStore[any] {
+	store := NewFingerprintStore[any]()
+	store.SetLimits(tcpClockMaxIPs, time.Hour)
+	return store
+}
+
+// GetFailedHandshakes returns the log of failed TLS handshakes
+func (s *Server) GetFailedHandshakes() *HandshakeLog {
+	return s.State.FailedHandshakes
+}
+
+// GetCaptureStats returns the packet counters of the capture devices
+func (s *Server) GetCaptureStats() *sync.Map {
+	return &s.State.CaptureStats
+}
+
+// GetProxyProtocolHeaders returns the PROXY headers of open connections
+func (s *Server) GetProxyProtocolHeaders() *sync.Map {
+	return &s.State.ProxyProtocolHeaders
 }
 
 // GetAdmin returns the CORS key configuration
@@ -49,7 +184,7 @@ func GetUserAgent(res types.Response) string {
 	var headers []string
 	var ua string
 
-	if res.HTTPVersion == "h2" {
+	if res.HTTPVersion == "h2" || res.HTTPVersion == "h2c" {
 		return res.UserAgent
 	} else {
 		if res.Http1 == nil {
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"net"
+
+	"github.com/pagpeter/trackme/pkg/types"
+	utls "github.com/wwhtrbbtt/utls"
+)
+
+// tcpConnection is an open TCP connection, and its TCP_INFO after the handshake
+type tcpConnection struct {
+	conn      *net.TCPConn
+	handshake *types.TCPInfo
+}
+
+// getTCPConn returns the TCP connection to the client beneath a connection,
+// nil if there is none
+func getTCPConn(conn net.Conn) *net.TCPConn {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c
+		case *utls.Conn:
+			conn = c.NetConn()
+		case *handshakeTimingConn:
+			conn = c.NetConn()
+		case *proxyConn:
+			if c.header != nil {
+				// The TCP connection ends at the load balancer, not at the client
+				return nil
+			}
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+}
+
+// trackTCPConnection takes the TCP_INFO of a connection whose handshake is
+// complete, and keeps the connection so requests on it can take it again when
+// they are answered. The returned function forgets the connection.
+func (srv *Server) trackTCPConnection(conn net.Conn) func() {
+	tcpConn := getTCPConn(conn)
+	if tcpConn == nil {
+		return func() {}
+	}
+	info, err := getTCPInfo(tcpConn)
+	if err != nil {
+		return func() {}
+	}
+	addr := conn.RemoteAddr().String()
+	srv.GetTCPConnections().Store(addr, &tcpConnection{conn: tcpConn, handshake: info})
+	return func() {
+		srv.GetTCPConnections().Delete(addr)
+	}
+}
+
+// getTCPInfoDetails returns the TCP_INFO of a client's connection after the
+// handshake and now, nil if the connection isn't tracked
+func (srv *Server) getTCPInfoDetails(addr string) *types.TCPInfoDetails {
+	v, ok := srv.GetTCPConnections().Load(addr)
+	if !ok {
+		return nil
+	}
+	c := v.(*tcpConnection)
+	details := &types.TCPInfoDetails{Handshake: c.handshake}
+	if info, err := getTCPInfo(c.conn); err == nil {
+		details.Response = info
+	}
+	return details
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"encoding/binary"
+	"net"
+	"unsafe"
+
+	"github.com/pagpeter/trackme/pkg/types"
+	"golang.org/x/sys/unix"
+)
+
+// TCP_INFO option flags (tcpi_options)
+var tcpInfoOptions = []struct {
+	flag uint8
+	name string
+}{
+	{0x01, "timestamps"},
+	{0x02, "sack"},
+	{0x04, "wscale"},
+	{0x08, "ecn"},
+	{0x10, "ecn_seen"},
+	{0x20, "syn_data"},
+}
+
+// getTCPInfo asks the kernel for the state of a TCP connection
+func getTCPInfo(conn *net.TCPConn) (*types.TCPInfo, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var info *unix.TCPInfo
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		info, sockErr = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	}); err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		return nil, sockErr
+	}
+
+	// The window scales are a bitfield right after tcpi_options, which
+	// unix.TCPInfo leaves out
+	wscale := (*[8]byte)(unsafe.Pointer(info))[6]
+	sndWScale, rcvWScale := wscale&0xf, wscale>>4
+	if binary.NativeEndian.Uint16([]byte{0, 1}) == 1 {
+		sndWScale, rcvWScale = wscale>>4, wscale&0xf
+	}
+
+	var options []string
+	for _, o := range tcpInfoOptions {
+		if info.Options&o.flag != 0 {
+			options = append(options, o.name)
+		}
+	}
+
+	return &types.TCPInfo{
+		RTTMs:           usToMs(info.Rtt),
+		RTTVarMs:        usToMs(info.Rttvar),
+		MinRTTMs:        usToMs(info.Min_rtt),
+		RTOMs:           usToMs(info.Rto),
+		SndMSS:          int(info.Snd_mss),
+		RcvMSS:          int(info.Rcv_mss),
+		AdvMSS:          int(info.Advmss),
+		PMTU:            int(info.Pmtu),
+		SndWScale:       int(sndWScale),
+		RcvWScale:       int(rcvWScale),
+		ClientWindow:    int(info.Snd_wnd),
+		SndCwnd:         int(info.Snd_cwnd),
+		Retransmissions: int(info.Total_retrans),
+		Lost:            int(info.Lost),
+		BytesReceived:   int(info.Bytes_received),
+		BytesAcked:      int(info.Bytes_acked),
+		SegsIn:          int(info.Segs_in),
+		SegsOut:         int(info.Segs_out),
+		Options:         options,
+	}, nil
+}
+
+func usToMs(us uint32) float64 {
+	return float64(us) / 1000
+}
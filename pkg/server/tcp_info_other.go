@@ -0,0 +1,14 @@
+//go:build !linux
+
+package server
+
+import (
+	"errors"
+	"net"
+
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+func getTCPInfo(_ *net.TCPConn) (*types.TCPInfo, error) {
+	return nil, errors.New("TCP_INFO is only supported on Linux")
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"time"
+
+	utls "github.com/wwhtrbbtt/utls"
+)
+
+// tlsChangeCipherSpec is the dummy record TLS 1.3 clients may send right
+// after their ClientHello, before they got anything from the server
+var tlsChangeCipherSpec = []byte{0x14, 0x03, 0x03, 0x00, 0x01, 0x01}
+
+// TLS record header fields
+const (
+	tlsRecordHeaderLen = 5
+	tlsRecordTypeAlert = 0x15
+)
+
+// handshakeTimingConn records when the server sent its first flight and when
+// the client's next flight arrived. The time in between is the TLS handshake
+// RTT, measured end to end even if the TCP connection ends at a proxy. It also
+// keeps the alert the server sent if the handshake failed before encryption.
+// Alerts sent after that are encrypted records and aren't captured.
+type handshakeTimingConn struct {
+	net.Conn
+	mu         sync.Mutex
+	firstWrite time.Time
+	reply      time.Time
+	// sentAlert is the description of a plaintext alert record, -1 if there was none
+	sentAlert int
+}
+
+func (c *handshakeTimingConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	if c.firstWrite.IsZero() {
+		c.firstWrite = time.Now()
+	}
+	if code, ok := findPlaintextAlert(b); ok {
+		c.sentAlert = code
+	}
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+func (c *handshakeTimingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 && !bytes.Equal(b[:n], tlsChangeCipherSpec) {
+		c.mu.Lock()
+		if !c.firstWrite.IsZero() && c.reply.IsZero() {
+			c.reply = time.Now()
+		}
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+// findPlaintextAlert returns the description of the first plaintext alert
+// record in the records of a write
+func findPlaintextAlert(b []byte) (int, bool) {
+	for len(b) >= tlsRecordHeaderLen {
+		length := int(b[3])<<8 | int(b[4])
+		if len(b) < tlsRecordHeaderLen+length {
+			break
+		}
+		// A plaintext alert is a level and a description
+		if b[0] == tlsRecordTypeAlert && length == 2 {
+			return int(b[tlsRecordHeaderLen+1]), true
+		}
+		b = b[tlsRecordHeaderLen+length:]
+	}
+	return 0, false
+}
+
+// NetConn returns the wrapped connection
+func (c *handshakeTimingConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// handshakeRTT returns the TLS handshake RTT, 0 if the handshake isn't complete
+func (c *handshakeTimingConn) handshakeRTT() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.reply.IsZero() {
+		return 0
+	}
+	return c.reply.Sub(c.firstWrite)
+}
+
+type handshakeTimingListener struct {
+	net.Listener
+}
+
+func (l handshakeTimingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &handshakeTimingConn{Conn: conn, sentAlert: -1}, nil
+}
+
+// TimeTLSHandshakes wraps the listener beneath a TLS listener, so the RTT of
+// the TLS handshakes can be reported
+func TimeTLSHandshakes(l net.Listener) net.Listener {
+	return handshakeTimingListener{Listener: l}
+}
+
+// getSentAlert returns the plaintext alert the server sent on a TLS connection,
+// -1 if it sent none
+func getSentAlert(conn net.Conn) int {
+	tlsConn, ok := conn.(*utls.Conn)
+	if !ok {
+		return -1
+	}
+	timing, ok := tlsConn.NetConn().(*handshakeTimingConn)
+	if !ok {
+		return -1
+	}
+	timing.mu.Lock()
+	defer timing.mu.Unlock()
+	return timing.sentAlert
+}
+
+// getTLSHandshakeRTT returns the handshake RTT of a TLS connection in
+// milliseconds, 0 if it wasn't measured
+func getTLSHandshakeRTT(conn net.Conn) float64 {
+	tlsConn, ok := conn.(*utls.Conn)
+	if !ok {
+		return 0
+	}
+	timing, ok := tlsConn.NetConn().(*handshakeTimingConn)
+	if !ok {
+		return 0
+	}
+	return float64(timing.handshakeRTT().Microseconds()) / 1000
+}
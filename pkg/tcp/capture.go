@@ -0,0 +1,52 @@
+package tcp
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+// snapLength is how much of every packet is captured, enough for the headers
+const snapLength = 1024
+
+// captureHandle is an open capture on one device
+type captureHandle interface {
+	// PacketSource returns the packets that passed the filter
+	PacketSource() *gopacket.PacketSource
+	// Stats returns how many packets were captured and dropped so far
+	Stats() (types.CaptureStats, error)
+	Close()
+}
+
+// openCapture starts capturing the packets that pass the filter on a device
+func openCapture(backend, device string, filter captureFilter) (captureHandle, error) {
+	switch backend {
+	case types.CaptureBackendPcap, "":
+		return openPcap(device, filter)
+	case types.CaptureBackendAFPacket:
+		return openAFPacket(device, filter)
+	}
+	return nil, fmt.Errorf("unknown capture backend %q", backend)
+}
+
+// getDevices splits the device config into the devices to capture on
+func getDevices(device string) []string {
+	var devices []string
+	for _, d := range strings.Split(device, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			devices = append(devices, d)
+		}
+	}
+	return devices
+}
+
+// decodeIP decodes packets that start at the IP header
+var decodeIP = gopacket.DecodeFunc(func(data []byte, p gopacket.PacketBuilder) error {
+	if len(data) > 0 && data[0]>>4 == 6 {
+		return layers.LayerTypeIPv6.Decode(data, p)
+	}
+	return layers.LayerTypeIPv4.Decode(data, p)
+})
@@ -0,0 +1,205 @@
+package tcp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/google/gopacket"
+	"github.com/pagpeter/trackme/pkg/types"
+	"golang.org/x/sys/unix"
+)
+
+// Size of the TPACKET_V3 ring shared with the kernel. The kernel hands a
+// block to us when it is full or afPacketBlockTimeoutMs passed.
+const (
+	afPacketBlockSize      = 1 << 20
+	afPacketBlockCount     = 16
+	afPacketFrameSize      = 2048
+	afPacketBlockTimeoutMs = 10
+	afPacketPollTimeoutMs  = 100
+)
+
+// Offsets in struct tpacket_block_desc and struct tpacket3_hdr
+const (
+	blockStatusOffset      = 8
+	blockNumPacketsOffset  = 12
+	blockFirstPacketOffset = 16
+)
+
+// afPacketHandle captures with an AF_PACKET socket and a TPACKET_V3 ring,
+// without libpcap. The socket is SOCK_DGRAM, so packets start at the IP header
+// on every kind of device.
+type afPacketHandle struct {
+	device string
+	fd     int
+	ring   []byte
+	closed atomic.Bool
+	unmap  sync.Once
+
+	// The block being read, its remaining packets and the offset of the next one
+	block     int
+	inBlock   bool
+	remaining uint32
+	offset    int
+
+	mu       sync.Mutex
+	received uint64
+	dropped  uint64
+}
+
+func htons(v uint16) uint16 {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	return binary.NativeEndian.Uint16(b[:])
+}
+
+func openAFPacket(device string, filter captureFilter) (captureHandle, error) {
+	ifindex := 0
+	if device != "any" {
+		iface, err := net.InterfaceByName(device)
+		if err != nil {
+			return nil, err
+		}
+		ifindex = iface.Index
+	}
+
+	program, err := filter.program(snapLength)
+	if err != nil {
+		return nil, err
+	}
+	rawProgram := make([]unix.SockFilter, len(program))
+	for i, insn := range program {
+		rawProgram[i] = unix.SockFilter{Code: insn.Op, Jt: insn.Jt, Jf: insn.Jf, K: insn.K}
+	}
+
+	// No packets arrive before the socket is bound, so the filter applies to all of them
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open AF_PACKET socket: %w", err)
+	}
+	h := &afPacketHandle{device: device, fd: fd}
+	fail := func(step string, err error) (captureHandle, error) {
+		h.Close()
+		h.unmapRing()
+		return nil, fmt.Errorf("failed to %s on %s: %w", step, device, err)
+	}
+
+	if err := unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &unix.SockFprog{
+		Len:    uint16(len(rawProgram)),
+		Filter: &rawProgram[0],
+	}); err != nil {
+		return fail("attach the capture filter", err)
+	}
+	if err := unix.SetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_VERSION, unix.TPACKET_V3); err != nil {
+		return fail("use TPACKET_V3", err)
+	}
+	if err := unix.SetsockoptTpacketReq3(fd, unix.SOL_PACKET, unix.PACKET_RX_RING, &unix.TpacketReq3{
+		Block_size:     afPacketBlockSize,
+		Block_nr:       afPacketBlockCount,
+		Frame_size:     afPacketFrameSize,
+		Frame_nr:       afPacketBlockSize / afPacketFrameSize * afPacketBlockCount,
+		Retire_blk_tov: afPacketBlockTimeoutMs,
+	}); err != nil {
+		return fail("set up the packet ring", err)
+	}
+	h.ring, err = unix.Mmap(fd, 0, afPacketBlockSize*afPacketBlockCount, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return fail("map the packet ring", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL), Ifindex: ifindex}); err != nil {
+		return fail("bind", err)
+	}
+	return h, nil
+}
+
+// blockStatus returns the status word of a block, which the kernel writes concurrently
+func (h *afPacketHandle) blockStatus(block int) *uint32 {
+	return (*uint32)(unsafe.Pointer(&h.ring[block*afPacketBlockSize+blockStatusOffset]))
+}
+
+// ReadPacketData returns the next packet, waiting for the kernel to hand over a block
+func (h *afPacketHandle) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		if h.closed.Load() {
+			h.unmapRing()
+			return nil, gopacket.CaptureInfo{}, io.EOF
+		}
+		if !h.inBlock {
+			if atomic.LoadUint32(h.blockStatus(h.block))&unix.TP_STATUS_USER == 0 {
+				fds := []unix.PollFd{{Fd: int32(h.fd), Events: unix.POLLIN | unix.POLLERR}}
+				if _, err := unix.Poll(fds, afPacketPollTimeoutMs); err != nil && err != unix.EINTR {
+					return nil, gopacket.CaptureInfo{}, err
+				}
+				continue
+			}
+			start := h.block * afPacketBlockSize
+			h.remaining = binary.NativeEndian.Uint32(h.ring[start+blockNumPacketsOffset:])
+			h.offset = start + int(binary.NativeEndian.Uint32(h.ring[start+blockFirstPacketOffset:]))
+			h.inBlock = true
+		}
+		if h.remaining == 0 {
+			// Give the block back to the kernel
+			atomic.StoreUint32(h.blockStatus(h.block), unix.TP_STATUS_KERNEL)
+			h.block = (h.block + 1) % afPacketBlockCount
+			h.inBlock = false
+			continue
+		}
+
+		hdr := (*unix.Tpacket3Hdr)(unsafe.Pointer(&h.ring[h.offset]))
+		start := h.offset + int(hdr.Net)
+		data := make([]byte, hdr.Snaplen)
+		copy(data, h.ring[start:start+int(hdr.Snaplen)])
+		ci := gopacket.CaptureInfo{
+			Timestamp:     time.Unix(int64(hdr.Sec), int64(hdr.Nsec)),
+			CaptureLength: int(hdr.Snaplen),
+			Length:        int(hdr.Len),
+		}
+		h.offset += int(hdr.Next_offset)
+		h.remaining--
+		return data, ci, nil
+	}
+}
+
+func (h *afPacketHandle) PacketSource() *gopacket.PacketSource {
+	return gopacket.NewPacketSource(h, decodeIP)
+}
+
+// Stats adds up the kernel's counters, which reset whenever they are read
+func (h *afPacketHandle) Stats() (types.CaptureStats, error) {
+	stats, err := unix.GetsockoptTpacketStatsV3(h.fd, unix.SOL_PACKET, unix.PACKET_STATISTICS)
+	if err != nil {
+		return types.CaptureStats{}, err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.received += uint64(stats.Packets)
+	h.dropped += uint64(stats.Drops)
+	return types.CaptureStats{
+		Device:   h.device,
+		Backend:  types.CaptureBackendAFPacket,
+		Received: h.received,
+		Dropped:  h.dropped,
+	}, nil
+}
+
+// Close closes the socket. The ring stays mapped until the reader noticed.
+func (h *afPacketHandle) Close() {
+	if h.closed.Swap(true) {
+		return
+	}
+	_ = unix.Close(h.fd)
+}
+
+func (h *afPacketHandle) unmapRing() {
+	h.unmap.Do(func() {
+		if h.ring != nil {
+			_ = unix.Munmap(h.ring)
+		}
+	})
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package tcp
+
+import "errors"
+
+func openAFPacket(_ string, _ captureFilter) (captureHandle, error) {
+	return nil, errors.New("the afpacket capture backend is only supported on Linux")
+}
@@ -0,0 +1,9 @@
+//go:build !cgo
+
+package tcp
+
+import "errors"
+
+func openPcap(_ string, _ captureFilter) (captureHandle, error) {
+	return nil, errors.New("built without cgo, so libpcap is not available: use the afpacket capture backend")
+}
@@ -0,0 +1,61 @@
+//go:build cgo
+
+package tcp
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+// TCP packet capture variables
+var (
+	promiscuous bool          = false
+	timeout     time.Duration = 1 * time.Millisecond
+)
+
+type pcapHandle struct {
+	device string
+	handle *pcap.Handle
+}
+
+func openPcap(device string, filter captureFilter) (captureHandle, error) {
+	expression, err := filter.expression()
+	if err != nil {
+		return nil, err
+	}
+	handle, err := pcap.OpenLive(device, snapLength, promiscuous, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := handle.SetBPFFilter(expression); err != nil {
+		handle.Close()
+		return nil, fmt.Errorf("failed to set capture filter on %s: %w", device, err)
+	}
+	return &pcapHandle{device: device, handle: handle}, nil
+}
+
+func (h *pcapHandle) PacketSource() *gopacket.PacketSource {
+	return gopacket.NewPacketSource(h.handle, h.handle.LinkType())
+}
+
+func (h *pcapHandle) Stats() (types.CaptureStats, error) {
+	stats, err := h.handle.Stats()
+	if err != nil {
+		return types.CaptureStats{}, err
+	}
+	return types.CaptureStats{
+		Device:           h.device,
+		Backend:          types.CaptureBackendPcap,
+		Received:         uint64(stats.PacketsReceived),
+		Dropped:          uint64(stats.PacketsDropped),
+		InterfaceDropped: uint64(stats.PacketsIfDropped),
+	}, nil
+}
+
+func (h *pcapHandle) Close() {
+	h.handle.Close()
+}
@@ -0,0 +1,187 @@
+package tcp
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pagpeter/trackme/pkg/server"
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+// Limits of the TCP timestamp samples kept per client IP
+const (
+	maxClockSamples = 32
+	maxClocksPerIP  = 8
+	clockSampleTTL  = time.Hour
+	// Rates are only measured over this span, shorter ones are dominated by jitter
+	minClockSpan = time.Second
+	// A sample belongs to a clock if its rate deviates by less than this
+	clockRateTolerance = 0.1
+)
+
+// nominalClockRates are the rates TCP timestamp clocks tick with, in Hz
+var nominalClockRates = []float64{1, 2, 10, 100, 128, 200, 250, 256, 1000}
+
+type clockSample struct {
+	at    time.Time
+	tsVal uint32
+}
+
+// tcpClock is a series of TCP timestamps that come from the same host. Since
+// Linux 4.13 the timestamps start at a random offset per client and server
+// address, so they are continuous across the connections of one host but
+// differ between hosts sharing an IP.
+type tcpClock struct {
+	samples []clockSample
+	// nominalRate is 0 until it is known
+	nominalRate float64
+}
+
+// tcpClocks are the clocks seen from one client IP
+type tcpClocks struct {
+	mu     sync.Mutex
+	nextID int
+	clocks map[int]*tcpClock
+}
+
+// ticksSince returns how far a timestamp advanced since a sample, handling wraparound
+func ticksSince(s clockSample, tsVal uint32) float64 {
+	return float64(int32(tsVal - s.tsVal))
+}
+
+// nearestNominalRate returns the nominal rate closest to a measured one, 0 if none is close
+func nearestNominalRate(rate float64) float64 {
+	for _, nominal := range nominalClockRates {
+		if math.Abs(rate-nominal)/nominal < clockRateTolerance {
+			return nominal
+		}
+	}
+	return 0
+}
+
+// fits reports whether a sample continues the clock
+func (c *tcpClock) fits(s clockSample) bool {
+	last := c.samples[len(c.samples)-1]
+	dt := s.at.Sub(last.at).Seconds()
+	ticks := ticksSince(last, s.tsVal)
+	if ticks < 0 {
+		return false
+	}
+	if dt < minClockSpan.Seconds() {
+		// Too close to measure a rate, but the fastest clock can't have advanced further
+		return ticks <= 1000*dt*(1+clockRateTolerance)+10
+	}
+	rate := ticks / dt
+	if c.nominalRate != 0 {
+		return math.Abs(rate-c.nominalRate)/c.nominalRate < clockRateTolerance
+	}
+	return nearestNominalRate(rate) != 0
+}
+
+// add appends a sample and updates the nominal rate once it can be measured
+func (c *tcpClock) add(s clockSample) {
+	c.samples = append(c.samples, s)
+	if len(c.samples) > maxClockSamples {
+		c.samples = c.samples[1:]
+	}
+	if c.nominalRate == 0 {
+		first := c.samples[0]
+		if dt := s.at.Sub(first.at); dt >= minClockSpan {
+			c.nominalRate = nearestNominalRate(ticksSince(first, s.tsVal) / dt.Seconds())
+		}
+	}
+}
+
+func (c *tcpClock) lastSeen() time.Time {
+	return c.samples[len(c.samples)-1].at
+}
+
+// measuredRate fits a line through the samples and returns its slope in Hz
+func (c *tcpClock) measuredRate() float64 {
+	first := c.samples[0]
+	n := float64(len(c.samples))
+	var sumX, sumY, sumXY, sumXX float64
+	for _, s := range c.samples {
+		x := s.at.Sub(first.at).Seconds()
+		y := ticksSince(first, s.tsVal)
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumXX += x * x
+	}
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return 0
+	}
+	return (n*sumXY - sumX*sumY) / denominator
+}
+
+// details describes the clock after its last sample
+func (c *tcpClock) details(id, clocks int) *types.TCPClock {
+	first, last := c.samples[0], c.samples[len(c.samples)-1]
+	details := &types.TCPClock{
+		ID:          id,
+		ClocksForIP: clocks,
+		Samples:     len(c.samples),
+		SpanSeconds: last.at.Sub(first.at).Seconds(),
+		NominalHz:   c.nominalRate,
+	}
+	if len(c.samples) >= 3 && details.SpanSeconds >= minClockSpan.Seconds() {
+		details.MeasuredHz = c.measuredRate()
+		if c.nominalRate != 0 {
+			details.SkewPPM = (details.MeasuredHz/c.nominalRate - 1) * 1e6
+		}
+	}
+	if c.nominalRate != 0 {
+		details.UptimeSeconds = float64(last.tsVal) / c.nominalRate
+	}
+	return details
+}
+
+// trackClock adds the timestamp of a SYN to the clocks of its source IP, and
+// returns what is known about the clock it belongs to
+func trackClock(srv *server.Server, ip string, at time.Time, tsVal uint32) *types.TCPClock {
+	store := srv.GetTCPClocks()
+	v, _ := store.LoadOrStore(ip, &tcpClocks{clocks: map[int]*tcpClock{}})
+	clocks := v.(*tcpClocks)
+	// Storing the clocks again keeps them while the IP is active
+	store.Store(ip, clocks)
+	clocks.mu.Lock()
+	defer clocks.mu.Unlock()
+
+	// Forget samples that are too old to belong to a host that's still there
+	for id, c := range clocks.clocks {
+		for len(c.samples) > 0 && at.Sub(c.samples[0].at) > clockSampleTTL {
+			c.samples = c.samples[1:]
+		}
+		if len(c.samples) == 0 {
+			delete(clocks.clocks, id)
+		}
+	}
+
+	s := clockSample{at: at, tsVal: tsVal}
+	for id, c := range clocks.clocks {
+		if c.fits(s) {
+			c.add(s)
+			return c.details(id, len(clocks.clocks))
+		}
+	}
+
+	if len(clocks.clocks) >= maxClocksPerIP {
+		// Replace the clock that was seen least recently
+		oldest := -1
+		for id, c := range clocks.clocks {
+			if oldest == -1 || c.lastSeen().Before(clocks.clocks[oldest].lastSeen()) {
+				oldest = id
+			}
+		}
+		delete(clocks.clocks, oldest)
+	}
+	id := clocks.nextID
+	clocks.nextID++
+	c := &tcpClock{}
+	c.add(s)
+	clocks.clocks[id] = c
+	return c.details(id, len(clocks.clocks))
+}
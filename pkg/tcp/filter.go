@@ -0,0 +1,233 @@
+package tcp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/bpf"
+)
+
+// captureFilter selects the packets the sniffer needs, so the kernel drops
+// everything else before it is copied to us
+type captureFilter struct {
+	tlsPort  int
+	httpPort int
+	// quicPort is 0 if QUIC is disabled
+	quicPort int
+	// firstPackets lets every TCP packet to the ports pass instead of only
+	// SYNs, for the first ACK and data segment of each connection
+	firstPackets bool
+}
+
+// errNoCapturePorts is returned for a filter without ports, which would let every packet pass
+var errNoCapturePorts = errors.New("capture filter has no ports")
+
+// tcpPorts returns the ports whose TCP packets are captured
+func (f captureFilter) tcpPorts() []int {
+	var ports []int
+	for _, port := range []int{f.tlsPort, f.httpPort} {
+		if port != 0 {
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
+
+// expression returns the filter in libpcap syntax. The TCP flags of IPv6
+// packets are only checked if there are no extension headers.
+func (f captureFilter) expression() (string, error) {
+	if len(f.tcpPorts()) == 0 && f.quicPort == 0 {
+		return "", errNoCapturePorts
+	}
+	var parts []string
+	if ports := f.tcpPorts(); len(ports) > 0 {
+		portList := make([]string, len(ports))
+		for i, port := range ports {
+			portList[i] = fmt.Sprint(port)
+		}
+		tcp := fmt.Sprintf("tcp dst port (%s)", strings.Join(portList, " or "))
+		if !f.firstPackets {
+			tcp += " and ((ip and tcp[tcpflags] & tcp-syn != 0) or (ip6 and ip6[6] = 6 and ip6[53] & 2 != 0))"
+		}
+		parts = append(parts, "("+tcp+")")
+	}
+	if f.quicPort != 0 {
+		parts = append(parts, fmt.Sprintf("(udp dst port %d)", f.quicPort))
+	}
+	return strings.Join(parts, " or "), nil
+}
+
+// Offsets in the IPv4 and IPv6 headers
+const (
+	ipv4FlagsFragment  = 6
+	ipv4Protocol       = 9
+	ipv6NextHeader     = 6
+	ipv6HeaderLength   = 40
+	ipv4FragmentMask   = 0x1fff
+	tcpFlagsOffset     = 13
+	tcpFlagSYN         = 0x02
+	destinationPortOff = 2
+	protocolTCP        = 6
+	protocolUDP        = 17
+)
+
+// program returns the filter as classic BPF for packets that start at the IP
+// header, keeping up to snapLen bytes of every packet that passes
+func (f captureFilter) program(snapLen uint32) ([]bpf.RawInstruction, error) {
+	if len(f.tcpPorts()) == 0 && f.quicPort == 0 {
+		return nil, errNoCapturePorts
+	}
+	a := newBPFAssembler()
+
+	// IP version
+	a.emit(bpf.LoadAbsolute{Off: 0, Size: 1})
+	a.emit(bpf.ALUOpConstant{Op: bpf.ALUOpShiftRight, Val: 4})
+	a.jumpIf(bpf.JumpEqual, 4, "ipv4", "")
+	a.jumpIf(bpf.JumpEqual, 6, "ipv6", "drop")
+
+	a.label("ipv4")
+	a.emit(bpf.LoadAbsolute{Off: ipv4FlagsFragment, Size: 2})
+	a.jumpIf(bpf.JumpBitsSet, ipv4FragmentMask, "drop", "")
+	// X is the length of the IPv4 header
+	a.emit(bpf.LoadMemShift{Off: 0})
+	a.emit(bpf.LoadAbsolute{Off: ipv4Protocol, Size: 1})
+	a.jumpIf(bpf.JumpEqual, protocolTCP, "ipv4-tcp", "")
+	a.jumpIf(bpf.JumpEqual, protocolUDP, "ipv4-udp", "drop")
+
+	a.label("ipv4-tcp")
+	a.emit(bpf.LoadIndirect{Off: destinationPortOff, Size: 2})
+	f.matchPorts(a, f.tcpPorts(), "ipv4-tcp-flags")
+	a.label("ipv4-tcp-flags")
+	a.emit(bpf.LoadIndirect{Off: tcpFlagsOffset, Size: 1})
+	f.matchSYN(a)
+
+	a.label("ipv4-udp")
+	a.emit(bpf.LoadIndirect{Off: destinationPortOff, Size: 2})
+	f.matchPorts(a, quicPorts(f.quicPort), "accept")
+
+	a.label("ipv6")
+	a.emit(bpf.LoadAbsolute{Off: ipv6NextHeader, Size: 1})
+	a.jumpIf(bpf.JumpEqual, protocolTCP, "ipv6-tcp", "")
+	a.jumpIf(bpf.JumpEqual, protocolUDP, "ipv6-udp", "drop")
+
+	a.label("ipv6-tcp")
+	a.emit(bpf.LoadAbsolute{Off: ipv6HeaderLength + destinationPortOff, Size: 2})
+	f.matchPorts(a, f.tcpPorts(), "ipv6-tcp-flags")
+	a.label("ipv6-tcp-flags")
+	a.emit(bpf.LoadAbsolute{Off: ipv6HeaderLength + tcpFlagsOffset, Size: 1})
+	f.matchSYN(a)
+
+	a.label("ipv6-udp")
+	a.emit(bpf.LoadAbsolute{Off: ipv6HeaderLength + destinationPortOff, Size: 2})
+	f.matchPorts(a, quicPorts(f.quicPort), "accept")
+
+	a.label("accept")
+	a.emit(bpf.RetConstant{Val: snapLen})
+	a.label("drop")
+	a.emit(bpf.RetConstant{Val: 0})
+
+	insns, err := a.assemble()
+	if err != nil {
+		return nil, err
+	}
+	return bpf.Assemble(insns)
+}
+
+func quicPorts(port int) []int {
+	if port == 0 {
+		return nil
+	}
+	return []int{port}
+}
+
+// matchPorts jumps to target if the loaded port is one of ports, and drops the packet otherwise
+func (f captureFilter) matchPorts(a *bpfAssembler, ports []int, target string) {
+	for _, port := range ports {
+		a.jumpIf(bpf.JumpEqual, uint32(port), target, "")
+	}
+	a.jump("drop")
+}
+
+// matchSYN accepts the packet if the loaded TCP flags contain SYN, or all
+// packets if the first packets are captured as well
+func (f captureFilter) matchSYN(a *bpfAssembler) {
+	if f.firstPackets {
+		a.jump("accept")
+		return
+	}
+	a.jumpIf(bpf.JumpBitsSet, tcpFlagSYN, "accept", "drop")
+}
+
+type bpfJump struct {
+	index           int
+	conditional     bool
+	ifTrue, ifFalse string
+	cond            bpf.JumpTest
+	val             uint32
+}
+
+// bpfAssembler resolves named jump targets into the relative skips of classic BPF
+type bpfAssembler struct {
+	insns  []bpf.Instruction
+	labels map[string]int
+	jumps  []bpfJump
+}
+
+func newBPFAssembler() *bpfAssembler {
+	return &bpfAssembler{labels: map[string]int{}}
+}
+
+func (a *bpfAssembler) emit(insn bpf.Instruction) {
+	a.insns = append(a.insns, insn)
+}
+
+func (a *bpfAssembler) label(name string) {
+	a.labels[name] = len(a.insns)
+}
+
+// jumpIf jumps to ifTrue or ifFalse, an empty label continues with the next instruction
+func (a *bpfAssembler) jumpIf(cond bpf.JumpTest, val uint32, ifTrue, ifFalse string) {
+	a.jumps = append(a.jumps, bpfJump{index: len(a.insns), conditional: true, cond: cond, val: val, ifTrue: ifTrue, ifFalse: ifFalse})
+	a.insns = append(a.insns, nil)
+}
+
+func (a *bpfAssembler) jump(target string) {
+	a.jumps = append(a.jumps, bpfJump{index: len(a.insns), ifTrue: target})
+	a.insns = append(a.insns, nil)
+}
+
+func (a *bpfAssembler) assemble() ([]bpf.Instruction, error) {
+	skip := func(from int, label string) (uint32, error) {
+		if label == "" {
+			return 0, nil
+		}
+		target, ok := a.labels[label]
+		if !ok {
+			return 0, fmt.Errorf("unknown BPF label %q", label)
+		}
+		if target <= from {
+			return 0, fmt.Errorf("BPF jump to %q goes backwards", label)
+		}
+		return uint32(target - from - 1), nil
+	}
+	for _, j := range a.jumps {
+		skipTrue, err := skip(j.index, j.ifTrue)
+		if err != nil {
+			return nil, err
+		}
+		if !j.conditional {
+			a.insns[j.index] = bpf.Jump{Skip: skipTrue}
+			continue
+		}
+		skipFalse, err := skip(j.index, j.ifFalse)
+		if err != nil {
+			return nil, err
+		}
+		if skipTrue > 255 || skipFalse > 255 {
+			return nil, fmt.Errorf("BPF jump too far")
+		}
+		a.insns[j.index] = bpf.JumpIf{Cond: j.cond, Val: j.val, SkipTrue: uint8(skipTrue), SkipFalse: uint8(skipFalse)}
+	}
+	return a.insns, nil
+}
@@ -0,0 +1,109 @@
+package tcp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// TCP option kinds (RFC 9293, RFC 7323, RFC 2018)
+const (
+	optionEOL           = 0
+	optionNOP           = 1
+	optionMSS           = 2
+	optionWindowScale   = 3
+	optionSACKPermitted = 4
+	optionSACK          = 5
+	optionTimestamps    = 8
+)
+
+// tcpOptions are the options of a TCP header, parsed from their raw bytes so
+// the exact layout (NOPs, padding after EOL) is kept
+type tcpOptions struct {
+	// layout lists the options with their p0f names, in order
+	layout []string
+	// values lists the options with their values, in order
+	values        []string
+	mss           int
+	windowScale   int
+	sackPermitted bool
+	sackBlocks    [][2]uint32
+	hasTimestamps bool
+	tsVal         uint32
+	tsEcr         uint32
+	// trailingData is set if there are non-zero bytes after the EOL option
+	trailingData bool
+	malformed    bool
+}
+
+// parseTCPOptions parses the options part of a TCP header
+func parseTCPOptions(raw []byte) tcpOptions {
+	opts := tcpOptions{mss: -1, windowScale: -1}
+	for i := 0; i < len(raw); {
+		kind := raw[i]
+		switch kind {
+		case optionEOL:
+			rest := raw[i+1:]
+			opts.layout = append(opts.layout, fmt.Sprintf("eol+%d", len(rest)))
+			opts.values = append(opts.values, "eol")
+			for _, b := range rest {
+				if b != 0 {
+					opts.trailingData = true
+				}
+			}
+			return opts
+		case optionNOP:
+			opts.layout = append(opts.layout, "nop")
+			opts.values = append(opts.values, "nop")
+			i++
+			continue
+		}
+
+		if i+1 >= len(raw) || raw[i+1] < 2 || i+int(raw[i+1]) > len(raw) {
+			opts.malformed = true
+			return opts
+		}
+		length := int(raw[i+1])
+		data := raw[i+2 : i+length]
+		i += length
+
+		switch {
+		case kind == optionMSS && len(data) == 2:
+			opts.mss = int(binary.BigEndian.Uint16(data))
+			opts.layout = append(opts.layout, "mss")
+			opts.values = append(opts.values, fmt.Sprintf("mss=%d", opts.mss))
+		case kind == optionWindowScale && len(data) == 1:
+			opts.windowScale = int(data[0])
+			opts.layout = append(opts.layout, "ws")
+			opts.values = append(opts.values, fmt.Sprintf("ws=%d", opts.windowScale))
+		case kind == optionSACKPermitted && len(data) == 0:
+			opts.sackPermitted = true
+			opts.layout = append(opts.layout, "sok")
+			opts.values = append(opts.values, "sok")
+		case kind == optionSACK && len(data)%8 == 0:
+			var blocks []string
+			for j := 0; j < len(data); j += 8 {
+				block := [2]uint32{binary.BigEndian.Uint32(data[j:]), binary.BigEndian.Uint32(data[j+4:])}
+				opts.sackBlocks = append(opts.sackBlocks, block)
+				blocks = append(blocks, fmt.Sprintf("%d-%d", block[0], block[1]))
+			}
+			opts.layout = append(opts.layout, "sack")
+			opts.values = append(opts.values, "sack="+strings.Join(blocks, "/"))
+		case kind == optionTimestamps && len(data) == 8:
+			opts.hasTimestamps = true
+			opts.tsVal = binary.BigEndian.Uint32(data)
+			opts.tsEcr = binary.BigEndian.Uint32(data[4:])
+			opts.layout = append(opts.layout, "ts")
+			opts.values = append(opts.values, fmt.Sprintf("ts=%d/%d", opts.tsVal, opts.tsEcr))
+		case kind == optionMSS || kind == optionWindowScale || kind == optionSACKPermitted || kind == optionSACK || kind == optionTimestamps:
+			// A known option with the wrong length
+			opts.malformed = true
+			opts.layout = append(opts.layout, fmt.Sprintf("?%d", kind))
+			opts.values = append(opts.values, fmt.Sprintf("?%d", kind))
+		default:
+			opts.layout = append(opts.layout, fmt.Sprintf("?%d", kind))
+			opts.values = append(opts.values, fmt.Sprintf("?%d=%x", kind, data))
+		}
+	}
+	return opts
+}
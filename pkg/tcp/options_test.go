@@ -0,0 +1,165 @@
+package tcp
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseTCPOptions(t *testing.T) {
+	tests := []struct {
+		name         string
+		raw          []byte
+		layout       []string
+		values       []string
+		mss          int
+		windowScale  int
+		trailingData bool
+		malformed    bool
+	}{
+		{
+			name:        "linux",
+			raw:         []byte{2, 4, 0x05, 0xb4, 4, 2, 8, 10, 0, 0, 0, 1, 0, 0, 0, 0, 1, 3, 3, 7},
+			layout:      []string{"mss", "sok", "ts", "nop", "ws"},
+			values:      []string{"mss=1460", "sok", "ts=1/0", "nop", "ws=7"},
+			mss:         1460,
+			windowScale: 7,
+		},
+		{
+			name:        "windows",
+			raw:         []byte{2, 4, 0x05, 0xb4, 1, 3, 3, 8, 1, 1, 4, 2},
+			layout:      []string{"mss", "nop", "ws", "nop", "nop", "sok"},
+			values:      []string{"mss=1460", "nop", "ws=8", "nop", "nop", "sok"},
+			mss:         1460,
+			windowScale: 8,
+		},
+		{
+			name:        "empty",
+			raw:         nil,
+			mss:         -1,
+			windowScale: -1,
+		},
+		{
+			name:        "eol without padding",
+			raw:         []byte{2, 4, 0x05, 0xb4, 0},
+			layout:      []string{"mss", "eol+0"},
+			values:      []string{"mss=1460", "eol"},
+			mss:         1460,
+			windowScale: -1,
+		},
+		{
+			name:        "eol with zero padding",
+			raw:         []byte{2, 4, 0x05, 0xb4, 0, 0, 0},
+			layout:      []string{"mss", "eol+2"},
+			values:      []string{"mss=1460", "eol"},
+			mss:         1460,
+			windowScale: -1,
+		},
+		{
+			name:         "trailing data after eol",
+			raw:          []byte{0, 0, 3, 3, 7},
+			layout:       []string{"eol+4"},
+			values:       []string{"eol"},
+			mss:          -1,
+			windowScale:  -1,
+			trailingData: true,
+		},
+		{
+			name:        "excessive window scale",
+			raw:         []byte{3, 3, 15},
+			layout:      []string{"ws"},
+			values:      []string{"ws=15"},
+			mss:         -1,
+			windowScale: 15,
+		},
+		{
+			name:        "sack blocks",
+			raw:         []byte{1, 1, 5, 18, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3, 0, 0, 0, 4},
+			layout:      []string{"nop", "nop", "sack"},
+			values:      []string{"nop", "nop", "sack=1-2/3-4"},
+			mss:         -1,
+			windowScale: -1,
+		},
+		{
+			name:        "unknown option",
+			raw:         []byte{30, 4, 0xab, 0xcd, 1},
+			layout:      []string{"?30", "nop"},
+			values:      []string{"?30=abcd", "nop"},
+			mss:         -1,
+			windowScale: -1,
+		},
+		{
+			name:        "known option with the wrong length",
+			raw:         []byte{2, 3, 0x05, 3, 3, 7},
+			layout:      []string{"?2", "ws"},
+			values:      []string{"?2", "ws=7"},
+			mss:         -1,
+			windowScale: 7,
+			malformed:   true,
+		},
+		{
+			name:        "zero length option",
+			raw:         []byte{1, 30, 0, 1, 1},
+			layout:      []string{"nop"},
+			values:      []string{"nop"},
+			mss:         -1,
+			windowScale: -1,
+			malformed:   true,
+		},
+		{
+			name:        "length of one",
+			raw:         []byte{4, 1, 1, 1},
+			mss:         -1,
+			windowScale: -1,
+			malformed:   true,
+		},
+		{
+			name:        "length past the options",
+			raw:         []byte{2, 4, 0x05, 0xb4, 8, 10, 0, 0, 0, 1},
+			layout:      []string{"mss"},
+			values:      []string{"mss=1460"},
+			mss:         1460,
+			windowScale: -1,
+			malformed:   true,
+		},
+		{
+			name:        "kind without length",
+			raw:         []byte{1, 2},
+			layout:      []string{"nop"},
+			values:      []string{"nop"},
+			mss:         -1,
+			windowScale: -1,
+			malformed:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := parseTCPOptions(tt.raw)
+			if !slices.Equal(opts.layout, tt.layout) {
+				t.Errorf("layout = %q, want %q", opts.layout, tt.layout)
+			}
+			if !slices.Equal(opts.values, tt.values) {
+				t.Errorf("values = %q, want %q", opts.values, tt.values)
+			}
+			if opts.mss != tt.mss || opts.windowScale != tt.windowScale {
+				t.Errorf("mss, window scale = %d, %d, want %d, %d", opts.mss, opts.windowScale, tt.mss, tt.windowScale)
+			}
+			if opts.trailingData != tt.trailingData {
+				t.Errorf("trailing data = %v, want %v", opts.trailingData, tt.trailingData)
+			}
+			if opts.malformed != tt.malformed {
+				t.Errorf("malformed = %v, want %v", opts.malformed, tt.malformed)
+			}
+		})
+	}
+}
+
+func TestParseTCPOptionsTimestamps(t *testing.T) {
+	opts := parseTCPOptions([]byte{1, 1, 8, 10, 0, 0, 0x01, 0x00, 0x00, 0x00, 0x00, 0x2a})
+	if !opts.hasTimestamps || opts.tsVal != 256 || opts.tsEcr != 42 {
+		t.Errorf("timestamps = %v %d/%d, want 256/42", opts.hasTimestamps, opts.tsVal, opts.tsEcr)
+	}
+	if opts.sackPermitted {
+		t.Error("SACK permitted without the option")
+	}
+}
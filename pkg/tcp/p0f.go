@@ -0,0 +1,387 @@
+package tcp
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/pagpeter/trackme/pkg/types"
+	"github.com/pagpeter/trackme/pkg/utils"
+)
+
+// maxDistance is the most hops a packet can travel for its initial TTL to still
+// count as an exact match
+const maxDistance = 35
+
+// Quality of an OS match, from best to worst
+const (
+	MatchExact   = "exact"
+	MatchGeneric = "generic"
+	MatchFuzzy   = "fuzzy"
+	MatchNone    = "none"
+)
+
+// Window size types of p0f signatures
+const (
+	windowAny = iota
+	windowValue
+	windowModulo
+	windowMSS
+	windowMTU
+)
+
+// fuzzyQuirks may differ between a packet and a signature, the match is fuzzy then
+var fuzzyQuirks = []string{"df", "id+", "id-", "ecn"}
+
+// osSignature is a [tcp:request] signature of a p0f database. Fields that
+// match anything are -1.
+type osSignature struct {
+	generic bool
+	class   string
+	name    string
+	flavor  string
+	raw     string
+
+	version    int
+	ittl       int
+	badTTL     bool
+	olen       int
+	mss        int
+	windowType int
+	window     int
+	scale      int
+	olayout    string
+	quirks     []string
+	// payload is -1 for any, 0 for none and 1 for some
+	payload int
+}
+
+// OSDatabase holds the SYN signatures of a p0f-compatible database
+type OSDatabase struct {
+	signatures []osSignature
+}
+
+// LoadOSDatabase reads the [tcp:request] section of a p0f.fp file
+func LoadOSDatabase(path string) (*OSDatabase, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open OS database: %w", err)
+	}
+	defer file.Close()
+
+	db := &OSDatabase{}
+	var section string
+	var label *osSignature
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			section = strings.Trim(line, "[]")
+			label = nil
+			continue
+		}
+		if section != "tcp:request" {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid line %d in OS database: %q", lineNumber, line)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		switch key {
+		case "label":
+			label, err = parseOSLabel(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid label on line %d in OS database: %w", lineNumber, err)
+			}
+		case "sig":
+			if label == nil {
+				return nil, fmt.Errorf("signature without label on line %d in OS database", lineNumber)
+			}
+			sig, err := parseOSSignature(*label, value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid signature on line %d in OS database: %w", lineNumber, err)
+			}
+			db.signatures = append(db.signatures, sig)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read OS database: %w", err)
+	}
+	return db, nil
+}
+
+// Len returns the number of signatures in the database
+func (db *OSDatabase) Len() int {
+	return len(db.signatures)
+}
+
+// parseOSLabel parses a label like "s:unix:Linux:3.11 and newer"
+func parseOSLabel(value string) (*osSignature, error) {
+	parts := strings.SplitN(value, ":", 4)
+	if len(parts) != 4 || (parts[0] != "s" && parts[0] != "g") {
+		return nil, fmt.Errorf("%q", value)
+	}
+	return &osSignature{
+		generic: parts[0] == "g",
+		class:   strings.TrimPrefix(parts[1], "!"),
+		name:    parts[2],
+		flavor:  parts[3],
+	}, nil
+}
+
+// parseOSSignature parses a signature like
+// "*:64:0:*:mss*20,10:mss,sok,ts,nop,ws:df,id+:0"
+func parseOSSignature(label osSignature, value string) (osSignature, error) {
+	sig := label
+	sig.raw = value
+	fields := strings.Split(value, ":")
+	if len(fields) != 8 {
+		return sig, fmt.Errorf("%q has %d fields instead of 8", value, len(fields))
+	}
+
+	var err error
+	if sig.version, err = parseOSField(fields[0]); err != nil {
+		return sig, err
+	}
+	ittl := fields[1]
+	if strings.HasSuffix(ittl, "-") {
+		sig.badTTL = true
+		ittl = strings.TrimSuffix(ittl, "-")
+	} else if i := strings.Index(ittl, "+"); i != -1 {
+		// "ttl+distance" is the observed TTL and the hops it traveled
+		observed, err1 := strconv.Atoi(ittl[:i])
+		distance, err2 := strconv.Atoi(ittl[i+1:])
+		if err1 != nil || err2 != nil {
+			return sig, fmt.Errorf("invalid ttl %q", fields[1])
+		}
+		ittl = strconv.Itoa(observed + distance)
+	}
+	if sig.ittl, err = parseOSField(ittl); err != nil {
+		return sig, err
+	}
+	if sig.olen, err = parseOSField(fields[2]); err != nil {
+		return sig, err
+	}
+	if sig.mss, err = parseOSField(fields[3]); err != nil {
+		return sig, err
+	}
+
+	window, scale, ok := strings.Cut(fields[4], ",")
+	if !ok {
+		return sig, fmt.Errorf("invalid window %q", fields[4])
+	}
+	switch {
+	case window == "*":
+		sig.windowType = windowAny
+	case strings.HasPrefix(window, "mss*"):
+		sig.windowType = windowMSS
+		sig.window, err = strconv.Atoi(strings.TrimPrefix(window, "mss*"))
+	case strings.HasPrefix(window, "mtu*"):
+		sig.windowType = windowMTU
+		sig.window, err = strconv.Atoi(strings.TrimPrefix(window, "mtu*"))
+	case strings.HasPrefix(window, "%"):
+		sig.windowType = windowModulo
+		sig.window, err = strconv.Atoi(strings.TrimPrefix(window, "%"))
+	default:
+		sig.windowType = windowValue
+		sig.window, err = strconv.Atoi(window)
+	}
+	if err != nil {
+		return sig, fmt.Errorf("invalid window %q", window)
+	}
+	if sig.scale, err = parseOSField(scale); err != nil {
+		return sig, err
+	}
+
+	sig.olayout = fields[5]
+	if fields[6] != "" {
+		sig.quirks = strings.Split(fields[6], ",")
+	}
+	switch fields[7] {
+	case "*":
+		sig.payload = -1
+	case "0":
+		sig.payload = 0
+	case "+":
+		sig.payload = 1
+	default:
+		return sig, fmt.Errorf("invalid payload class %q", fields[7])
+	}
+	return sig, nil
+}
+
+// parseOSField parses a number, or "*" for any value
+func parseOSField(field string) (int, error) {
+	if field == "*" {
+		return -1, nil
+	}
+	n, err := strconv.Atoi(field)
+	if err != nil {
+		return 0, fmt.Errorf("invalid field %q", field)
+	}
+	return n, nil
+}
+
+// Match finds the signature of a SYN in the database. Exact matches of
+// specific signatures are preferred over generic ones, which are preferred
+// over fuzzy matches where the TTL or some quirks don't fit.
+func (db *OSDatabase) Match(pack types.TCPIPDetails) *types.OSGuess {
+	var generic, fuzzy *osSignature
+	for i := range db.signatures {
+		sig := &db.signatures[i]
+		ok, exact := sig.matches(pack)
+		if !ok {
+			continue
+		}
+		if !exact {
+			if fuzzy == nil {
+				fuzzy = sig
+			}
+			continue
+		}
+		if !sig.generic {
+			return sig.guess(pack, MatchExact)
+		}
+		if generic == nil {
+			generic = sig
+		}
+	}
+	if generic != nil {
+		return generic.guess(pack, MatchGeneric)
+	}
+	if fuzzy != nil {
+		return fuzzy.guess(pack, MatchFuzzy)
+	}
+	return &types.OSGuess{Quality: MatchNone}
+}
+
+// matches reports whether a SYN fits the signature, and whether it does so exactly
+func (sig *osSignature) matches(pack types.TCPIPDetails) (ok, exact bool) {
+	exact = true
+	if sig.olayout != pack.TCP.OptionsOrder {
+		return false, false
+	}
+	// Only a few quirks that middleboxes like to change may differ
+	for _, q := range quirkDifference(sig.quirks, pack.TCP.Quirks) {
+		if !slices.Contains(fuzzyQuirks, q) {
+			return false, false
+		}
+		exact = false
+	}
+	if sig.version != -1 && sig.version != pack.IP.IPVersion {
+		return false, false
+	}
+
+	olen := 0
+	if pack.IP.IPVersion == 4 && pack.IP.HDRLength > 20 {
+		olen = pack.IP.HDRLength - 20
+	}
+	if sig.olen != -1 && sig.olen != olen {
+		return false, false
+	}
+
+	// An initial TTL of * matches any TTL
+	if sig.ittl != -1 {
+		if sig.ittl < pack.IP.TTL {
+			if sig.badTTL {
+				return false, false
+			}
+			exact = false
+		} else if !sig.badTTL && sig.ittl-pack.IP.TTL > maxDistance {
+			exact = false
+		}
+	}
+
+	mss := -1
+	if pack.TCP.MSS != 0 || strings.Contains(pack.TCP.OptionsOrder, "mss") {
+		mss = pack.TCP.MSS
+	}
+	if sig.mss != -1 && sig.mss != mss {
+		return false, false
+	}
+	// p0f uses a scale of 0 if the option is missing
+	scale := max(pack.TCP.WindowScale, 0)
+	if sig.scale != -1 && sig.scale != scale {
+		return false, false
+	}
+
+	window := pack.TCP.Window
+	switch sig.windowType {
+	case windowValue:
+		ok = window == sig.window
+	case windowModulo:
+		ok = sig.window != 0 && window%sig.window == 0
+	case windowMSS:
+		ok = mss > 0 && window == mss*sig.window
+	case windowMTU:
+		ok = mss > 0 && window == (mss+ipHeaderOverhead(pack.IP.IPVersion))*sig.window
+	default:
+		ok = true
+	}
+	if !ok {
+		return false, false
+	}
+
+	switch sig.payload {
+	case 0:
+		ok = pack.TCP.PayloadLength == 0
+	case 1:
+		ok = pack.TCP.PayloadLength > 0
+	}
+	return ok, ok && exact
+}
+
+// quirkDifference returns the quirks that are only in one of both lists
+func quirkDifference(a, b []string) []string {
+	var diff []string
+	for _, q := range a {
+		if !slices.Contains(b, q) {
+			diff = append(diff, q)
+		}
+	}
+	for _, q := range b {
+		if !slices.Contains(a, q) {
+			diff = append(diff, q)
+		}
+	}
+	return diff
+}
+
+// ipHeaderOverhead returns the size of the IP and TCP headers without options,
+// the difference between the MTU and the MSS
+func ipHeaderOverhead(version int) int {
+	if version == 6 {
+		return 60
+	}
+	return 40
+}
+
+// guess describes the signature as the OS of a packet
+func (sig *osSignature) guess(pack types.TCPIPDetails, quality string) *types.OSGuess {
+	label := sig.name
+	if sig.flavor != "" {
+		label += " " + sig.flavor
+	}
+	ittl := sig.ittl
+	if ittl < pack.IP.TTL {
+		ittl = utils.GuessInitialTTL(pack.IP.TTL)
+	}
+	return &types.OSGuess{
+		Label:     label,
+		Class:     sig.class,
+		Name:      sig.name,
+		Flavor:    sig.flavor,
+		Generic:   sig.generic,
+		Quality:   quality,
+		Signature: sig.raw,
+		Distance:  ittl - pack.IP.TTL,
+	}
+}
@@ -0,0 +1,192 @@
+package tcp
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+// syn builds the details of a SYN for the signatures in testdata/p0f.fp
+func syn(ttl int, layout string, mss, window, scale int, quirks ...string) types.TCPIPDetails {
+	return types.TCPIPDetails{
+		IP: types.IPDetails{IPVersion: 4, TTL: ttl, HDRLength: 20},
+		TCP: types.TCPDetails{
+			OptionsOrder: layout,
+			MSS:          mss,
+			Window:       window,
+			WindowScale:  scale,
+			Quirks:       quirks,
+		},
+	}
+}
+
+const linuxLayout = "mss,sok,ts,nop,ws"
+
+func TestOSDatabaseMatch(t *testing.T) {
+	db, err := LoadOSDatabase("testdata/p0f.fp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Len() != 7 {
+		t.Fatalf("loaded %d signatures, want the 7 of [tcp:request]", db.Len())
+	}
+
+	withPayload := syn(250, "mss", 1460, 1024, -1)
+	withPayload.TCP.PayloadLength = 10
+
+	tests := []struct {
+		name     string
+		pack     types.TCPIPDetails
+		quality  string
+		label    string
+		distance int
+	}{
+		{
+			name:     "exact",
+			pack:     syn(57, linuxLayout, 1460, 14600, 7, "df", "id+"),
+			quality:  MatchExact,
+			label:    "Linux 3.11 and newer",
+			distance: 7,
+		},
+		{
+			name:     "exact for another OS",
+			pack:     syn(113, "mss,nop,ws,nop,nop,sok", 1460, 8192, 8, "df", "id+"),
+			quality:  MatchExact,
+			label:    "Windows 7 or 8",
+			distance: 15,
+		},
+		{
+			name:     "generic",
+			pack:     syn(64, linuxLayout, 1460, 29200, 9, "df", "id+"),
+			quality:  MatchGeneric,
+			label:    "Linux 2.2.x-3.x",
+			distance: 0,
+		},
+		{
+			name:     "fuzzy quirks",
+			pack:     syn(57, linuxLayout, 1460, 14600, 7, "df"),
+			quality:  MatchFuzzy,
+			label:    "Linux 3.11 and newer",
+			distance: 7,
+		},
+		{
+			name:     "fuzzy past the max distance",
+			pack:     syn(64-maxDistance-1, linuxLayout, 1460, 14600, 7, "df", "id+"),
+			quality:  MatchFuzzy,
+			label:    "Linux 3.11 and newer",
+			distance: maxDistance + 1,
+		},
+		{
+			name:     "exact at the max distance",
+			pack:     syn(64-maxDistance, linuxLayout, 1460, 14600, 7, "df", "id+"),
+			quality:  MatchExact,
+			label:    "Linux 3.11 and newer",
+			distance: maxDistance,
+		},
+		{
+			name:     "fuzzy above the initial TTL",
+			pack:     syn(100, linuxLayout, 1460, 14600, 7, "df", "id+"),
+			quality:  MatchFuzzy,
+			label:    "Linux 3.11 and newer",
+			distance: 28,
+		},
+		{
+			name:     "ttl plus distance",
+			pack:     syn(118, "mss,nop,nop,sok", 1460, 65535, -1, "df", "id+"),
+			quality:  MatchExact,
+			label:    "Windows XP",
+			distance: 10,
+		},
+		{
+			name:     "bad TTL ignores the max distance",
+			pack:     syn(20, "nop,ws,nop,nop,ts,nop,nop,sok,mss", 1460, 32850, 1, "df", "id+"),
+			quality:  MatchExact,
+			label:    "Solaris 10",
+			distance: 44,
+		},
+		{
+			name:    "bad TTL above the initial TTL",
+			pack:    syn(100, "nop,ws,nop,nop,ts,nop,nop,sok,mss", 1460, 32850, 1, "df", "id+"),
+			quality: MatchNone,
+		},
+		{
+			name:     "wildcard initial TTL",
+			pack:     syn(250, "mss", 1460, 1024, -1),
+			quality:  MatchExact,
+			label:    "NMap SYN scan",
+			distance: 5,
+		},
+		{
+			name:    "payload where none is expected",
+			pack:    withPayload,
+			quality: MatchNone,
+		},
+		{
+			name:    "quirk that isn't fuzzy",
+			pack:    syn(57, linuxLayout, 1460, 14600, 7, "df", "id+", "ts1-"),
+			quality: MatchNone,
+		},
+		{
+			name:    "unknown layout",
+			pack:    syn(57, "mss,nop,ws", 1460, 14600, 7, "df", "id+"),
+			quality: MatchNone,
+		},
+		{
+			name:    "response signatures are skipped",
+			pack:    syn(64, "mss", 1460, 14600, -1, "df"),
+			quality: MatchNone,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			guess := db.Match(tt.pack)
+			if guess.Quality != tt.quality {
+				t.Fatalf("quality = %s, want %s (%+v)", guess.Quality, tt.quality, guess)
+			}
+			if tt.quality == MatchNone {
+				return
+			}
+			if guess.Label != tt.label {
+				t.Errorf("label = %q, want %q", guess.Label, tt.label)
+			}
+			if guess.Generic != (tt.quality == MatchGeneric) {
+				t.Errorf("generic = %v", guess.Generic)
+			}
+			if guess.Distance != tt.distance {
+				t.Errorf("distance = %d, want %d", guess.Distance, tt.distance)
+			}
+		})
+	}
+}
+
+func TestLoadOSDatabaseErrors(t *testing.T) {
+	tests := map[string]string{
+		"no label":          "[tcp:request]\nsig = *:64:0:*:*,*:mss::0\n",
+		"invalid label":     "[tcp:request]\nlabel = x:unix:Linux:\n",
+		"too few fields":    "[tcp:request]\nlabel = s:unix:Linux:\nsig = *:64:0:*:*,*:mss:0\n",
+		"invalid ttl":       "[tcp:request]\nlabel = s:unix:Linux:\nsig = *:64+x:0:*:*,*:mss::0\n",
+		"invalid window":    "[tcp:request]\nlabel = s:unix:Linux:\nsig = *:64:0:*:mss*x,*:mss::0\n",
+		"window w/o scale":  "[tcp:request]\nlabel = s:unix:Linux:\nsig = *:64:0:*:*:mss::0\n",
+		"invalid payload":   "[tcp:request]\nlabel = s:unix:Linux:\nsig = *:64:0:*:*,*:mss::x\n",
+		"line without key":  "[tcp:request]\nlabel\n",
+		"invalid mss field": "[tcp:request]\nlabel = s:unix:Linux:\nsig = *:64:0:x:*,*:mss::0\n",
+	}
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "p0f.fp")
+			if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := LoadOSDatabase(path); err == nil {
+				t.Error("no error")
+			}
+		})
+	}
+
+	if _, err := LoadOSDatabase("testdata/missing.fp"); err == nil {
+		t.Error("no error for a missing file")
+	}
+}
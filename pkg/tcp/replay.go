@@ -0,0 +1,67 @@
+package tcp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/pagpeter/trackme/pkg/server"
+)
+
+// pcapngMagic starts the section header block of pcapng files
+var pcapngMagic = []byte{0x0a, 0x0d, 0x0d, 0x0a}
+
+// ReplayCapture feeds the packets of a pcap or pcapng file to the sniffer as
+// if they were captured live on the ports. The timestamps of the file are
+// kept, so the results only depend on the file.
+func ReplayCapture(path string, tlsPort, httpPort, quicPort int, srv *server.Server) error {
+	filter := captureFilter{
+		tlsPort:      tlsPort,
+		httpPort:     httpPort,
+		quicPort:     quicPort,
+		firstPackets: srv.GetConfig().CaptureFirstPackets,
+	}
+	expression, err := filter.expression()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open capture file: %w", err)
+	}
+	defer f.Close()
+
+	source, err := openCaptureFile(bufio.NewReader(f))
+	if err != nil {
+		return fmt.Errorf("failed to read capture file %s: %w", path, err)
+	}
+	log.Printf("Replaying %s: %s", path, expression)
+	n := handlePackets(srv, source, filter, loadOSDatabase(srv))
+	log.Printf("Replayed %d packets from %s", n, path)
+	return nil
+}
+
+// openCaptureFile reads packets from a pcap or pcapng file
+func openCaptureFile(r *bufio.Reader) (*gopacket.PacketSource, error) {
+	magic, err := r.Peek(len(pcapngMagic))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(magic, pcapngMagic) {
+		ng, err := pcapgo.NewNgReader(r, pcapgo.DefaultNgReaderOptions)
+		if err != nil {
+			return nil, err
+		}
+		return gopacket.NewPacketSource(ng, ng.LinkType()), nil
+	}
+	pcap, err := pcapgo.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return gopacket.NewPacketSource(pcap, pcap.LinkType()), nil
+}
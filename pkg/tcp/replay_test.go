@@ -0,0 +1,70 @@
+package tcp
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/pagpeter/trackme/pkg/server"
+)
+
+// The captures in testdata hold, from 10.0.0.1 to 10.0.0.2:
+//   - a SYN from port 5000 to 443 with MSS, SACK, timestamps and window scale
+//   - the ACK of that connection
+//   - a 1200 byte QUIC datagram from port 6000 to 443
+//   - an ACK without SYN from port 7000 to 443
+func TestReplayCapture(t *testing.T) {
+	for _, file := range []string{"testdata/syn.pcap", "testdata/syn.pcapng"} {
+		t.Run(file, func(t *testing.T) {
+			srv := server.NewServer()
+			srv.GetConfig().CaptureFile = file
+			srv.ConfigureFingerprintStores()
+			if err := ReplayCapture(file, 443, 80, 443, srv); err != nil {
+				t.Fatal(err)
+			}
+
+			syn, ok := srv.GetTCPFingerprints().Lookup("10.0.0.1:5000", 0)
+			if !ok {
+				t.Fatal("no details for the SYN")
+			}
+			if syn.IP.TTL != 57 || syn.IP.IPVersion != 4 || syn.IP.DstIp != "10.0.0.2" {
+				t.Errorf("unexpected IP details: %+v", syn.IP)
+			}
+			if syn.TCP.Window != 64240 || syn.TCP.MSS != 1460 || syn.TCP.WindowScale != 7 || !syn.TCP.SackPermitted {
+				t.Errorf("unexpected TCP details: %+v", syn.TCP)
+			}
+			if syn.TCP.OptionsOrder != "mss,sok,ts,nop,ws" {
+				t.Errorf("options order = %q", syn.TCP.OptionsOrder)
+			}
+			if want := "4:64:0:1460:mss*44,7:mss,sok,ts,nop,ws:df"; syn.Signature != want {
+				t.Errorf("signature = %q, want %q", syn.Signature, want)
+			}
+			if syn.FirstACK != nil {
+				t.Error("first ACK recorded without capturing the first packets")
+			}
+
+			quic, ok := srv.GetUDPFingerprints().Lookup("10.0.0.1:6000", 0)
+			if !ok {
+				t.Fatal("no details for the QUIC datagram")
+			}
+			if quic.UDP == nil || quic.UDP.PayloadLength != 1200 || quic.IP.TTL != 57 {
+				t.Errorf("unexpected UDP details: %+v %+v", quic.IP, quic.UDP)
+			}
+
+			if _, ok := srv.GetTCPFingerprints().Lookup("10.0.0.1:7000", 0); ok {
+				t.Error("ACK without SYN was recorded")
+			}
+
+			// Replayed fingerprints are kept until they are evicted by size
+			if ttl := srv.GetTCPFingerprints().Stats().TTLSeconds; ttl >= 0 {
+				t.Errorf("TTL of replayed fingerprints = %vs, want none", ttl)
+			}
+		})
+	}
+}
+
+func TestReplayCaptureWithoutPorts(t *testing.T) {
+	err := ReplayCapture("testdata/syn.pcap", 0, 0, 0, server.NewServer())
+	if !errors.Is(err, errNoCapturePorts) {
+		t.Fatalf("err = %v, want %v", err, errNoCapturePorts)
+	}
+}
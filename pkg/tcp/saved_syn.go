@@ -0,0 +1,99 @@
+package tcp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/pagpeter/trackme/pkg/server"
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+// SavedSYNSource fingerprints TCP connections with the SYN the kernel saved for
+// them (TCP_SAVE_SYN). Unlike SniffTCP it needs no libpcap, capture device or
+// root privileges, and the SYN is stored before the connection is handled.
+type SavedSYNSource struct {
+	srv  *server.Server
+	osDB *OSDatabase
+}
+
+// NewSavedSYNSource creates a saved SYN source storing into srv's TCP fingerprints
+func NewSavedSYNSource(srv *server.Server) *SavedSYNSource {
+	return &SavedSYNSource{
+		srv:  srv,
+		osDB: loadOSDatabase(srv),
+	}
+}
+
+// Listen listens on a TCP address with TCP_SAVE_SYN set, and stores the SYN of
+// every accepted connection
+func (s *SavedSYNSource) Listen(network, address string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: setSaveSYN}
+	listener, err := lc.Listen(context.Background(), network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &savedSYNListener{Listener: listener, source: s}, nil
+}
+
+type savedSYNListener struct {
+	net.Listener
+	source *SavedSYNSource
+}
+
+func (l *savedSYNListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		if err := l.source.store(tcpConn); err != nil {
+			server.Log(fmt.Sprintf("No saved SYN for %s: %v", conn.RemoteAddr(), err))
+		}
+	}
+	return conn, nil
+}
+
+// store reads the saved SYN of a connection and stores its details
+func (s *SavedSYNSource) store(conn *net.TCPConn) error {
+	syn, err := getSavedSYN(conn)
+	if err != nil {
+		return err
+	}
+	pack, err := parseSavedSYN(syn)
+	if err != nil {
+		return err
+	}
+	if s.osDB != nil {
+		pack.OS = s.osDB.Match(pack)
+	}
+	if len(pack.TS) > 0 {
+		// The SYN arrived one round trip before the connection was accepted
+		pack.Clock = trackClock(s.srv, pack.IP.SrcIP, time.Now(), uint32(pack.TS[0]))
+	}
+	s.srv.GetTCPFingerprints().Store(conn.RemoteAddr().String(), pack)
+	return nil
+}
+
+// parseSavedSYN parses a saved SYN, which starts at the IP header
+func parseSavedSYN(syn []byte) (types.TCPIPDetails, error) {
+	if len(syn) == 0 {
+		return types.TCPIPDetails{}, fmt.Errorf("empty saved SYN")
+	}
+	first := layers.LayerTypeIPv4
+	if syn[0]>>4 == 6 {
+		first = layers.LayerTypeIPv6
+	}
+	packet := gopacket.NewPacket(syn, first, gopacket.Default)
+	ip := parseIP(packet)
+	tcpLayer := packet.Layer(layers.LayerTypeTCP)
+	if ip == nil || tcpLayer == nil {
+		return types.TCPIPDetails{}, fmt.Errorf("failed to parse saved SYN of %d bytes", len(syn))
+	}
+	pack := parseTCP(packet, *ip, tcpLayer.(*layers.TCP))
+	pack.CapLen = len(syn)
+	return pack, nil
+}
@@ -0,0 +1,48 @@
+package tcp
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxSavedSYNLength fits the largest IPv6 and TCP headers
+const maxSavedSYNLength = 512
+
+// setSaveSYN makes the kernel keep the SYN of connections to a listening socket
+func setSaveSYN(_, _ string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_SAVE_SYN, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// getSavedSYN returns the IP and TCP headers of the SYN of a connection. The
+// kernel frees them after the first read.
+func getSavedSYN(conn *net.TCPConn) ([]byte, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxSavedSYNLength)
+	length := uint32(len(buf))
+	var errno syscall.Errno
+	err = raw.Control(func(fd uintptr) {
+		// unix.GetsockoptString would cut the headers at the first zero byte
+		_, _, errno = unix.Syscall6(unix.SYS_GETSOCKOPT, fd, unix.IPPROTO_TCP, unix.TCP_SAVED_SYN,
+			uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&length)), 0)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if errno != 0 {
+		return nil, errno
+	}
+	return buf[:length], nil
+}
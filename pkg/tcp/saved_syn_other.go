@@ -0,0 +1,19 @@
+//go:build !linux
+
+package tcp
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+var errSavedSYNUnsupported = errors.New("TCP_SAVED_SYN is only supported on Linux")
+
+func setSaveSYN(_, _ string, _ syscall.RawConn) error {
+	return errSavedSYNUnsupported
+}
+
+func getSavedSYN(_ *net.TCPConn) ([]byte, error) {
+	return nil, errSavedSYNUnsupported
+}
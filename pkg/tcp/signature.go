@@ -0,0 +1,75 @@
+package tcp
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+	"github.com/pagpeter/trackme/pkg/types"
+	"github.com/pagpeter/trackme/pkg/utils"
+)
+
+// getQuirks returns the p0f quirks of a packet: unusual values in the IP and
+// TCP headers that tell network stacks apart
+func getQuirks(ip types.IPDetails, tcp *layers.TCP, opts tcpOptions) []string {
+	var quirks []string
+	add := func(cond bool, quirk string) {
+		if cond {
+			quirks = append(quirks, quirk)
+		}
+	}
+	if ip.IPVersion == 4 {
+		add(ip.DF == 1, "df")
+		add(ip.DF == 1 && ip.ID != 0, "id+")
+		add(ip.DF == 0 && ip.ID == 0, "id-")
+	}
+	add(ip.TOS&0x3 != 0 || tcp.ECE || tcp.CWR || tcp.NS, "ecn")
+	add(ip.RF == 1, "0+")
+	add(ip.IPVersion == 6 && ip.FlowLabel != 0, "flow")
+	add(tcp.Seq == 0, "seq-")
+	add(!tcp.ACK && tcp.Ack != 0, "ack+")
+	add(tcp.ACK && tcp.Ack == 0, "ack-")
+	add(!tcp.URG && tcp.Urgent != 0, "uptr+")
+	add(tcp.URG, "urgf+")
+	add(tcp.PSH, "pushf+")
+	add(opts.hasTimestamps && opts.tsVal == 0, "ts1-")
+	add(opts.hasTimestamps && opts.tsEcr != 0 && tcp.SYN && !tcp.ACK, "ts2+")
+	add(opts.trailingData, "opt+")
+	add(opts.windowScale > 14, "exws")
+	add(opts.malformed, "bad")
+	return quirks
+}
+
+// getSignature builds a p0f-style signature of a packet:
+//
+//	ver:ittl:olen:mss:wsize,scale:olayout:quirks
+//
+// The window size is written as a multiple of the MSS if possible, a missing
+// MSS is written as "*" and a missing window scale as 0.
+func getSignature(ip types.IPDetails, tcp *layers.TCP, opts tcpOptions, quirks []string) string {
+	olen := 0
+	if ip.IPVersion == 4 && ip.HDRLength > 20 {
+		olen = ip.HDRLength - 20
+	}
+
+	mss := "*"
+	if opts.mss >= 0 {
+		mss = fmt.Sprint(opts.mss)
+	}
+	wsize := fmt.Sprint(tcp.Window)
+	if opts.mss > 0 && tcp.Window > 0 && int(tcp.Window)%opts.mss == 0 {
+		wsize = fmt.Sprintf("mss*%d", int(tcp.Window)/opts.mss)
+	}
+	scale := max(opts.windowScale, 0)
+
+	return fmt.Sprintf("%d:%d:%d:%s:%s,%d:%s:%s",
+		ip.IPVersion,
+		utils.GuessInitialTTL(ip.TTL),
+		olen,
+		mss,
+		wsize,
+		scale,
+		strings.Join(opts.layout, ","),
+		strings.Join(quirks, ","),
+	)
+}
@@ -0,0 +1,122 @@
+package tcp
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+func TestGetSignature(t *testing.T) {
+	linuxOptions := []byte{2, 4, 0x05, 0xb4, 4, 2, 8, 10, 0, 0, 0, 1, 0, 0, 0, 0, 1, 3, 3, 7}
+	tests := []struct {
+		name      string
+		ip        types.IPDetails
+		tcp       layers.TCP
+		options   []byte
+		quirks    []string
+		signature string
+	}{
+		{
+			name:      "linux",
+			ip:        types.IPDetails{IPVersion: 4, TTL: 57, DF: 1, HDRLength: 20},
+			tcp:       layers.TCP{SYN: true, Seq: 1, Window: 64240},
+			options:   linuxOptions,
+			quirks:    []string{"df"},
+			signature: "4:64:0:1460:mss*44,7:mss,sok,ts,nop,ws:df",
+		},
+		{
+			name:      "ipv6 with flow label",
+			ip:        types.IPDetails{IPVersion: 6, TTL: 120, FlowLabel: 1},
+			tcp:       layers.TCP{SYN: true, Seq: 1, Window: 65535},
+			options:   []byte{2, 4, 0x05, 0xa0, 1, 3, 3, 8, 1, 1, 4, 2},
+			quirks:    []string{"flow"},
+			signature: "6:128:0:1440:65535,8:mss,nop,ws,nop,nop,sok:flow",
+		},
+		{
+			name:      "no options",
+			ip:        types.IPDetails{IPVersion: 4, TTL: 250, ID: 1, HDRLength: 24},
+			tcp:       layers.TCP{SYN: true, Seq: 1, Window: 1024},
+			quirks:    nil,
+			signature: "4:255:4:*:1024,0::",
+		},
+		{
+			name:      "eol with padding",
+			ip:        types.IPDetails{IPVersion: 4, TTL: 64, ID: 0},
+			tcp:       layers.TCP{SYN: true, Seq: 1, Window: 2920},
+			options:   []byte{2, 4, 0x05, 0xb4, 0, 0, 0},
+			quirks:    []string{"id-"},
+			signature: "4:64:0:1460:mss*2,0:mss,eol+2:id-",
+		},
+		{
+			name:      "trailing data after eol",
+			ip:        types.IPDetails{IPVersion: 4, TTL: 64, DF: 1},
+			tcp:       layers.TCP{SYN: true, Seq: 1, Window: 1000},
+			options:   []byte{2, 4, 0x05, 0xb4, 0, 1, 0},
+			quirks:    []string{"df", "opt+"},
+			signature: "4:64:0:1460:1000,0:mss,eol+2:df,opt+",
+		},
+		{
+			name:      "excessive window scale",
+			ip:        types.IPDetails{IPVersion: 4, TTL: 64, DF: 1},
+			tcp:       layers.TCP{SYN: true, Seq: 1, Window: 1000},
+			options:   []byte{3, 3, 15},
+			quirks:    []string{"df", "exws"},
+			signature: "4:64:0:*:1000,15:ws:df,exws",
+		},
+		{
+			name:      "zero timestamp",
+			ip:        types.IPDetails{IPVersion: 4, TTL: 64, DF: 1},
+			tcp:       layers.TCP{SYN: true, Seq: 1, Window: 1000},
+			options:   []byte{8, 10, 0, 0, 0, 0, 0, 0, 0, 0},
+			quirks:    []string{"df", "ts1-"},
+			signature: "4:64:0:*:1000,0:ts:df,ts1-",
+		},
+		{
+			name:      "echoed timestamp in a SYN",
+			ip:        types.IPDetails{IPVersion: 4, TTL: 64, DF: 1},
+			tcp:       layers.TCP{SYN: true, Seq: 1, Window: 1000},
+			options:   []byte{8, 10, 0, 0, 0, 1, 0, 0, 0, 2},
+			quirks:    []string{"df", "ts2+"},
+			signature: "4:64:0:*:1000,0:ts:df,ts2+",
+		},
+		{
+			name:    "echoed timestamp in a SYN+ACK",
+			ip:      types.IPDetails{IPVersion: 4, TTL: 64, DF: 1},
+			tcp:     layers.TCP{SYN: true, ACK: true, Seq: 1, Ack: 1, Window: 1000},
+			options: []byte{8, 10, 0, 0, 0, 1, 0, 0, 0, 2},
+			quirks:  []string{"df"},
+			// A SYN+ACK echoes the timestamp of the SYN, so ts2+ only applies to SYNs
+			signature: "4:64:0:*:1000,0:ts:df",
+		},
+		{
+			name:      "malformed options",
+			ip:        types.IPDetails{IPVersion: 4, TTL: 64, DF: 1},
+			tcp:       layers.TCP{SYN: true, Seq: 1, Window: 1000},
+			options:   []byte{2, 4, 0x05, 0xb4, 4, 0},
+			quirks:    []string{"df", "bad"},
+			signature: "4:64:0:1460:1000,0:mss:df,bad",
+		},
+		{
+			name:      "odd header fields",
+			ip:        types.IPDetails{IPVersion: 4, TTL: 64, DF: 1, ID: 7, RF: 1, TOS: 1},
+			tcp:       layers.TCP{SYN: true, Seq: 0, Ack: 5, Urgent: 1, PSH: true, Window: 1000},
+			quirks:    []string{"df", "id+", "ecn", "0+", "seq-", "ack+", "uptr+", "pushf+"},
+			signature: "4:64:0:*:1000,0::df,id+,ecn,0+,seq-,ack+,uptr+,pushf+",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := parseTCPOptions(tt.options)
+			quirks := getQuirks(tt.ip, &tt.tcp, opts)
+			if !slices.Equal(quirks, tt.quirks) {
+				t.Errorf("quirks = %q, want %q", quirks, tt.quirks)
+			}
+			if sig := getSignature(tt.ip, &tt.tcp, opts, quirks); sig != tt.signature {
+				t.Errorf("signature = %q, want %q", sig, tt.signature)
+			}
+		})
+	}
+}
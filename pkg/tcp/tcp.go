@@ -4,23 +4,16 @@ import (
 	"log"
 	"net"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 	"github.com/pagpeter/trackme/pkg/server"
 	"github.com/pagpeter/trackme/pkg/types"
 )
 
-// TCP packet capture variables
-var (
-	snapshot_len int32         = 1024
-	promiscuous  bool          = false
-	timeout      time.Duration = 1 * time.Millisecond
-	handle       *pcap.Handle
-)
-
 func parseIP(packet gopacket.Packet) *types.IPDetails {
 	if ipLayer := packet.Layer(layers.LayerTypeIPv4); ipLayer == nil {
 		if ipLayer := packet.Layer(layers.LayerTypeIPv6); ipLayer == nil {
@@ -32,6 +25,10 @@ func parseIP(packet gopacket.Packet) *types.IPDetails {
 				DstIp:     ip.DstIP.String(),
 				SrcIP:     ip.SrcIP.String(),
 				TTL:       int(ip.HopLimit),
+				TOS:       int(ip.TrafficClass),
+				FlowLabel: int(ip.FlowLabel),
+				NXT:       int(ip.NextHeader),
+				PLEN:      int(ip.Length),
 				IPVersion: 6,
 			}
 		}
@@ -39,56 +36,247 @@ func parseIP(packet gopacket.Packet) *types.IPDetails {
 		// IPv4
 		ip := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
 		return &types.IPDetails{
-			DstIp:     ip.DstIP.String(),
-			SrcIP:     ip.SrcIP.String(),
-			ID:        int(ip.Id),
-			TOS:       int(ip.TOS),
-			TTL:       int(ip.TTL),
-			IPVersion: 4,
+			DstIp:       ip.DstIP.String(),
+			SrcIP:       ip.SrcIP.String(),
+			ID:          int(ip.Id),
+			TOS:         int(ip.TOS),
+			TTL:         int(ip.TTL),
+			DF:          boolToInt(ip.Flags&layers.IPv4DontFragment != 0),
+			MF:          boolToInt(ip.Flags&layers.IPv4MoreFragments != 0),
+			RF:          boolToInt(ip.Flags&layers.IPv4EvilBit != 0),
+			OFF:         int(ip.FragOffset),
+			HDRLength:   int(ip.IHL) * 4,
+			TotalLength: int(ip.Length),
+			Protocol:    int(ip.Protocol),
+			IPVersion:   4,
 		}
 	}
 }
 
-func SniffTCP(device string, tlsPort int, srv *server.Server) {
-	handle, err := pcap.OpenLive(device, snapshot_len, promiscuous, timeout)
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// loadOSDatabase loads the configured OS database, nil if there is none
+func loadOSDatabase(srv *server.Server) *OSDatabase {
+	path := srv.GetConfig().OSDatabase
+	if path == "" {
+		return nil
+	}
+	osDB, err := LoadOSDatabase(path)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer handle.Close()
+	log.Printf("Loaded %d OS signatures from %s", osDB.Len(), path)
+	return osDB
+}
+
+// captureStatsInterval is how often the capture counters are updated
+const captureStatsInterval = 10 * time.Second
+
+// SniffTCP records the TCP/IP details of clients connecting to the TLS and the
+// plain HTTP port (0 if a SavedSYNSource is used instead), and the IP details
+// of the first datagram HTTP/3 clients send to the QUIC port (0 if QUIC is
+// disabled). device is a comma separated list of devices, or "any".
+func SniffTCP(device string, tlsPort, httpPort, quicPort int, srv *server.Server) {
+	osDB := loadOSDatabase(srv)
+	filter := captureFilter{
+		tlsPort:      tlsPort,
+		httpPort:     httpPort,
+		quicPort:     quicPort,
+		firstPackets: srv.GetConfig().CaptureFirstPackets,
+	}
+	expression, err := filter.expression()
+	if err != nil {
+		log.Printf("Not capturing on %s: %v", device, err)
+		return
+	}
 
-	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
-	for packet := range packetSource.Packets() {
+	var wg sync.WaitGroup
+	for _, d := range getDevices(device) {
+		handle, err := openCapture(srv.GetConfig().CaptureBackend, d, filter)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Capturing on %s: %s", d, expression)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer handle.Close()
+			done := make(chan struct{})
+			defer close(done)
+			go reportCaptureStats(srv, handle, done)
+			handlePackets(srv, handle.PacketSource(), filter, osDB)
+		}()
+	}
+	wg.Wait()
+}
+
+// reportCaptureStats updates the capture counters of a device until done is
+// closed, and logs when the kernel dropped packets
+func reportCaptureStats(srv *server.Server, handle captureHandle, done chan struct{}) {
+	ticker := time.NewTicker(captureStatsInterval)
+	defer ticker.Stop()
+	var dropped uint64
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		stats, err := handle.Stats()
+		if err != nil {
+			continue
+		}
+		if stats.Dropped+stats.InterfaceDropped > dropped {
+			log.Printf("Capture on %s dropped %d packets", stats.Device, stats.Dropped+stats.InterfaceDropped-dropped)
+			dropped = stats.Dropped + stats.InterfaceDropped
+		}
+		srv.GetCaptureStats().Store(stats.Device, stats)
+	}
+}
+
+// handlePackets stores the details of the captured packets and returns how
+// many it read. Live captures are already filtered by the kernel, the checks
+// here are for replayed files and filters that could not look past IPv6
+// extension headers.
+func handlePackets(srv *server.Server, source *gopacket.PacketSource, filter captureFilter, osDB *OSDatabase) int {
+	n := 0
+	for packet := range source.Packets() {
+		n++
 		if tcpLayer := packet.Layer(layers.LayerTypeTCP); tcpLayer != nil {
 			ip := parseIP(packet)
 			tcp := tcpLayer.(*layers.TCP)
-			if !tcp.ACK || int(tcp.DstPort) != tlsPort || ip.IPVersion == 0 {
+			dstPort := int(tcp.DstPort)
+			if dstPort == 0 || (dstPort != filter.tlsPort && dstPort != filter.httpPort) || ip == nil || tcp.RST {
+				continue
+			}
+			if !tcp.SYN && !filter.firstPackets {
+				continue
+			}
+			storeTCPPacket(srv, parseTCP(packet, *ip, tcp), tcp, packet.Metadata().Timestamp, osDB)
+		} else if udpLayer := packet.Layer(layers.LayerTypeUDP); udpLayer != nil && filter.quicPort != 0 {
+			udp := udpLayer.(*layers.UDP)
+			if int(udp.DstPort) != filter.quicPort {
+				continue
+			}
+			ip := parseIP(packet)
+			if ip == nil {
 				continue
 			}
 
 			pack := types.TCPIPDetails{
 				CapLen:  packet.Metadata().CaptureLength,
-				DstPort: int(tcp.DstPort),
-				SrcPort: int(tcp.SrcPort),
+				DstPort: int(udp.DstPort),
+				SrcPort: int(udp.SrcPort),
 				IP:      *ip,
-				TCP: types.TCPDetails{
-					Ack:          int(tcp.Ack),
-					Checksum:     int(tcp.Checksum),
-					Options:      parseTCPOptions(tcp.Options),
-					OptionsOrder: parseTCPOptionsOrder(tcp.Options),
-					Seq:          int(tcp.Seq),
-					Window:       int(tcp.Window),
+				UDP: &types.UDPDetails{
+					Length: int(udp.Length),
+					// The datagram may be cut off by the snap length
+					PayloadLength: int(udp.Length) - 8,
+					Checksum:      int(udp.Checksum),
 				},
 			}
+			// Only the first datagram of a client is kept, later ones are smaller and padded differently
 			src := net.JoinHostPort(pack.IP.SrcIP, strconv.Itoa(pack.SrcPort))
+			srv.GetUDPFingerprints().LoadOrStore(src, pack)
+		}
+	}
+	return n
+}
+
+// storeTCPPacket keeps the SYN of every connection, which is what the
+// fingerprint and the OS guess are taken from. The client's first ACK and first data segment are
+// added to it, every other packet is ignored.
+func storeTCPPacket(srv *server.Server, pack types.TCPIPDetails, tcp *layers.TCP, at time.Time, osDB *OSDatabase) {
+	src := net.JoinHostPort(pack.IP.SrcIP, strconv.Itoa(pack.SrcPort))
+	if tcp.SYN {
+		if !tcp.ACK {
+			if osDB != nil {
+				pack.OS = osDB.Match(pack)
+			}
+			if len(pack.TS) > 0 {
+				pack.Clock = trackClock(srv, pack.IP.SrcIP, at, uint32(pack.TS[0]))
+			}
+			// A new SYN from the same address and port is a new connection
 			srv.GetTCPFingerprints().Store(src, pack)
 		}
+		return
 	}
+
+	// Nothing is updated if the SYN was missed
+	srv.GetTCPFingerprints().Update(src, func(syn *types.TCPIPDetails) bool {
+		switch {
+		case pack.TCP.PayloadLength == 0 && syn.FirstACK == nil && syn.FirstData == nil:
+			syn.FirstACK = &pack
+		case pack.TCP.PayloadLength > 0 && syn.FirstData == nil:
+			syn.FirstData = &pack
+		default:
+			return false
+		}
+		return true
+	})
 }
 
-func parseTCPOptions(_ []layers.TCPOption) string {
-	return ""
+// parseTCP collects the TCP/IP details of a TCP packet
+func parseTCP(packet gopacket.Packet, ip types.IPDetails, tcp *layers.TCP) types.TCPIPDetails {
+	var opts tcpOptions
+	if headerLen := int(tcp.DataOffset) * 4; headerLen > 20 && len(tcp.Contents) >= headerLen {
+		opts = parseTCPOptions(tcp.Contents[20:headerLen])
+	} else {
+		opts = parseTCPOptions(nil)
+	}
+	quirks := getQuirks(ip, tcp, opts)
+
+	details := types.TCPIPDetails{
+		CapLen:    packet.Metadata().CaptureLength,
+		DstPort:   int(tcp.DstPort),
+		SrcPort:   int(tcp.SrcPort),
+		HeaderLen: int(tcp.DataOffset) * 4,
+		IP:        ip,
+		TCP: types.TCPDetails{
+			Ack:           int(tcp.Ack),
+			Checksum:      int(tcp.Checksum),
+			Flags:         tcpFlags(tcp),
+			HeaderLength:  int(tcp.DataOffset) * 4,
+			OFF:           int(tcp.DataOffset),
+			Options:       strings.Join(opts.values, ","),
+			OptionsOrder:  strings.Join(opts.layout, ","),
+			Seq:           int(tcp.Seq),
+			URP:           int(tcp.Urgent),
+			Window:        int(tcp.Window),
+			WindowScale:   opts.windowScale,
+			SackPermitted: opts.sackPermitted,
+			SackBlocks:    opts.sackBlocks,
+			Quirks:        quirks,
+			PayloadLength: len(tcp.Payload),
+		},
+	}
+	if tcp.SYN {
+		details.Signature = getSignature(ip, tcp, opts, quirks)
+	}
+	if opts.mss >= 0 {
+		details.TCP.MSS = opts.mss
+	}
+	if opts.hasTimestamps {
+		details.TCP.Timestamp = int(opts.tsVal)
+		details.TCP.TimestampEchoReply = int(opts.tsEcr)
+		details.TS = []int{int(opts.tsVal), int(opts.tsEcr)}
+	}
+	return details
 }
 
-func parseTCPOptionsOrder(_ []layers.TCPOption) string {
-	return ""
+// tcpFlags returns the flags of a TCP header as a number, CWR being the highest bit
+func tcpFlags(tcp *layers.TCP) int {
+	flags := 0
+	for i, set := range []bool{tcp.FIN, tcp.SYN, tcp.RST, tcp.PSH, tcp.ACK, tcp.URG, tcp.ECE, tcp.CWR} {
+		if set {
+			flags |= 1 << i
+		}
+	}
+	return flags
 }
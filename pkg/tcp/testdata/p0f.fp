@@ -0,0 +1,27 @@
+; A few signatures in the format of p0f.fp, for the tests of OSDatabase
+
+[tcp:request]
+
+label = s:unix:Linux:3.11 and newer
+sig   = *:64:0:*:mss*20,10:mss,sok,ts,nop,ws:df,id+:0
+sig   = *:64:0:*:mss*10,7:mss,sok,ts,nop,ws:df,id+:0
+
+label = g:unix:Linux:2.2.x-3.x
+sig   = *:64:0:*:*,*:mss,sok,ts,nop,ws:df,id+:0
+
+label = s:win:Windows:7 or 8
+sig   = *:128:0:*:8192,8:mss,nop,ws,nop,nop,sok:df,id+:0
+
+label = s:win:Windows:XP
+sig   = *:120+8:0:*:65535,0:mss,nop,nop,sok:df,id+:0
+
+label = s:unix:Solaris:10
+sig   = *:64-:0:*:32850,1:nop,ws,nop,nop,ts,nop,nop,sok,mss:df,id+:0
+
+label = s:!:NMap:SYN scan
+sig   = *:*:0:1460:1024,0:mss::0
+
+[tcp:response]
+
+label = s:unix:Linux:3.x
+sig   = *:64:0:*:mss*10,0:mss:df:0
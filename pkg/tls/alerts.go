@@ -0,0 +1,108 @@
+package tls
+
+import (
+	"fmt"
+	"strings"
+)
+
+// alertDescriptions are the names of the TLS alerts
+var alertDescriptions = map[int]string{
+	0:   "close_notify",
+	10:  "unexpected_message",
+	20:  "bad_record_mac",
+	21:  "decryption_failed",
+	22:  "record_overflow",
+	30:  "decompression_failure",
+	40:  "handshake_failure",
+	41:  "no_certificate",
+	42:  "bad_certificate",
+	43:  "unsupported_certificate",
+	44:  "certificate_revoked",
+	45:  "certificate_expired",
+	46:  "certificate_unknown",
+	47:  "illegal_parameter",
+	48:  "unknown_ca",
+	49:  "access_denied",
+	50:  "decode_error",
+	51:  "decrypt_error",
+	60:  "export_restriction",
+	70:  "protocol_version",
+	71:  "insufficient_security",
+	80:  "internal_error",
+	86:  "inappropriate_fallback",
+	90:  "user_canceled",
+	100: "no_renegotiation",
+	109: "missing_extension",
+	110: "unsupported_extension",
+	111: "certificate_unobtainable",
+	112: "unrecognized_name",
+	113: "bad_certificate_status_response",
+	114: "bad_certificate_hash_value",
+	115: "unknown_psk_identity",
+	116: "certificate_required",
+	120: "no_application_protocol",
+}
+
+// GetAlertDescription returns the name of a TLS alert
+func GetAlertDescription(code int) string {
+	if description, ok := alertDescriptions[code]; ok {
+		return description
+	}
+	return fmt.Sprintf("unknown_%d", code)
+}
+
+// alertMessages are the texts of the alert errors of utls, whose alert type is
+// unexported
+var alertMessages = map[string]int{
+	"close notify":                    0,
+	"unexpected message":              10,
+	"bad record MAC":                  20,
+	"decryption failed":               21,
+	"record overflow":                 22,
+	"decompression failure":           30,
+	"handshake failure":               40,
+	"bad certificate":                 42,
+	"unsupported certificate":         43,
+	"revoked certificate":             44,
+	"expired certificate":             45,
+	"unknown certificate":             46,
+	"illegal parameter":               47,
+	"unknown certificate authority":   48,
+	"access denied":                   49,
+	"error decoding message":          50,
+	"error decrypting message":        51,
+	"export restriction":              60,
+	"protocol version not supported":  70,
+	"insufficient security level":     71,
+	"internal error":                  80,
+	"inappropriate fallback":          86,
+	"user canceled":                   90,
+	"no renegotiation":                100,
+	"missing extension":               109,
+	"unsupported extension":           110,
+	"certificate unobtainable":        111,
+	"unrecognized name":               112,
+	"bad certificate status response": 113,
+	"bad certificate hash value":      114,
+	"unknown PSK identity":            115,
+	"certificate required":            116,
+	"no application protocol":         120,
+}
+
+// GetAlertCode returns the code of a utls alert error, like the Err of the
+// net.OpError a connection fails with when an alert was sent or received
+func GetAlertCode(err error) (int, bool) {
+	text, ok := strings.CutPrefix(err.Error(), "tls: ")
+	if !ok {
+		return 0, false
+	}
+	if code, ok := alertMessages[text]; ok {
+		return code, true
+	}
+	// Alerts without a text
+	var code int
+	if _, err := fmt.Sscanf(text, "alert(%d)", &code); err == nil {
+		return code, true
+	}
+	return 0, false
+}
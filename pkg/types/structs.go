@@ -26,16 +26,107 @@ type TLSDetails struct {
 	SessionID    string `json:"session_id"`
 	RawBytes     string `json:"-"`
 	RawB64       string `json:"-"`
+
+	// HandshakeRTTMs is the time between the server's first flight and the client's answer
+	HandshakeRTTMs float64 `json:"handshake_rtt_ms,omitempty"`
 }
 
 type Http1Details struct {
-	Headers []string `json:"headers"`
+	RequestLine string   `json:"request_line"`
+	Headers     []string `json:"headers"`
+	// LineEndings is "crlf", "lf" or "mixed"
+	LineEndings string   `json:"line_endings"`
+	Anomalies   []string `json:"anomalies"`
+	// HeaderOrder is the comma separated list of lowercased header names, as sent
+	HeaderOrder     string        `json:"header_order"`
+	HeaderOrderHash string        `json:"header_order_hash"`
+	Raw             string        `json:"raw"`
+	History         *Http1History `json:"connection,omitempty"`
+}
+
+// Http1History relates a request to the previous one on the same keep-alive connection
+type Http1History struct {
+	RequestIndex       int      `json:"request_index"`
+	SincePreviousMs    float64  `json:"since_previous_ms,omitempty"`
+	HeaderOrderChanged bool     `json:"header_order_changed"`
+	AddedHeaders       []string `json:"added_headers,omitempty"`
+	RemovedHeaders     []string `json:"removed_headers,omitempty"`
 }
 
 type Http2Details struct {
 	AkamaiFingerprint     string        `json:"akamai_fingerprint"`
 	AkamaiFingerprintHash string        `json:"akamai_fingerprint_hash"`
 	SendFrames            []ParsedFrame `json:"sent_frames"`
+	Probe                 *Http2Probe   `json:"probe,omitempty"`
+	ServerProfile         string        `json:"server_profile"`
+	// WindowUpdates are the WINDOW_UPDATEs the client sent before the response was built
+	WindowUpdates []Http2WindowUpdate `json:"window_updates"`
+	// ResponseToken is passed as h2_token on the next request to get how
+	// the client read this response in its PreviousResponse
+	ResponseToken string `json:"response_token,omitempty"`
+	// PreviousResponse describes how the client read the response whose token the request carried
+	PreviousResponse *Http2SentResponse `json:"previous_response,omitempty"`
+}
+
+// Http2WindowUpdate is a WINDOW_UPDATE frame received from the client
+type Http2WindowUpdate struct {
+	Stream          uint32  `json:"stream_id"`
+	Increment       uint32  `json:"increment"`
+	ReceivedAfterMs float64 `json:"received_after_ms"`
+}
+
+// Http2SentResponse describes the sending of a response body. The times of
+// the WINDOW_UPDATEs are relative to the first DATA frame.
+type Http2SentResponse struct {
+	Size          int                 `json:"size"`
+	SentBytes     int                 `json:"sent_bytes"`
+	WindowUpdates []Http2WindowUpdate `json:"window_updates"`
+	Error         string              `json:"error,omitempty"`
+}
+
+// Http2Probe describes how the client reacted to the frames sent in probe mode
+type Http2Probe struct {
+	PingAcked            bool              `json:"ping_acked"`
+	PingAckLatencyMs     float64           `json:"ping_ack_latency_ms,omitempty"`
+	SettingsAcked        bool              `json:"settings_acked"`
+	SettingsAckLatencyMs float64           `json:"settings_ack_latency_ms,omitempty"`
+	WindowUpdates        []float64         `json:"window_updates_ms,omitempty"`
+	ResetStream          bool              `json:"reset_stream"`
+	ReceivedFrames       []Http2ProbeFrame `json:"received_frames"`
+	// Window is only probed for requests with a body
+	Window *Http2WindowProbe `json:"window,omitempty"`
+}
+
+// Http2WindowProbe describes how the client paced the DATA of its request body
+// against a small connection window
+type Http2WindowProbe struct {
+	InitialWindow  int64              `json:"initial_window"`
+	DataFrames     []Http2ProbeData   `json:"data_frames"`
+	Refills        []Http2ProbeRefill `json:"refills,omitempty"`
+	ExceededWindow bool               `json:"exceeded_window"`
+}
+
+// Http2ProbeData is a DATA frame of a probed body, with the connection window
+// the client had left before sending it
+type Http2ProbeData struct {
+	Size            int     `json:"size"`
+	WindowBefore    int64   `json:"window_before"`
+	ReceivedAfterMs float64 `json:"received_after_ms"`
+}
+
+// Http2ProbeRefill is a WINDOW_UPDATE the server sent to let a probed body
+// continue, because the window was "exhausted" or the client "stalled" with
+// window left
+type Http2ProbeRefill struct {
+	SentAfterMs  float64 `json:"sent_after_ms"`
+	WindowBefore int64   `json:"window_before"`
+	Reason       string  `json:"reason"`
+}
+
+// Http2ProbeFrame is a frame received while probing, with its arrival time relative to the probe start
+type Http2ProbeFrame struct {
+	ParsedFrame
+	ReceivedAfterMs float64 `json:"received_after_ms"`
 }
 
 type Http3Details struct {
@@ -48,6 +139,163 @@ type Http3Details struct {
 	AkamaiFingerprint                  string             `json:"akamai_fingerprint"`
 	AkamaiFingerprintHash              string             `json:"akamai_fingerprint_hash"`
 	Headers                            []string           `json:"headers,omitempty"`
+	HeaderFields                       []Http3HeaderField `json:"header_fields,omitempty"`
+	Streams                            []Http3Stream      `json:"streams,omitempty"`
+	Packets                            []QUICPacket       `json:"packets,omitempty"`
+	QUICInitial                        *QUICInitial       `json:"quic_initial,omitempty"`
+	Probe                              *QUICProbe         `json:"probe,omitempty"`
+}
+
+// QUICProbe is how the client reacted to the probe of the HTTP/3 server it connected to
+type QUICProbe struct {
+	// Mode is "retry", "version_negotiation" or "hello_retry_request"
+	Mode               string               `json:"mode"`
+	Retry              *QUICRetryProbe      `json:"retry,omitempty"`
+	VersionNegotiation *QUICVersionProbe    `json:"version_negotiation,omitempty"`
+	HelloRetryRequest  *QUICHelloRetryProbe `json:"hello_retry_request,omitempty"`
+}
+
+// QUICRetryProbe describes how the client answered a Retry packet
+type QUICRetryProbe struct {
+	RetrySent   bool `json:"retry_sent"`
+	TokenLength int  `json:"token_length"`
+	// TokenEchoed is set if the client's next Initial carried the token of the Retry
+	TokenEchoed bool `json:"token_echoed"`
+	// DCIDFromRetry is set if the client used the Retry's source connection ID as destination
+	DCIDFromRetry  bool    `json:"dcid_from_retry"`
+	RetryLatencyMs float64 `json:"retry_latency_ms"`
+}
+
+// QUICVersionProbe describes how the client answered a Version Negotiation packet
+type QUICVersionProbe struct {
+	VersionNegotiationSent bool     `json:"version_negotiation_sent"`
+	OfferedVersion         string   `json:"offered_version"`
+	ServerVersions         []string `json:"server_versions"`
+	ChosenVersion          string   `json:"chosen_version"`
+	// ValidChoice is set if the chosen version was offered by both the client and the server
+	ValidChoice bool `json:"valid_choice"`
+	// ClientVersions are the versions from the client's version_information transport parameter
+	ClientVersions []string `json:"client_versions,omitempty"`
+	RetryLatencyMs float64  `json:"retry_latency_ms"`
+}
+
+// QUICHelloRetryProbe describes how the client answered a HelloRetryRequest
+type QUICHelloRetryProbe struct {
+	KeyShareGroups []string `json:"key_share_groups"`
+	SelectedGroup  string   `json:"selected_group"`
+	// HelloRetryRequest is set if the first ClientHello had no key share for the selected group
+	HelloRetryRequest     bool `json:"hello_retry_request"`
+	FirstClientHelloSize  int  `json:"first_client_hello_size"`
+	SecondClientHelloSize int  `json:"second_client_hello_size,omitempty"`
+}
+
+// QUICInitial describes the client's Initial flight, the datagrams it sent
+// before the server could answer with its handshake
+type QUICInitial struct {
+	Version          string `json:"version"`
+	DCIDLength       int    `json:"dcid_length"`
+	SCIDLength       int    `json:"scid_length"`
+	TokenLength      int    `json:"token_length"`
+	FirstDatagramLen int    `json:"first_datagram_size"`
+	// CryptoPackets is the number of Initial packets the ClientHello was split into
+	CryptoPackets int `json:"crypto_packets"`
+	// CryptoOrder is "sequential" if the CRYPTO frames were sent in offset order, else "reordered"
+	CryptoOrder string `json:"crypto_order"`
+	// Coalesced is set if an Initial packet shared a datagram with other packets
+	Coalesced       bool                  `json:"coalesced"`
+	FrameTypes      []string              `json:"frame_types"`
+	Datagrams       []QUICInitialDatagram `json:"datagrams"`
+	Fingerprint     string                `json:"fingerprint"`
+	FingerprintHash string                `json:"fingerprint_hash"`
+}
+
+// QUICInitialDatagram is a UDP datagram of the Initial flight and the packets coalesced in it
+type QUICInitialDatagram struct {
+	Size            int                 `json:"size"`
+	ReceivedAfterMs float64             `json:"received_after_ms"`
+	Packets         []QUICInitialPacket `json:"packets"`
+	// TrailingBytes are bytes after the last QUIC packet, e.g. padding with zeros
+	TrailingBytes int `json:"trailing_bytes,omitempty"`
+}
+
+// QUICInitialPacket is a long header packet. Initial packets are decrypted, so
+// their frames, including PADDING, are listed in the order they were sent.
+type QUICInitialPacket struct {
+	Type         string   `json:"type"`
+	Size         int      `json:"size"`
+	PacketNumber uint64   `json:"packet_number"`
+	DCIDLength   int      `json:"dcid_length"`
+	SCIDLength   int      `json:"scid_length"`
+	TokenLength  int      `json:"token_length,omitempty"`
+	Frames       []string `json:"frames,omitempty"`
+}
+
+// Http3Stream is a stream opened by the client and the STREAM frames its data arrived in
+type Http3Stream struct {
+	ID int64 `json:"id"`
+	// Type is "request", "control", "push", "qpack_encoder", "qpack_decoder",
+	// "grease" or "unknown"
+	Type string `json:"type"`
+	// StreamType is the type sent at the start of a unidirectional stream
+	StreamType    *uint64            `json:"stream_type,omitempty"`
+	OpenedAfterMs float64            `json:"opened_after_ms"`
+	Size          int64              `json:"size"`
+	Fin           bool               `json:"fin"`
+	Frames        []Http3StreamFrame `json:"frames"`
+	// Http3Frames are the HTTP/3 frames of request and control streams, in order
+	Http3Frames []Http3Frame `json:"http3_frames,omitempty"`
+}
+
+// Http3Frame is an HTTP/3 frame the client sent on one of its streams
+type Http3Frame struct {
+	Type   string `json:"type"`
+	TypeID uint64 `json:"type_id"`
+	Length uint64 `json:"length"`
+	// Settings are the parameters of a SETTINGS frame, in order
+	Settings       []Http3SettingPair   `json:"settings,omitempty"`
+	PriorityUpdate *Http3PriorityUpdate `json:"priority_update,omitempty"`
+	// ID is the stream or push ID of GOAWAY, MAX_PUSH_ID and CANCEL_PUSH frames
+	ID *uint64 `json:"id,omitempty"`
+}
+
+// Http3HeaderField is a field of the request's QPACK-encoded field section,
+// with how the client represented it (RFC 9204, 4.5)
+type Http3HeaderField struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	// Representation is "indexed", "indexed_post_base", "literal_name_ref",
+	// "literal_post_base_name_ref" or "literal"
+	Representation string `json:"representation"`
+	// Table is "static" or "dynamic" if the field or its name is a reference
+	Table string  `json:"table,omitempty"`
+	Index *uint64 `json:"index,omitempty"`
+	// HuffmanName and HuffmanValue tell if the literals were Huffman-coded
+	HuffmanName  bool `json:"huffman_name,omitempty"`
+	HuffmanValue bool `json:"huffman_value,omitempty"`
+	// NeverIndexed is set if intermediaries must not add the field to a dynamic table
+	NeverIndexed bool `json:"never_indexed,omitempty"`
+}
+
+// Http3PriorityUpdate is the content of a PRIORITY_UPDATE frame (RFC 9218, 7.2)
+type Http3PriorityUpdate struct {
+	ElementID uint64 `json:"element_id"`
+	Priority  string `json:"priority"`
+}
+
+// Http3StreamFrame is a single STREAM frame of a client stream
+type Http3StreamFrame struct {
+	Offset          int64   `json:"offset"`
+	Length          int64   `json:"length"`
+	Fin             bool    `json:"fin,omitempty"`
+	ReceivedAfterMs float64 `json:"received_after_ms"`
+}
+
+// QUICPacket is a packet received from the client, with a summary of its frames
+type QUICPacket struct {
+	Type            string   `json:"type"`
+	Size            int      `json:"size"`
+	ReceivedAfterMs float64  `json:"received_after_ms"`
+	Frames          []string `json:"frames"`
 }
 
 // Http3SettingPair represents a single HTTP/3 setting for fingerprinting
@@ -80,6 +328,7 @@ type IPDetails struct {
 	IPVersion   int    `json:"ip_version,omitempty"`
 	DstIp       string `json:"dst_ip,omitempty"`
 	SrcIP       string `json:"src_ip,omitempty"`
+	FlowLabel   int    `json:"flow_label,omitempty"`
 }
 type TCPDetails struct {
 	Ack                int    `json:"ack,omitempty"`
@@ -95,29 +344,268 @@ type TCPDetails struct {
 	TimestampEchoReply int    `json:"timestamp_echo_reply,omitempty"`
 	URP                int    `json:"urp,omitempty"`
 	Window             int    `json:"window,omitempty"`
+	// WindowScale is -1 if the option wasn't sent
+	WindowScale   int         `json:"window_scale"`
+	SackPermitted bool        `json:"sack_permitted,omitempty"`
+	SackBlocks    [][2]uint32 `json:"sack_blocks,omitempty"`
+	Quirks        []string    `json:"quirks,omitempty"`
+	PayloadLength int         `json:"payload_length,omitempty"`
 }
 type TCPIPDetails struct {
-	CapLen    int        `json:"cap_length,omitempty"`
-	DstPort   int        `json:"dst_port,omitempty"`
-	SrcPort   int        `json:"src_port,omitempty"`
-	HeaderLen int        `json:"header_length,omitempty"`
-	TS        []int      `json:"ts,omitempty"`
-	IP        IPDetails  `json:"ip,omitempty"`
-	TCP       TCPDetails `json:"tcp,omitempty"`
+	CapLen    int         `json:"cap_length,omitempty"`
+	DstPort   int         `json:"dst_port,omitempty"`
+	SrcPort   int         `json:"src_port,omitempty"`
+	HeaderLen int         `json:"header_length,omitempty"`
+	TS        []int       `json:"ts,omitempty"`
+	IP        IPDetails   `json:"ip,omitempty"`
+	TCP       TCPDetails  `json:"tcp,omitempty"`
+	UDP       *UDPDetails `json:"udp,omitempty"`
+	// Signature is a p0f-style signature: ver:ittl:olen:mss:wsize,scale:olayout:quirks
+	Signature string `json:"signature,omitempty"`
+	// Clock describes the TCP timestamp clock of the client, if it sent timestamps
+	Clock *TCPClock `json:"tcp_clock,omitempty"`
+	// TCPInfo is the kernel's view of the connection, only set on Linux
+	TCPInfo *TCPInfoDetails `json:"tcp_info,omitempty"`
+	// OS is guessed from the SYN if an OS database is configured
+	OS *OSGuess `json:"os,omitempty"`
+	// The details above are taken from the SYN, the client's following packets are kept separately
+	FirstACK  *TCPIPDetails `json:"first_ack,omitempty"`
+	FirstData *TCPIPDetails `json:"first_data,omitempty"`
+}
+
+// FingerprintStoreStats are the counters of a fingerprint store
+type FingerprintStoreStats struct {
+	Entries    int     `json:"entries"`
+	MaxEntries int     `json:"max_entries"`
+	TTLSeconds float64 `json:"ttl_seconds"`
+	Stores     uint64  `json:"stores"`
+	Hits       uint64  `json:"hits"`
+	// WaitHits were found after waiting for the capture, WaitTimeouts weren't
+	WaitHits         uint64 `json:"wait_hits"`
+	WaitTimeouts     uint64 `json:"wait_timeouts"`
+	Misses           uint64 `json:"misses"`
+	ExpiredEvictions uint64 `json:"expired_evictions"`
+	SizeEvictions    uint64 `json:"size_evictions"`
+}
+
+// HandshakeEvent is a TLS handshake that failed or was aborted by the client,
+// fingerprinted from its ClientHello
+type HandshakeEvent struct {
+	Time  string `json:"time"`
+	IP    string `json:"ip"`
+	Error string `json:"error"`
+	// Alert is the alert that ended the handshake, if there was one
+	Alert *TLSAlert     `json:"alert,omitempty"`
+	TLS   *TLSDetails   `json:"tls"`
+	TCPIP *TCPIPDetails `json:"tcpip,omitempty"`
+}
+
+// TLSAlert is an alert sent during a TLS handshake
+type TLSAlert struct {
+	// SentBy is client or server
+	SentBy      string `json:"sent_by"`
+	Code        int    `json:"code"`
+	Description string `json:"description"`
+}
+
+// CaptureStats are the packet counters of a capture device
+type CaptureStats struct {
+	Device   string `json:"device"`
+	Backend  string `json:"backend"`
+	Received uint64 `json:"received"`
+	// Dropped were dropped by the kernel because we were too slow, InterfaceDropped by the interface
+	Dropped          uint64 `json:"dropped"`
+	InterfaceDropped uint64 `json:"interface_dropped,omitempty"`
+}
+
+// StatsResponse is returned by /api/stats
+type StatsResponse struct {
+	TCPFingerprints FingerprintStoreStats `json:"tcp_fingerprints"`
+	UDPFingerprints FingerprintStoreStats `json:"udp_fingerprints"`
+	Capture         []CaptureStats        `json:"capture,omitempty"`
+	// FailedHandshakes counts the failed TLS handshakes since the start
+	FailedHandshakes int `json:"failed_handshakes"`
+}
+
+// TCPClock is estimated from the TCP timestamps of the SYNs a client IP sent
+// so far. Each host behind the IP has its own clock.
+type TCPClock struct {
+	// ID identifies the clock among those of the IP, ClocksForIP is how many there are
+	ID          int     `json:"id"`
+	ClocksForIP int     `json:"clocks_for_ip"`
+	Samples     int     `json:"samples"`
+	SpanSeconds float64 `json:"span_seconds"`
+	NominalHz   float64 `json:"nominal_hz,omitempty"`
+	MeasuredHz  float64 `json:"measured_hz,omitempty"`
+	SkewPPM     float64 `json:"skew_ppm,omitempty"`
+	// UptimeSeconds assumes the clock started at 0 on boot, which it doesn't if
+	// the OS randomizes timestamp offsets (Linux 4.10 and newer)
+	UptimeSeconds float64 `json:"uptime_seconds,omitempty"`
+}
+
+// TCPInfoDetails holds the TCP_INFO of a connection after the handshake and
+// when the response was sent
+type TCPInfoDetails struct {
+	Handshake *TCPInfo `json:"handshake,omitempty"`
+	Response  *TCPInfo `json:"response,omitempty"`
+}
+
+// TCPInfo is the TCP_INFO of a connection
+type TCPInfo struct {
+	RTTMs    float64 `json:"rtt_ms"`
+	RTTVarMs float64 `json:"rtt_var_ms"`
+	MinRTTMs float64 `json:"min_rtt_ms"`
+	RTOMs    float64 `json:"rto_ms"`
+	// SndMSS is the MSS we send with, RcvMSS the one the client sends with
+	SndMSS int `json:"snd_mss"`
+	RcvMSS int `json:"rcv_mss"`
+	AdvMSS int `json:"adv_mss"`
+	PMTU   int `json:"pmtu"`
+	// SndWScale is the client's window scale, RcvWScale ours
+	SndWScale int `json:"snd_wscale"`
+	RcvWScale int `json:"rcv_wscale"`
+	// ClientWindow is the receive window the client advertised last (Linux 5.19+)
+	ClientWindow    int      `json:"client_window"`
+	SndCwnd         int      `json:"snd_cwnd"`
+	Retransmissions int      `json:"retransmissions"`
+	Lost            int      `json:"lost"`
+	BytesReceived   int      `json:"bytes_received"`
+	BytesAcked      int      `json:"bytes_acked"`
+	SegsIn          int      `json:"segs_in"`
+	SegsOut         int      `json:"segs_out"`
+	Options         []string `json:"options"`
+}
+
+// OSGuess is the operating system a SYN matched in the p0f database
+type OSGuess struct {
+	// Label is the name and flavor, like "Linux 3.11 and newer"
+	Label   string `json:"label,omitempty"`
+	Class   string `json:"class,omitempty"`
+	Name    string `json:"name,omitempty"`
+	Flavor  string `json:"flavor,omitempty"`
+	Generic bool   `json:"generic,omitempty"`
+	// Quality is exact, generic, fuzzy (TTL or some quirks differ) or none
+	Quality   string `json:"quality"`
+	Signature string `json:"signature,omitempty"`
+	// Distance is the number of hops between the client and the server
+	Distance int `json:"distance"`
+}
+
+// UDPDetails describes the first UDP datagram of an HTTP/3 client
+type UDPDetails struct {
+	Length        int `json:"length"`
+	PayloadLength int `json:"payload_length"`
+	Checksum      int `json:"checksum"`
 }
 
 type Response struct {
-	Donate      string        `json:"donate"`
+	Donate      string            `json:"donate"`
+	IP          string            `json:"ip"`
+	HTTPVersion string            `json:"http_version"`
+	Path        string            `json:"-"`
+	Method      string            `json:"method"`
+	UserAgent   string            `json:"user_agent,omitempty"`
+	TLS         *TLSDetails       `json:"tls"`
+	Http1       *Http1Details     `json:"http1,omitempty"`
+	Http2       *Http2Details     `json:"http2,omitempty"`
+	Http3       *Http3Details     `json:"http3,omitempty"`
+	Body        *RequestBody      `json:"body,omitempty"`
+	PlainHTTP   *PlainHTTPDetails `json:"plain_http,omitempty"`
+	TCPIP       TCPIPDetails      `json:"tcpip,omitempty"`
+	// ProxyLikelihood is only returned by /api/all
+	ProxyLikelihood *ProxyLikelihood `json:"proxy_likelihood,omitempty"`
+	// ProxyProtocol is the PROXY header of a trusted load balancer
+	ProxyProtocol *ProxyProtocolDetails `json:"proxy_protocol,omitempty"`
+}
+
+// ProxyProtocolDetails is the PROXY protocol header a load balancer sent in
+// front of the client's connection
+type ProxyProtocolDetails struct {
+	Version int `json:"version"`
+	// Protocol is TCP4, TCP6 or UNKNOWN for v1, and TCP4, UDP6, UNSPEC etc. for v2
+	Protocol string `json:"protocol"`
+	// ProxyAddr is the address of the balancer, SourceAddr the client's
+	ProxyAddr       string `json:"proxy_addr"`
+	SourceAddr      string `json:"source_addr,omitempty"`
+	DestinationAddr string `json:"destination_addr,omitempty"`
+	// ALPN, Authority (the SNI) and UniqueID are taken from the v2 TLVs
+	ALPN      string             `json:"alpn,omitempty"`
+	Authority string             `json:"authority,omitempty"`
+	UniqueID  string             `json:"unique_id,omitempty"`
+	SSL       *ProxyProtocolSSL  `json:"ssl,omitempty"`
+	TLVs      []ProxyProtocolTLV `json:"tlvs,omitempty"`
+}
+
+// ProxyProtocolSSL describes the TLS connection between the client and the
+// load balancer, if the balancer terminated it
+type ProxyProtocolSSL struct {
+	// Client has bit 0 set if the client connected over TLS
+	Client   int    `json:"client"`
+	Verified bool   `json:"verified"`
+	Version  string `json:"version,omitempty"`
+	CN       string `json:"cn,omitempty"`
+	Cipher   string `json:"cipher,omitempty"`
+	SigAlg   string `json:"sig_alg,omitempty"`
+	KeyAlg   string `json:"key_alg,omitempty"`
+}
+
+// ProxyProtocolTLV is a raw v2 TLV, its value hex encoded
+type ProxyProtocolTLV struct {
+	Type  int    `json:"type"`
+	Value string `json:"value"`
+}
+
+// ProxyLikelihood is how likely a client connects through a proxy or VPN,
+// judged from the latency and MTU of its connection and its TTL
+type ProxyLikelihood struct {
+	// Score is 0 to 100, Likelihood is low, medium or high
+	Score      int             `json:"score"`
+	Likelihood string          `json:"likelihood"`
+	Evidence   []ProxyEvidence `json:"evidence"`
+
+	TCPRTTMs    float64 `json:"tcp_rtt_ms,omitempty"`
+	TLSRTTMs    float64 `json:"tls_rtt_ms,omitempty"`
+	H2PingRTTMs float64 `json:"h2_ping_rtt_ms,omitempty"`
+	MSS         int     `json:"mss,omitempty"`
+	TTL         int     `json:"ttl,omitempty"`
+	InitialTTL  int     `json:"initial_ttl,omitempty"`
+	ClaimedOS   string  `json:"claimed_os,omitempty"`
+}
+
+// ProxyEvidence is a signal that points to a proxy or VPN
+type ProxyEvidence struct {
+	Signal string `json:"signal"`
+	Detail string `json:"detail"`
+	Weight int    `json:"weight"`
+}
+
+// PlainHTTPDetails is the request a client made to the plain HTTP port before
+// it was redirected to HTTPS, linked through the redirect token
+type PlainHTTPDetails struct {
 	IP          string        `json:"ip"`
-	HTTPVersion string        `json:"http_version"`
-	Path        string        `json:"-"`
 	Method      string        `json:"method"`
+	Path        string        `json:"path"`
+	HTTPVersion string        `json:"http_version"`
 	UserAgent   string        `json:"user_agent,omitempty"`
-	TLS         *TLSDetails   `json:"tls"`
-	Http1       *Http1Details `json:"http1,omitempty"`
-	Http2       *Http2Details `json:"http2,omitempty"`
-	Http3       *Http3Details `json:"http3,omitempty"`
-	TCPIP       TCPIPDetails  `json:"tcpip,omitempty"`
+	Http1       *Http1Details `json:"http1"`
+	TCPIP       *TCPIPDetails `json:"tcpip,omitempty"`
+	// SecondsBeforeHTTPS is the time between the plain request and the linked HTTPS request
+	SecondsBeforeHTTPS float64 `json:"seconds_before_https"`
+	// HeaderOrderMatches compares the header order with the HTTPS request, if it was HTTP/1
+	HeaderOrderMatches *bool `json:"header_order_matches,omitempty"`
+	SameUserAgent      bool  `json:"same_user_agent"`
+}
+
+// RequestBody describes the body sent by the client and how it was framed on the wire
+type RequestBody struct {
+	Size        int    `json:"size"`
+	SHA256      string `json:"sha256"`
+	ContentType string `json:"content_type,omitempty"`
+	// Framing is one of "content-length", "chunked", "data-frames" or "none"
+	Framing string `json:"framing"`
+	// FrameSizes contains the size of every chunk (HTTP/1) or DATA frame (HTTP/2) in order
+	FrameSizes []int  `json:"frame_sizes,omitempty"`
+	Data       []byte `json:"-"`
 }
 
 func (res Response) ToJson() string {
@@ -139,6 +627,9 @@ type SmallResponse struct {
 	PeetPrint     string `json:"peetprint"`
 	PeetPrintHash string `json:"peetprint_hash"`
 	HTTPVersion   string `json:"http_version"`
+	// OS and OSMatchQuality are only set if TCP fingerprinting and an OS database are configured
+	OS             string `json:"os,omitempty"`
+	OSMatchQuality string `json:"os_match_quality,omitempty"`
 }
 
 func (res SmallResponse) ToJson() string {
@@ -150,6 +641,22 @@ func (res SmallResponse) ToJson() string {
 	return string(j)
 }
 
+type EchoResponse struct {
+	Method       string        `json:"method"`
+	HTTPVersion  string        `json:"http_version"`
+	Body         *RequestBody  `json:"body"`
+	Fingerprints SmallResponse `json:"fingerprints"`
+}
+
+func (res EchoResponse) ToJson() string {
+	j, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		log.Println("Error marshalling response", err)
+		return ""
+	}
+	return string(j)
+}
+
 type Priority struct {
 	Weight    int `json:"weight"`
 	DependsOn int `json:"depends_on"`
@@ -173,8 +680,37 @@ type ParsedFrame struct {
 	Flags     []string  `json:"flags,omitempty"`
 	Priority  *Priority `json:"priority,omitempty"`
 	GoAway    *GoAway   `json:"goaway,omitempty"`
+	ErrCode   string    `json:"error_code,omitempty"`
+}
+
+// H2Setting is a single SETTINGS parameter the server sends
+type H2Setting struct {
+	ID    uint16 `json:"id"`
+	Value uint32 `json:"value"`
 }
 
+// H2Profile controls what the server sends on HTTP/2 connections
+type H2Profile struct {
+	// Settings are sent in this order in the server's first SETTINGS frame
+	Settings []H2Setting `json:"settings"`
+	// WindowUpdate is the connection WINDOW_UPDATE increment sent after the SETTINGS, 0 for none
+	WindowUpdate uint32 `json:"window_update"`
+	// MaxDataFrameSize caps the size of DATA frames we send, 0 to only respect the client's limit
+	MaxDataFrameSize uint32 `json:"max_data_frame_size"`
+}
+
+// TCP fingerprint sources
+const (
+	TCPSourcePcap     = "pcap"
+	TCPSourceSavedSYN = "saved_syn"
+)
+
+// Capture backends of the sniffer
+const (
+	CaptureBackendPcap     = "pcap"
+	CaptureBackendAFPacket = "afpacket"
+)
+
 type Config struct {
 	TLSPort      string `json:"tls_port"`
 	HTTPPort     string `json:"http_port"`
@@ -185,6 +721,34 @@ type Config struct {
 	Device       string `json:"device"`
 	CorsKey      string `json:"cors_key"`
 	EnableQUIC   bool   `json:"enable_quic"`
+	// H2Profile is the default HTTP/2 server profile: google, cloudflare, nginx or custom
+	H2Profile       string     `json:"h2_profile"`
+	H2CustomProfile *H2Profile `json:"h2_custom_profile,omitempty"`
+	// Ports of additional HTTP/3 servers that probe the client, disabled if empty
+	QUICRetryPort              string `json:"quic_retry_port,omitempty"`
+	QUICVersionNegotiationPort string `json:"quic_version_negotiation_port,omitempty"`
+	QUICHelloRetryPort         string `json:"quic_hello_retry_port,omitempty"`
+	// TCPSource is where TCP fingerprints come from: pcap (sniffing on Device) or
+	// saved_syn (the SYN the kernel saved for each connection, Linux only)
+	TCPSource string `json:"tcp_source"`
+	// ProxyProtocolTrusted lists the IPs and CIDRs whose connections may
+	// start with a PROXY protocol header
+	ProxyProtocolTrusted []string `json:"proxy_protocol_trusted,omitempty"`
+	// CaptureFile is a pcap or pcapng file that is replayed instead of capturing on Device
+	CaptureFile string `json:"capture_file,omitempty"`
+	// CaptureBackend is pcap (libpcap, needs cgo) or afpacket (Linux only)
+	CaptureBackend string `json:"capture_backend,omitempty"`
+	// CaptureFirstPackets captures every TCP packet to the ports, not only
+	// SYNs, to also record the first ACK and data segment of connections
+	CaptureFirstPackets bool `json:"capture_first_packets,omitempty"`
+	// Limits of the TCP and UDP fingerprint stores, 0 for the defaults (2 minutes, 100000 entries)
+	FingerprintTTLSeconds int `json:"fingerprint_ttl_seconds,omitempty"`
+	FingerprintMaxEntries int `json:"fingerprint_max_entries,omitempty"`
+	// FingerprintWaitMs is how long a request waits for its sniffed fingerprint,
+	// 0 for the default (100ms) and negative to not wait
+	FingerprintWaitMs int `json:"fingerprint_wait_ms,omitempty"`
+	// OSDatabase is a p0f.fp file used to guess the OS of TCP clients, disabled if empty
+	OSDatabase string `json:"os_database,omitempty"`
 }
 
 func (c *Config) LoadFromFile() error {
@@ -209,6 +773,20 @@ func (c *Config) LoadFromFile() error {
 	c.Device = tmp.Device
 	c.CorsKey = tmp.CorsKey
 	c.EnableQUIC = tmp.EnableQUIC
+	c.H2Profile = tmp.H2Profile
+	c.H2CustomProfile = tmp.H2CustomProfile
+	c.QUICRetryPort = tmp.QUICRetryPort
+	c.QUICVersionNegotiationPort = tmp.QUICVersionNegotiationPort
+	c.QUICHelloRetryPort = tmp.QUICHelloRetryPort
+	c.TCPSource = tmp.TCPSource
+	c.ProxyProtocolTrusted = tmp.ProxyProtocolTrusted
+	c.CaptureFile = tmp.CaptureFile
+	c.CaptureBackend = tmp.CaptureBackend
+	c.CaptureFirstPackets = tmp.CaptureFirstPackets
+	c.FingerprintTTLSeconds = tmp.FingerprintTTLSeconds
+	c.FingerprintMaxEntries = tmp.FingerprintMaxEntries
+	c.FingerprintWaitMs = tmp.FingerprintWaitMs
+	c.OSDatabase = tmp.OSDatabase
 	return nil
 }
 
@@ -232,4 +810,7 @@ func (c *Config) MakeDefault() {
 	c.HTTPRedirect = "https://tls.peet.ws"
 	c.CorsKey = "X-CORS"
 	c.EnableQUIC = true
+	c.H2Profile = "google"
+	c.TCPSource = TCPSourcePcap
+	c.CaptureBackend = CaptureBackendPcap
 }
@@ -218,3 +218,14 @@ func ToHexAll(in []string, filterOut bool, shouldSort bool) []string {
 
 	return out
 }
+
+// GuessInitialTTL returns the TTL a packet was most likely sent with, before
+// every hop decremented it
+func GuessInitialTTL(ttl int) int {
+	for _, initial := range []int{32, 64, 128} {
+		if ttl <= initial {
+			return initial
+		}
+	}
+	return 255
+}